@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Page size for GET /registrations, unless ?limit= is given.
+const apiDefaultListLimit = 100
+const apiMaxListLimit = 1000
+
+// Where an AOR (user@domain) is registered, one entry per instance.
+type RegistrationLookupResult struct {
+	Aor           string           `json:"aor"`
+	Registrations []KvBackendValue `json:"registrations"`
+}
+
+type RegistrationListResult struct {
+	// Total number of AORs, across all pages.
+	Total   int                        `json:"total"`
+	Offset  int                        `json:"offset"`
+	Limit   int                        `json:"limit"`
+	Results []RegistrationLookupResult `json:"results"`
+}
+
+// Groups registrations by AOR, sorted by AOR and then by host and port.
+// Entries from before per-instance keys (just user@domain) are grouped under their own key.
+func groupRegistrationsByAor(registrations *Registrations) []RegistrationLookupResult {
+	by_aor := make(map[string][]KvBackendValue)
+	for k, v := range *registrations {
+		aor, _, err := splitRegistrationKey(k)
+		if err != nil {
+			aor = k
+		}
+		by_aor[aor] = append(by_aor[aor], v)
+	}
+	var results []RegistrationLookupResult
+	for aor, values := range by_aor {
+		sort.Sort(kvBackendValuesByHost(values))
+		results = append(results, RegistrationLookupResult{Aor: aor, Registrations: values})
+	}
+	sort.Sort(registrationLookupResultsByAor(results))
+	return results
+}
+
+type kvBackendValuesByHost []KvBackendValue
+
+func (v kvBackendValuesByHost) Len() int      { return len(v) }
+func (v kvBackendValuesByHost) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v kvBackendValuesByHost) Less(i, j int) bool {
+	if v[i].Host != v[j].Host {
+		return v[i].Host < v[j].Host
+	}
+	return v[i].Port < v[j].Port
+}
+
+type registrationLookupResultsByAor []RegistrationLookupResult
+
+func (r registrationLookupResultsByAor) Len() int           { return len(r) }
+func (r registrationLookupResultsByAor) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r registrationLookupResultsByAor) Less(i, j int) bool { return r[i].Aor < r[j].Aor }
+
+func writeApiJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("WARNING: writeApiJson(): %s\n", err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeApiJson(w, status, map[string]string{"error": message})
+}
+
+// Reads (and decodes) everything under key, an empty result if nothing is found.
+func readApiRegistrations(kv_backend KvBackend, key string) (*Registrations, error) {
+	raw_registrations, err := kv_backend.Read(key, true)
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" {
+			return new(Registrations), nil
+		}
+		return nil, err
+	}
+	return generateLastRegistrationsType(raw_registrations)
+}
+
+// GET /registrations/{user@domain} looks up a single AOR.
+// GET /registrations?offset=0&limit=100 lists every AOR, sorted.
+func registrationsHandler(kv_backend KvBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeApiError(w, http.StatusMethodNotAllowed, "Only GET is supported.")
+			return
+		}
+		aor := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/registrations"), "/")
+		if len(aor) == 0 {
+			listRegistrations(w, r, kv_backend)
+			return
+		}
+		if strings.Contains(aor, "/") {
+			writeApiError(w, http.StatusBadRequest, fmt.Sprintf("Invalid AOR '%s', expected user@domain.", aor))
+			return
+		}
+		registrations, err := readApiRegistrations(kv_backend, aor)
+		if err != nil {
+			log.Printf("WARNING: registrationsHandler(): Error reading '%s' from K/V Backend: %s\n", aor, err)
+			writeApiError(w, http.StatusServiceUnavailable, "Error reading from K/V Backend.")
+			return
+		}
+		results := groupRegistrationsByAor(registrations)
+		if len(results) == 0 {
+			writeApiError(w, http.StatusNotFound, fmt.Sprintf("'%s' is not registered.", aor))
+			return
+		}
+		writeApiJson(w, http.StatusOK, results[0])
+	}
+}
+
+func listRegistrations(w http.ResponseWriter, r *http.Request, kv_backend KvBackend) {
+	offset, err := getApiIntParam(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeApiError(w, http.StatusBadRequest, "offset must be 0 or more.")
+		return
+	}
+	limit, err := getApiIntParam(r, "limit", apiDefaultListLimit)
+	if err != nil || limit <= 0 || limit > apiMaxListLimit {
+		writeApiError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d.", apiMaxListLimit))
+		return
+	}
+	registrations, err := readApiRegistrations(kv_backend, "")
+	if err != nil {
+		log.Printf("WARNING: listRegistrations(): Error reading from K/V Backend: %s\n", err)
+		writeApiError(w, http.StatusServiceUnavailable, "Error reading from K/V Backend.")
+		return
+	}
+	all_results := groupRegistrationsByAor(registrations)
+	result := RegistrationListResult{
+		Total:   len(all_results),
+		Offset:  offset,
+		Limit:   limit,
+		Results: []RegistrationLookupResult{},
+	}
+	if offset < len(all_results) {
+		end := offset + limit
+		if end > len(all_results) {
+			end = len(all_results)
+		}
+		result.Results = all_results[offset:end]
+	}
+	writeApiJson(w, http.StatusOK, result)
+}
+
+func getApiIntParam(r *http.Request, name string, default_value int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if len(v) == 0 {
+		return default_value, nil
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGroupRegistrationsByAor(t *testing.T) {
+	input := Registrations{
+		"1001@domain/10.0.0.2:5060": KvBackendValue{Host: "10.0.0.2", Port: 5060},
+		"1001@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+		"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+		// From before per-instance keys.
+		"1002@domain": KvBackendValue{Host: "10.0.0.3", Port: 5060},
+	}
+	expected_result := []RegistrationLookupResult{
+		{Aor: "1000@domain", Registrations: []KvBackendValue{{Host: "10.0.0.1", Port: 5060}}},
+		{Aor: "1001@domain", Registrations: []KvBackendValue{{Host: "10.0.0.1", Port: 5060}, {Host: "10.0.0.2", Port: 5060}}},
+		{Aor: "1002@domain", Registrations: []KvBackendValue{{Host: "10.0.0.3", Port: 5060}}},
+	}
+	result := groupRegistrationsByAor(&input)
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
+
+func doTestApiRequest(t *testing.T, handler http.Handler, method string, path string, v interface{}) int {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if v != nil {
+		err = json.Unmarshal(recorder.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%s %s: %s (%s)", method, path, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestRegistrationsHandler(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	handler := newHttpMux(test_kv_backend, 0)
+
+	// Nothing registered yet.
+	var result1 RegistrationListResult
+	code := doTestApiRequest(t, handler, "GET", "/registrations", &result1)
+	expected_result1 := RegistrationListResult{Total: 0, Offset: 0, Limit: 100, Results: []RegistrationLookupResult{}}
+	if code != http.StatusOK || reflect.DeepEqual(result1, expected_result1) != true {
+		t.Error("Expected 200 and", expected_result1, "got", code, "and", result1)
+	}
+	code = doTestApiRequest(t, handler, "GET", "/registrations/1000@domain", nil)
+	if code != http.StatusNotFound {
+		t.Error("Expected a status code of 404, got", code)
+	}
+
+	for k, v := range map[string]string{
+		"1000@domain/10.0.0.1:5060": "{\"host\":\"10.0.0.1\",\"port\":5060,\"contact\":\"sip:1000@192.168.1.10:5060\"}",
+		"1000@domain/10.0.0.2:5060": "{\"host\":\"10.0.0.2\",\"port\":5060}",
+		"1001@domain/10.0.0.1:5060": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+		"1002@domain/10.0.0.1:5060": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+	} {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var result2 RegistrationLookupResult
+	code = doTestApiRequest(t, handler, "GET", "/registrations/1000@domain", &result2)
+	expected_result2 := RegistrationLookupResult{
+		Aor: "1000@domain",
+		Registrations: []KvBackendValue{
+			{Host: "10.0.0.1", Port: 5060, Contact: "sip:1000@192.168.1.10:5060"},
+			{Host: "10.0.0.2", Port: 5060},
+		},
+	}
+	if code != http.StatusOK || reflect.DeepEqual(result2, expected_result2) != true {
+		t.Error("Expected 200 and", expected_result2, "got", code, "and", result2)
+	}
+
+	// Second page of 2.
+	var result3 RegistrationListResult
+	code = doTestApiRequest(t, handler, "GET", "/registrations?offset=2&limit=2", &result3)
+	expected_result3 := RegistrationListResult{
+		Total:  3,
+		Offset: 2,
+		Limit:  2,
+		Results: []RegistrationLookupResult{
+			{Aor: "1002@domain", Registrations: []KvBackendValue{{Host: "10.0.0.1", Port: 5060}}},
+		},
+	}
+	if code != http.StatusOK || reflect.DeepEqual(result3, expected_result3) != true {
+		t.Error("Expected 200 and", expected_result3, "got", code, "and", result3)
+	}
+
+	// Error scenarios.
+	for _, v := range []string{"/registrations?limit=0", "/registrations?limit=1001", "/registrations?offset=-1", "/registrations?offset=abc", "/registrations/1000@domain/10.0.0.1:5060"} {
+		code = doTestApiRequest(t, handler, "GET", v, nil)
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected a status code of 400 for '%s', got %d", v, code)
+		}
+	}
+	code = doTestApiRequest(t, handler, "DELETE", "/registrations/1000@domain", nil)
+	if code != http.StatusMethodNotAllowed {
+		t.Error("Expected a status code of 405, got", code)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"path"
 	"strings"
 
 	"gopkg.in/urfave/cli.v1"
@@ -10,58 +12,380 @@ import (
 
 type ArgConfig struct {
 	// FreeSWITCH
-	FreeswitchHost          string
-	FreeswitchPort          int
-	FreeswitchEslPassword   string
+	FreeswitchHost        string
+	FreeswitchPort        int
+	FreeswitchEslPassword string
+	// Empty with --fsprofiles auto, the running profiles are fetched from FreeSWITCH on each sync instead.
 	FreeswitchSofiaProfiles []string
+	// --fsprofiles auto only, glob patterns (as per path.Match) the running profiles are filtered by.
+	FreeswitchSofiaProfilesAuto    bool
+	FreeswitchSofiaProfilesInclude []string
+	FreeswitchSofiaProfilesExclude []string
+	// Empty/0 with --fsadvertisefrom, derived from each Sofia profile on each sync instead.
 	FreeswitchAdvertiseIp   string
 	FreeswitchAdvertisePort int
+	// Empty, or one of advertiseFromValues.
+	FreeswitchAdvertiseFrom string
 	// Key/Value Store
 	KvBackend string
 	KvHost    string
 	KvPort    int
 	KvPrefix  string
+	// Backend specific configuration, passed through to CreateKvBackend()
+	KvOptions map[string]string
+	KvTtl     int
 	//
 	SyncInterval uint32
+	// Delete this instance's registrations on shutdown, instead of leaving them to expire.
+	WithdrawOnExit bool
+	// Empty if the HTTP endpoints are disabled.
+	HttpListen string
+	// Seconds without activity from the event loop before /healthz fails.
+	LivenessThreshold int
+	LogLevel          string
+	// Empty if the DNS responder is disabled.
+	DnsListen string
+	DnsZone   string
+	// Log changes to the K/V backend instead of making them.
+	DryRun bool
+	// Empty if not recording messages from FreeSWITCH.
+	RecordFile string
+	// Subcommands.
+	RedirectListen string
+	OutputFormat   string
+	// Registrations of this instance only (dump, purge), any host/port if empty/0.
+	FilterHost string
+	FilterPort int
+	LookupAor  string
+	ReplayFile string
+	// 0 for as fast as possible.
+	ReplaySpeed float64
+	// Replay into an in-memory K/V store, instead of --kvbackend.
+	ReplayMemory bool
 }
 
+// Output formats of the subcommands that print results.
+var outputFormats = []string{"text", "json"}
+
 func parseFlags(c *cli.Context) (*ArgConfig, error) {
 	var result ArgConfig
 
-	for _, v := range []string{"fshost", "fspassword", "fsprofiles", "fsadvertiseip", "kvhost", "kvprefix"} {
+	for _, v := range []string{"fshost", "fspassword", "fsprofiles"} {
 		if len(c.String(v)) == 0 {
 			return new(ArgConfig), fmt.Errorf("Error: --%s must not be empty.", v)
 		}
 	}
-	for _, v := range []string{"fsport", "fsadvertiseport", "kvport"} {
-		if c.Int(v) <= 0 {
-			return new(ArgConfig), fmt.Errorf("Error: --%s must not be 0 (or empty).", v)
-		}
-		if c.Int(v) > 65536 {
-			return new(ArgConfig), fmt.Errorf("Error: --%s must be below 65536.", v)
-		}
+	if err := validatePortFlag(c, "fsport"); err != nil {
+		return new(ArgConfig), err
 	}
 	result.FreeswitchHost = c.String("fshost")
 	result.FreeswitchPort = c.Int("fsport")
 	result.FreeswitchEslPassword = c.String("fspassword")
-	result.FreeswitchAdvertiseIp = c.String("fsadvertiseip")
-	result.FreeswitchAdvertisePort = c.Int("fsadvertiseport")
-	result.KvHost = c.String("kvhost")
-	result.KvPort = c.Int("kvport")
-	result.KvPrefix = c.String("kvprefix")
+	if err := parseAdvertiseFlags(c, &result); err != nil {
+		return new(ArgConfig), err
+	}
 
-	available_backends := availableKvBackends()
-	if stringInSlice(c.String("kvbackend"), available_backends) != true {
-		return new(ArgConfig), fmt.Errorf("Error: --kvbackend must be one of: %s", strings.Join(available_backends, ", "))
+	if err := parseKvFlags(c, &result); err != nil {
+		return new(ArgConfig), err
 	}
-	result.KvBackend = c.String("kvbackend")
 
 	if uint32(c.Int("syncinterval")) <= 0 {
 		return new(ArgConfig), errors.New("Error: --syncinterval must not be 0 (or empty).")
 	}
 	result.SyncInterval = uint32(c.Int("syncinterval"))
 
-	result.FreeswitchSofiaProfiles = strings.Split(c.String("fsprofiles"), ",")
+	result.WithdrawOnExit = c.Bool("withdrawonexit")
+	result.DryRun = c.Bool("dry-run")
+	result.RecordFile = c.String("record")
+
+	if len(c.String("httplisten")) > 0 {
+		if _, _, err := net.SplitHostPort(c.String("httplisten")); err != nil {
+			return new(ArgConfig), fmt.Errorf("Error: --httplisten must be in the format [host]:port, got '%s'.", c.String("httplisten"))
+		}
+	}
+	result.HttpListen = c.String("httplisten")
+
+	if c.Int("livenessthreshold") <= 0 {
+		return new(ArgConfig), errors.New("Error: --livenessthreshold must not be 0 (or empty).")
+	}
+	result.LivenessThreshold = c.Int("livenessthreshold")
+
+	if stringInSlice(c.String("loglevel"), logLevels) != true {
+		return new(ArgConfig), fmt.Errorf("Error: --loglevel must be one of: %s", strings.Join(logLevels, ", "))
+	}
+	result.LogLevel = c.String("loglevel")
+
+	if len(c.String("dnslisten")) > 0 {
+		if _, _, err := net.SplitHostPort(c.String("dnslisten")); err != nil {
+			return new(ArgConfig), fmt.Errorf("Error: --dnslisten must be in the format [host]:port, got '%s'.", c.String("dnslisten"))
+		}
+		if len(strings.Trim(c.String("dnszone"), ".")) == 0 {
+			return new(ArgConfig), errors.New("Error: --dnszone must not be empty when --dnslisten is set.")
+		}
+	}
+	result.DnsListen = c.String("dnslisten")
+	result.DnsZone = c.String("dnszone")
+
+	if err := parseSofiaProfileFlags(c, &result); err != nil {
+		return new(ArgConfig), err
+	}
+
+	return &result, nil
+}
+
+// Either --fsadvertiseip and --fsadvertiseport, or --fsadvertisefrom to derive them from each Sofia profile.
+func parseAdvertiseFlags(c *cli.Context, result *ArgConfig) error {
+	if len(c.String("fsadvertisefrom")) == 0 {
+		if len(c.String("fsadvertiseip")) == 0 {
+			return errors.New("Error: --fsadvertiseip must not be empty.")
+		}
+		if err := validatePortFlag(c, "fsadvertiseport"); err != nil {
+			return err
+		}
+		result.FreeswitchAdvertiseIp = c.String("fsadvertiseip")
+		result.FreeswitchAdvertisePort = c.Int("fsadvertiseport")
+		return nil
+	}
+	if stringInSlice(c.String("fsadvertisefrom"), advertiseFromValues) != true {
+		return fmt.Errorf("Error: --fsadvertisefrom must be one of: %s", strings.Join(advertiseFromValues, ", "))
+	}
+	if len(c.String("fsadvertiseip")) > 0 || c.Int("fsadvertiseport") != 0 {
+		return errors.New("Error: --fsadvertiseip/--fsadvertiseport cannot be combined with --fsadvertisefrom.")
+	}
+	result.FreeswitchAdvertiseFrom = c.String("fsadvertisefrom")
+	return nil
+}
+
+// --fsprofiles is either a list of profiles or "auto", the include/exclude patterns only apply to the latter.
+func parseSofiaProfileFlags(c *cli.Context, result *ArgConfig) error {
+	profiles := strings.Split(c.String("fsprofiles"), ",")
+	if stringInSlice(sofiaProfilesAuto, profiles) == false {
+		for _, v := range []string{"fsprofilesinclude", "fsprofilesexclude"} {
+			if len(c.String(v)) > 0 {
+				return fmt.Errorf("Error: --%s is only used with --fsprofiles %s.", v, sofiaProfilesAuto)
+			}
+		}
+		result.FreeswitchSofiaProfiles = profiles
+		return nil
+	}
+	if len(profiles) > 1 {
+		return fmt.Errorf("Error: --fsprofiles %s cannot be combined with other Sofia Profiles.", sofiaProfilesAuto)
+	}
+	result.FreeswitchSofiaProfilesAuto = true
+	for _, v := range []string{"fsprofilesinclude", "fsprofilesexclude"} {
+		if len(c.String(v)) == 0 {
+			continue
+		}
+		patterns := strings.Split(c.String(v), ",")
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+				return fmt.Errorf("Error: --%s has an invalid pattern '%s'.", v, pattern)
+			}
+		}
+		if v == "fsprofilesinclude" {
+			result.FreeswitchSofiaProfilesInclude = patterns
+		} else {
+			result.FreeswitchSofiaProfilesExclude = patterns
+		}
+	}
+	return nil
+}
+
+// The global flags needed by the subcommands that only use the K/V store, c is the subcommand's context.
+func parseCommandKvFlags(c *cli.Context) (*ArgConfig, error) {
+	var result ArgConfig
+
+	if err := parseKvFlags(c.Parent(), &result); err != nil {
+		return new(ArgConfig), err
+	}
+
+	if stringInSlice(c.Parent().String("loglevel"), logLevels) != true {
+		return new(ArgConfig), fmt.Errorf("Error: --loglevel must be one of: %s", strings.Join(logLevels, ", "))
+	}
+	result.LogLevel = c.Parent().String("loglevel")
+	result.DryRun = c.Parent().Bool("dry-run")
 
 	return &result, nil
 }
+
+func parseOutputFormatFlag(c *cli.Context, result *ArgConfig) error {
+	if stringInSlice(c.String("format"), outputFormats) != true {
+		return fmt.Errorf("Error: --format must be one of: %s", strings.Join(outputFormats, ", "))
+	}
+	result.OutputFormat = c.String("format")
+	return nil
+}
+
+// Flags for the redirect subcommand.
+func parseRedirectFlags(c *cli.Context) (*ArgConfig, error) {
+	result, err := parseCommandKvFlags(c)
+	if err != nil {
+		return new(ArgConfig), err
+	}
+
+	if _, _, err := net.SplitHostPort(c.String("listen")); err != nil {
+		return new(ArgConfig), fmt.Errorf("Error: --listen must be in the format [host]:port, got '%s'.", c.String("listen"))
+	}
+	result.RedirectListen = c.String("listen")
+
+	return result, nil
+}
+
+// Flags for the sync subcommand, everything is global (given before the subcommand) as for a normal run.
+func parseSyncFlags(c *cli.Context) (*ArgConfig, error) {
+	return parseFlags(c.Parent())
+}
+
+// Flags for the diff subcommand, as for sync.
+func parseDiffFlags(c *cli.Context) (*ArgConfig, error) {
+	result, err := parseFlags(c.Parent())
+	if err != nil {
+		return new(ArgConfig), err
+	}
+
+	if err := parseOutputFormatFlag(c, result); err != nil {
+		return new(ArgConfig), err
+	}
+
+	return result, nil
+}
+
+// Flags for the dump subcommand.
+func parseDumpFlags(c *cli.Context) (*ArgConfig, error) {
+	result, err := parseCommandKvFlags(c)
+	if err != nil {
+		return new(ArgConfig), err
+	}
+
+	// 0 (the default) matches any port.
+	if c.Int("port") < 0 {
+		return new(ArgConfig), errors.New("Error: --port must not be negative.")
+	}
+	if c.Int("port") > 65536 {
+		return new(ArgConfig), errors.New("Error: --port must be below 65536.")
+	}
+	result.FilterHost = c.String("host")
+	result.FilterPort = c.Int("port")
+
+	if err := parseOutputFormatFlag(c, result); err != nil {
+		return new(ArgConfig), err
+	}
+
+	return result, nil
+}
+
+// Flags for the lookup subcommand, the AOR is the only argument.
+func parseLookupFlags(c *cli.Context) (*ArgConfig, error) {
+	result, err := parseCommandKvFlags(c)
+	if err != nil {
+		return new(ArgConfig), err
+	}
+
+	if c.NArg() != 1 || strings.Contains(c.Args().First(), "@") == false || strings.Contains(c.Args().First(), "/") {
+		return new(ArgConfig), errors.New("Error: Expected a single user@domain argument.")
+	}
+	result.LookupAor = c.Args().First()
+
+	if err := parseOutputFormatFlag(c, result); err != nil {
+		return new(ArgConfig), err
+	}
+
+	return result, nil
+}
+
+// Flags for the replay subcommand, the recording is the only argument. Nothing connects to FreeSWITCH, but the
+// --fsprofiles and --fsadvertiseip/--fsadvertiseport (or --fsadvertisefrom) of the recorded instance are needed to
+// filter its events and reconcile its syncs.
+func parseReplayFlags(c *cli.Context) (*ArgConfig, error) {
+	result, err := parseCommandKvFlags(c)
+	if err != nil {
+		return new(ArgConfig), err
+	}
+	if len(c.Parent().String("fsprofiles")) == 0 {
+		return new(ArgConfig), errors.New("Error: --fsprofiles must not be empty.")
+	}
+	if err := parseSofiaProfileFlags(c.Parent(), result); err != nil {
+		return new(ArgConfig), err
+	}
+	if err := parseAdvertiseFlags(c.Parent(), result); err != nil {
+		return new(ArgConfig), err
+	}
+
+	if c.NArg() != 1 || len(c.Args().First()) == 0 {
+		return new(ArgConfig), errors.New("Error: Expected a single file argument.")
+	}
+	result.ReplayFile = c.Args().First()
+	if c.Float64("speed") < 0 {
+		return new(ArgConfig), errors.New("Error: --speed must not be negative.")
+	}
+	result.ReplaySpeed = c.Float64("speed")
+	result.ReplayMemory = c.Bool("memory")
+
+	return result, nil
+}
+
+// Flags for the purge subcommand, both the host and port are required so only a single instance is purged.
+func parsePurgeFlags(c *cli.Context) (*ArgConfig, error) {
+	result, err := parseCommandKvFlags(c)
+	if err != nil {
+		return new(ArgConfig), err
+	}
+
+	if len(c.String("host")) == 0 {
+		return new(ArgConfig), errors.New("Error: --host must not be empty.")
+	}
+	if err := validatePortFlag(c, "port"); err != nil {
+		return new(ArgConfig), err
+	}
+	result.FilterHost = c.String("host")
+	result.FilterPort = c.Int("port")
+
+	return result, nil
+}
+
+// The K/V store flags, shared by the subcommands that only need to read from the K/V store.
+func parseKvFlags(c *cli.Context, result *ArgConfig) error {
+	for _, v := range []string{"kvhost", "kvprefix"} {
+		if len(c.String(v)) == 0 {
+			return fmt.Errorf("Error: --%s must not be empty.", v)
+		}
+	}
+	if err := validatePortFlag(c, "kvport"); err != nil {
+		return err
+	}
+	result.KvHost = c.String("kvhost")
+	result.KvPort = c.Int("kvport")
+	result.KvPrefix = c.String("kvprefix")
+
+	result.KvOptions = make(map[string]string)
+	for _, v := range c.StringSlice("kvoption") {
+		split_v := strings.SplitN(v, "=", 2)
+		if len(split_v) != 2 || len(split_v[0]) == 0 {
+			return fmt.Errorf("Error: --kvoption must be in the format key=value, got '%s'.", v)
+		}
+		result.KvOptions[split_v[0]] = split_v[1]
+	}
+
+	if c.Int("kvttl") <= 0 {
+		return errors.New("Error: --kvttl must not be 0 (or empty).")
+	}
+	result.KvTtl = c.Int("kvttl")
+
+	available_backends := availableKvBackends()
+	if stringInSlice(c.String("kvbackend"), available_backends) != true {
+		return fmt.Errorf("Error: --kvbackend must be one of: %s", strings.Join(available_backends, ", "))
+	}
+	result.KvBackend = c.String("kvbackend")
+
+	return nil
+}
+
+func validatePortFlag(c *cli.Context, name string) error {
+	if c.Int(name) <= 0 {
+		return fmt.Errorf("Error: --%s must not be 0 (or empty).", name)
+	}
+	if c.Int(name) > 65536 {
+		return fmt.Errorf("Error: --%s must be below 65536.", name)
+	}
+	return nil
+}
@@ -22,7 +22,17 @@ func TestParseFlags(t *testing.T) {
 	expected_result1.KvHost = "somekvhost"
 	expected_result1.KvPort = 2380
 	expected_result1.KvPrefix = "someprefix"
+	expected_result1.KvOptions = map[string]string{"db": "2", "password": "some=pass"}
+	expected_result1.KvTtl = 120
 	expected_result1.SyncInterval = 330
+	expected_result1.WithdrawOnExit = true
+	expected_result1.HttpListen = ":9090"
+	expected_result1.LivenessThreshold = 60
+	expected_result1.LogLevel = "debug"
+	expected_result1.DnsListen = "127.0.0.1:5353"
+	expected_result1.DnsZone = "reg.example"
+	expected_result1.DryRun = true
+	expected_result1.RecordFile = "/tmp/esl.jsonl"
 
 	set1 := flag.NewFlagSet("test1", 0)
 	set1.String("fshost", "somehost", "doc")
@@ -35,7 +45,17 @@ func TestParseFlags(t *testing.T) {
 	set1.String("kvhost", "somekvhost", "doc")
 	set1.Int("kvport", 2380, "doc")
 	set1.String("kvprefix", "someprefix", "doc")
+	set1.Var(&cli.StringSlice{"db=2", "password=some=pass"}, "kvoption", "doc")
+	set1.Int("kvttl", 120, "doc")
 	set1.Int("syncinterval", 330, "doc")
+	set1.Bool("withdrawonexit", true, "doc")
+	set1.String("httplisten", ":9090", "doc")
+	set1.Int("livenessthreshold", 60, "doc")
+	set1.String("loglevel", "debug", "doc")
+	set1.String("dnslisten", "127.0.0.1:5353", "doc")
+	set1.String("dnszone", "reg.example", "doc")
+	set1.Bool("dry-run", true, "doc")
+	set1.String("record", "/tmp/esl.jsonl", "doc")
 	context1 := cli.NewContext(nil, set1, nil)
 
 	result1, err := parseFlags(context1)
@@ -105,6 +125,7 @@ func TestParseFlags(t *testing.T) {
 	set5.String("kvhost", "somekvhost", "doc")
 	set5.Int("kvport", 2380, "doc")
 	set5.String("kvprefix", "someprefix", "doc")
+	set5.Int("kvttl", 300, "doc")
 	set5.String("kvbackend", "randombackend", "doc")
 	context5 := cli.NewContext(nil, set5, nil)
 	_, err = parseFlags(context5)
@@ -126,6 +147,7 @@ func TestParseFlags(t *testing.T) {
 	set6.String("kvhost", "somekvhost", "doc")
 	set6.Int("kvport", 2380, "doc")
 	set6.String("kvprefix", "someprefix", "doc")
+	set6.Int("kvttl", 300, "doc")
 	set6.String("kvbackend", "etcd", "doc")
 	set6.Int("syncinterval", 0, "doc")
 	context6 := cli.NewContext(nil, set6, nil)
@@ -137,4 +159,394 @@ func TestParseFlags(t *testing.T) {
 	if err.Error() != expected_err6 {
 		t.Error("Expected error of", expected_err6, "got", err.Error())
 	}
+	//
+	set7 := flag.NewFlagSet("test1", 0)
+	set7.String("fshost", "somehost", "doc")
+	set7.Int("fsport", 8022, "doc")
+	set7.String("fspassword", "somepass", "doc")
+	set7.String("fsprofiles", "profile1,profile2", "doc")
+	set7.String("fsadvertiseip", "10.3.4.5", "doc")
+	set7.Int("fsadvertiseport", 5071, "doc")
+	set7.String("kvhost", "somekvhost", "doc")
+	set7.Int("kvport", 2380, "doc")
+	set7.String("kvprefix", "someprefix", "doc")
+	set7.Var(&cli.StringSlice{"nokeyvalue"}, "kvoption", "doc")
+	context7 := cli.NewContext(nil, set7, nil)
+	_, err = parseFlags(context7)
+	if err == nil {
+		t.Error("Expected error, got nil error")
+	}
+	expected_err7 := "Error: --kvoption must be in the format key=value, got 'nokeyvalue'."
+	if err.Error() != expected_err7 {
+		t.Error("Expected error of", expected_err7, "got", err.Error())
+	}
+	//
+	set8 := flag.NewFlagSet("test1", 0)
+	set8.String("fshost", "somehost", "doc")
+	set8.Int("fsport", 8022, "doc")
+	set8.String("fspassword", "somepass", "doc")
+	set8.String("fsprofiles", "profile1,profile2", "doc")
+	set8.String("fsadvertiseip", "10.3.4.5", "doc")
+	set8.Int("fsadvertiseport", 5071, "doc")
+	set8.String("kvhost", "somekvhost", "doc")
+	set8.Int("kvport", 2380, "doc")
+	set8.String("kvprefix", "someprefix", "doc")
+	set8.Int("kvttl", 0, "doc")
+	context8 := cli.NewContext(nil, set8, nil)
+	_, err = parseFlags(context8)
+	if err == nil {
+		t.Error("Expected error, got nil error")
+	}
+	expected_err8 := "Error: --kvttl must not be 0 (or empty)."
+	if err.Error() != expected_err8 {
+		t.Error("Expected error of", expected_err8, "got", err.Error())
+	}
+	//
+	set9 := flag.NewFlagSet("test1", 0)
+	set9.String("fshost", "somehost", "doc")
+	set9.Int("fsport", 8022, "doc")
+	set9.String("fspassword", "somepass", "doc")
+	set9.String("fsprofiles", "profile1,profile2", "doc")
+	set9.String("fsadvertiseip", "10.3.4.5", "doc")
+	set9.Int("fsadvertiseport", 5071, "doc")
+	set9.String("kvhost", "somekvhost", "doc")
+	set9.Int("kvport", 2380, "doc")
+	set9.String("kvprefix", "someprefix", "doc")
+	set9.Int("kvttl", 300, "doc")
+	set9.String("kvbackend", "etcd", "doc")
+	set9.Int("syncinterval", 330, "doc")
+	set9.String("httplisten", "9090", "doc")
+	context9 := cli.NewContext(nil, set9, nil)
+	_, err = parseFlags(context9)
+	if err == nil {
+		t.Error("Expected error, got nil error")
+	}
+	expected_err9 := "Error: --httplisten must be in the format [host]:port, got '9090'."
+	if err.Error() != expected_err9 {
+		t.Error("Expected error of", expected_err9, "got", err.Error())
+	}
+	//
+	set10 := flag.NewFlagSet("test1", 0)
+	set10.String("fshost", "somehost", "doc")
+	set10.Int("fsport", 8022, "doc")
+	set10.String("fspassword", "somepass", "doc")
+	set10.String("fsprofiles", "profile1,profile2", "doc")
+	set10.String("fsadvertiseip", "10.3.4.5", "doc")
+	set10.Int("fsadvertiseport", 5071, "doc")
+	set10.String("kvhost", "somekvhost", "doc")
+	set10.Int("kvport", 2380, "doc")
+	set10.String("kvprefix", "someprefix", "doc")
+	set10.Int("kvttl", 300, "doc")
+	set10.String("kvbackend", "etcd", "doc")
+	set10.Int("syncinterval", 330, "doc")
+	set10.Int("livenessthreshold", 0, "doc")
+	context10 := cli.NewContext(nil, set10, nil)
+	_, err = parseFlags(context10)
+	if err == nil {
+		t.Error("Expected error, got nil error")
+	}
+	expected_err10 := "Error: --livenessthreshold must not be 0 (or empty)."
+	if err.Error() != expected_err10 {
+		t.Error("Expected error of", expected_err10, "got", err.Error())
+	}
+	//
+	set11 := flag.NewFlagSet("test1", 0)
+	set11.String("fshost", "somehost", "doc")
+	set11.Int("fsport", 8022, "doc")
+	set11.String("fspassword", "somepass", "doc")
+	set11.String("fsprofiles", "profile1,profile2", "doc")
+	set11.String("fsadvertiseip", "10.3.4.5", "doc")
+	set11.Int("fsadvertiseport", 5071, "doc")
+	set11.String("kvhost", "somekvhost", "doc")
+	set11.Int("kvport", 2380, "doc")
+	set11.String("kvprefix", "someprefix", "doc")
+	set11.Int("kvttl", 300, "doc")
+	set11.String("kvbackend", "etcd", "doc")
+	set11.Int("syncinterval", 330, "doc")
+	set11.Int("livenessthreshold", 60, "doc")
+	set11.String("loglevel", "verbose", "doc")
+	context11 := cli.NewContext(nil, set11, nil)
+	_, err = parseFlags(context11)
+	if err == nil {
+		t.Error("Expected error, got nil error")
+	}
+	expected_err11 := "Error: --loglevel must be one of: debug, info"
+	if err.Error() != expected_err11 {
+		t.Error("Expected error of", expected_err11, "got", err.Error())
+	}
+	//
+	set12 := flag.NewFlagSet("test1", 0)
+	set12.String("fshost", "somehost", "doc")
+	set12.Int("fsport", 8022, "doc")
+	set12.String("fspassword", "somepass", "doc")
+	set12.String("fsprofiles", "profile1,profile2", "doc")
+	set12.String("fsadvertiseip", "10.3.4.5", "doc")
+	set12.Int("fsadvertiseport", 5071, "doc")
+	set12.String("kvhost", "somekvhost", "doc")
+	set12.Int("kvport", 2380, "doc")
+	set12.String("kvprefix", "someprefix", "doc")
+	set12.Int("kvttl", 300, "doc")
+	set12.String("kvbackend", "etcd", "doc")
+	set12.Int("syncinterval", 330, "doc")
+	set12.Int("livenessthreshold", 60, "doc")
+	set12.String("loglevel", "info", "doc")
+	set12.String("dnslisten", ":5353", "doc")
+	set12.String("dnszone", ".", "doc")
+	context12 := cli.NewContext(nil, set12, nil)
+	_, err = parseFlags(context12)
+	if err == nil {
+		t.Error("Expected error, got nil error")
+	}
+	expected_err12 := "Error: --dnszone must not be empty when --dnslisten is set."
+	if err.Error() != expected_err12 {
+		t.Error("Expected error of", expected_err12, "got", err.Error())
+	}
+}
+
+func TestParseSofiaProfileFlags(t *testing.T) {
+	set1 := flag.NewFlagSet("test1", 0)
+	set1.String("fsprofiles", "auto", "doc")
+	set1.String("fsprofilesinclude", "internal*,external", "doc")
+	set1.String("fsprofilesexclude", "*-ipv6", "doc")
+	var result1 ArgConfig
+	if err := parseSofiaProfileFlags(cli.NewContext(nil, set1, nil), &result1); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected_result1 := ArgConfig{
+		FreeswitchSofiaProfilesAuto:    true,
+		FreeswitchSofiaProfilesInclude: []string{"internal*", "external"},
+		FreeswitchSofiaProfilesExclude: []string{"*-ipv6"},
+	}
+	if reflect.DeepEqual(result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+
+	for _, v := range []struct {
+		profiles     string
+		include      string
+		exclude      string
+		expected_err string
+	}{
+		{"internal", "internal*", "", "Error: --fsprofilesinclude is only used with --fsprofiles auto."},
+		{"internal,external", "", "ext*", "Error: --fsprofilesexclude is only used with --fsprofiles auto."},
+		{"auto,internal", "", "", "Error: --fsprofiles auto cannot be combined with other Sofia Profiles."},
+		{"auto", "internal[", "", "Error: --fsprofilesinclude has an invalid pattern 'internal['."},
+		{"auto", "", "internal,", "Error: --fsprofilesexclude has an invalid pattern ''."},
+	} {
+		set2 := flag.NewFlagSet("test2", 0)
+		set2.String("fsprofiles", v.profiles, "doc")
+		set2.String("fsprofilesinclude", v.include, "doc")
+		set2.String("fsprofilesexclude", v.exclude, "doc")
+		var result2 ArgConfig
+		err := parseSofiaProfileFlags(cli.NewContext(nil, set2, nil), &result2)
+		if err == nil || err.Error() != v.expected_err {
+			t.Error("Expected error of", v.expected_err, "got", err)
+		}
+	}
+}
+
+func TestParseAdvertiseFlags(t *testing.T) {
+	set1 := flag.NewFlagSet("test1", 0)
+	set1.String("fsadvertiseip", "", "doc")
+	set1.String("fsadvertiseport", "", "doc")
+	set1.String("fsadvertisefrom", "ext-sip-ip", "doc")
+	var result1 ArgConfig
+	if err := parseAdvertiseFlags(cli.NewContext(nil, set1, nil), &result1); err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if expected_result1 := (ArgConfig{FreeswitchAdvertiseFrom: "ext-sip-ip"}); reflect.DeepEqual(result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+
+	for _, v := range []struct {
+		ip           string
+		port         string
+		from         string
+		expected_err string
+	}{
+		{"", "5060", "", "Error: --fsadvertiseip must not be empty."},
+		{"10.0.0.1", "", "", "Error: --fsadvertiseport must not be 0 (or empty)."},
+		{"", "", "rtp-ip", "Error: --fsadvertisefrom must be one of: sip-ip, ext-sip-ip"},
+		{"10.0.0.1", "", "sip-ip", "Error: --fsadvertiseip/--fsadvertiseport cannot be combined with --fsadvertisefrom."},
+		{"", "5060", "sip-ip", "Error: --fsadvertiseip/--fsadvertiseport cannot be combined with --fsadvertisefrom."},
+	} {
+		set2 := flag.NewFlagSet("test2", 0)
+		set2.String("fsadvertiseip", v.ip, "doc")
+		set2.String("fsadvertiseport", v.port, "doc")
+		set2.String("fsadvertisefrom", v.from, "doc")
+		var result2 ArgConfig
+		err := parseAdvertiseFlags(cli.NewContext(nil, set2, nil), &result2)
+		if err == nil || err.Error() != v.expected_err {
+			t.Error("Expected error of", v.expected_err, "got", err)
+		}
+	}
+}
+
+func TestParseRedirectFlags(t *testing.T) {
+	global_set := flag.NewFlagSet("test", 0)
+	global_set.String("kvhost", "somekvhost", "doc")
+	global_set.Int("kvport", 8500, "doc")
+	global_set.String("kvprefix", "someprefix", "doc")
+	global_set.Int("kvttl", 300, "doc")
+	global_set.String("kvbackend", "consul", "doc")
+	global_set.Var(&cli.StringSlice{"token=abc"}, "kvoption", "doc")
+	global_set.String("loglevel", "info", "doc")
+	// The FreeSWITCH flags aren't needed.
+	global_set.String("fsadvertiseip", "", "doc")
+	global_context := cli.NewContext(nil, global_set, nil)
+
+	set1 := flag.NewFlagSet("redirect", 0)
+	set1.String("listen", "127.0.0.1:5070", "doc")
+	result1, err := parseRedirectFlags(cli.NewContext(nil, set1, global_context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_result1 := &ArgConfig{
+		KvBackend:      "consul",
+		KvHost:         "somekvhost",
+		KvPort:         8500,
+		KvPrefix:       "someprefix",
+		KvOptions:      map[string]string{"token": "abc"},
+		KvTtl:          300,
+		LogLevel:       "info",
+		RedirectListen: "127.0.0.1:5070",
+	}
+	if reflect.DeepEqual(result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+
+	set2 := flag.NewFlagSet("redirect", 0)
+	set2.String("listen", "5070", "doc")
+	_, err = parseRedirectFlags(cli.NewContext(nil, set2, global_context))
+	expected_err2 := "Error: --listen must be in the format [host]:port, got '5070'."
+	if err == nil || err.Error() != expected_err2 {
+		t.Error("Expected error of", expected_err2, "got", err)
+	}
+}
+
+func TestParseReplayFlags(t *testing.T) {
+	// No --fshost/--fspassword, nothing connects to FreeSWITCH.
+	global_set := flag.NewFlagSet("test", 0)
+	global_set.String("fsprofiles", "internal", "doc")
+	global_set.String("fsadvertiseip", "10.3.4.5", "doc")
+	global_set.Int("fsadvertiseport", 5071, "doc")
+	global_set.String("kvhost", "somekvhost", "doc")
+	global_set.Int("kvport", 8500, "doc")
+	global_set.String("kvprefix", "someprefix", "doc")
+	global_set.Int("kvttl", 300, "doc")
+	global_set.String("kvbackend", "consul", "doc")
+	global_set.String("loglevel", "info", "doc")
+	global_context := cli.NewContext(nil, global_set, nil)
+
+	set1 := flag.NewFlagSet("replay", 0)
+	set1.Float64("speed", 10, "doc")
+	set1.Bool("memory", true, "doc")
+	set1.Parse([]string{"/tmp/esl.jsonl"})
+	result1, err := parseReplayFlags(cli.NewContext(nil, set1, global_context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result1.ReplayFile != "/tmp/esl.jsonl" || result1.ReplaySpeed != 10 || result1.ReplayMemory != true || result1.FreeswitchAdvertiseIp != "10.3.4.5" {
+		t.Error("Expected ReplayFile /tmp/esl.jsonl, ReplaySpeed 10, ReplayMemory true and FreeswitchAdvertiseIp 10.3.4.5, got", result1)
+	}
+	set1.Set("speed", "-1")
+	_, err = parseReplayFlags(cli.NewContext(nil, set1, global_context))
+	expected_err1 := "Error: --speed must not be negative."
+	if err == nil || err.Error() != expected_err1 {
+		t.Error("Expected error of", expected_err1, "got", err)
+	}
+	for _, v := range [][]string{{}, {""}, {"/tmp/esl.jsonl", "/tmp/esl2.jsonl"}} {
+		set2 := flag.NewFlagSet("replay", 0)
+		set2.Float64("speed", 1, "doc")
+		set2.Parse(v)
+		_, err = parseReplayFlags(cli.NewContext(nil, set2, global_context))
+		expected_err2 := "Error: Expected a single file argument."
+		if err == nil || err.Error() != expected_err2 {
+			t.Error("Expected error of", expected_err2, "for", v, "got", err)
+		}
+	}
+}
+
+func TestParseCommandFlags(t *testing.T) {
+	global_set := flag.NewFlagSet("test", 0)
+	global_set.String("kvhost", "somekvhost", "doc")
+	global_set.Int("kvport", 8500, "doc")
+	global_set.String("kvprefix", "someprefix", "doc")
+	global_set.Int("kvttl", 300, "doc")
+	global_set.String("kvbackend", "consul", "doc")
+	global_set.String("loglevel", "info", "doc")
+	global_set.Bool("dry-run", true, "doc")
+	global_context := cli.NewContext(nil, global_set, nil)
+
+	// dump
+	dump_set := flag.NewFlagSet("dump", 0)
+	dump_set.String("host", "10.0.0.1", "doc")
+	dump_set.Int("port", 0, "doc")
+	dump_set.String("format", "json", "doc")
+	result1, err := parseDumpFlags(cli.NewContext(nil, dump_set, global_context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result1.FilterHost != "10.0.0.1" || result1.FilterPort != 0 || result1.OutputFormat != "json" || result1.DryRun != true || result1.KvBackend != "consul" {
+		t.Error("Expected FilterHost 10.0.0.1, FilterPort 0, OutputFormat json, DryRun true and KvBackend consul, got", result1)
+	}
+	dump_set.Set("format", "xml")
+	_, err = parseDumpFlags(cli.NewContext(nil, dump_set, global_context))
+	expected_err1 := "Error: --format must be one of: text, json"
+	if err == nil || err.Error() != expected_err1 {
+		t.Error("Expected error of", expected_err1, "got", err)
+	}
+	dump_set.Set("format", "json")
+	dump_set.Set("port", "-1")
+	_, err = parseDumpFlags(cli.NewContext(nil, dump_set, global_context))
+	expected_err5 := "Error: --port must not be negative."
+	if err == nil || err.Error() != expected_err5 {
+		t.Error("Expected error of", expected_err5, "got", err)
+	}
+
+	// lookup
+	lookup_set := flag.NewFlagSet("lookup", 0)
+	lookup_set.String("format", "text", "doc")
+	lookup_set.Parse([]string{"1000@domain"})
+	result2, err := parseLookupFlags(cli.NewContext(nil, lookup_set, global_context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result2.LookupAor != "1000@domain" || result2.OutputFormat != "text" {
+		t.Error("Expected LookupAor 1000@domain and OutputFormat text, got", result2)
+	}
+	for _, v := range [][]string{{}, {"1000"}, {"1000@domain/10.0.0.1:5060"}, {"1000@domain", "1001@domain"}} {
+		lookup_set := flag.NewFlagSet("lookup", 0)
+		lookup_set.String("format", "text", "doc")
+		lookup_set.Parse(v)
+		_, err = parseLookupFlags(cli.NewContext(nil, lookup_set, global_context))
+		expected_err2 := "Error: Expected a single user@domain argument."
+		if err == nil || err.Error() != expected_err2 {
+			t.Error("Expected error of", expected_err2, "for", v, "got", err)
+		}
+	}
+
+	// purge
+	purge_set := flag.NewFlagSet("purge", 0)
+	purge_set.String("host", "10.0.0.1", "doc")
+	purge_set.Int("port", 5060, "doc")
+	result3, err := parsePurgeFlags(cli.NewContext(nil, purge_set, global_context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result3.FilterHost != "10.0.0.1" || result3.FilterPort != 5060 {
+		t.Error("Expected FilterHost 10.0.0.1 and FilterPort 5060, got", result3)
+	}
+	purge_set.Set("port", "0")
+	_, err = parsePurgeFlags(cli.NewContext(nil, purge_set, global_context))
+	expected_err3 := "Error: --port must not be 0 (or empty)."
+	if err == nil || err.Error() != expected_err3 {
+		t.Error("Expected error of", expected_err3, "got", err)
+	}
+	purge_set.Set("host", "")
+	_, err = parsePurgeFlags(cli.NewContext(nil, purge_set, global_context))
+	expected_err4 := "Error: --host must not be empty."
+	if err == nil || err.Error() != expected_err4 {
+		t.Error("Expected error of", expected_err4, "got", err)
+	}
 }
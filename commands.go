@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kr/pretty"
+	"golang.org/x/net/context"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Subcommands for operators, the global flags (given before the subcommand) configure FreeSWITCH and the K/V store as for a normal run.
+func getCommands() []cli.Command {
+	format_flag := cli.StringFlag{
+		Name:  "format",
+		Value: "text",
+		Usage: fmt.Sprintf("Output format (one of: %s)", strings.Join(outputFormats, ", ")),
+	}
+	return []cli.Command{
+		{
+			Name:      "sync",
+			Usage:     "Perform a single full sync between FreeSWITCH and the K/V Store, then exit",
+			ArgsUsage: " ",
+			Action:    syncCommand,
+		},
+		{
+			Name:      "diff",
+			Usage:     "Print what a full sync would add, update and remove in the K/V Store, without changing anything",
+			ArgsUsage: " ",
+			Action:    diffCommand,
+			Flags:     []cli.Flag{format_flag},
+		},
+		{
+			Name:      "dump",
+			Usage:     "Print every registration in the K/V Store",
+			ArgsUsage: " ",
+			Action:    dumpCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "host",
+					Usage: "Only print registrations on this FreeSWITCH instance (advertised IP)",
+				},
+				cli.IntFlag{
+					Name:  "port",
+					Usage: "Only print registrations on this FreeSWITCH instance (advertised port)",
+				},
+				format_flag,
+			},
+		},
+		{
+			Name:      "lookup",
+			Usage:     "Print where a user is registered",
+			ArgsUsage: "user@domain",
+			Action:    lookupCommand,
+			Flags:     []cli.Flag{format_flag},
+		},
+		{
+			Name:      "purge",
+			Usage:     "Remove every registration of a FreeSWITCH instance from the K/V Store (eg. after it has died)",
+			ArgsUsage: " ",
+			Action:    purgeCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "host",
+					Usage: "Advertised IP of the instance to purge (required)",
+				},
+				cli.IntFlag{
+					Name:  "port",
+					Usage: "Advertised port of the instance to purge (required)",
+				},
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "Feed a file recorded with --record through the same event handling and full syncs as when live",
+			ArgsUsage: "file",
+			Action:    replayCommand,
+			Flags: []cli.Flag{
+				cli.Float64Flag{
+					Name:  "speed",
+					Value: 1,
+					Usage: "Replay speed relative to the recording (eg. 10 for 10 times faster), 0 for as fast as possible",
+				},
+				cli.BoolFlag{
+					Name:  "memory",
+					Usage: "Replay into an in-memory K/V Store (instead of --kvbackend), and print the resulting registrations as per dump",
+				},
+			},
+		},
+		{
+			Name:      "redirect",
+			Usage:     "Answer SIP INVITEs with a 302 to where the Request-URI user@domain is registered (404 if not registered)",
+			ArgsUsage: " ",
+			Action:    redirectCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "listen",
+					Value:  ":5060",
+					Usage:  "Address ([host]:port) to receive SIP requests on (UDP/TCP)",
+					EnvVar: "REDIRECT_LISTEN",
+				},
+			},
+		},
+	}
+}
+
+// Applies --config and parses the flags for a subcommand (exiting with its help on error), and sets the log level.
+func setupCommand(c *cli.Context, parse func(c *cli.Context) (*ArgConfig, error)) *ArgConfig {
+	_, err := loadConfigFile(c.Parent())
+	if err != nil {
+		log.Printf("%s\n\n", err.Error())
+		cli.ShowCommandHelp(c, c.Command.Name)
+		os.Exit(1)
+	}
+	arg_config, err := parse(c)
+	if err != nil {
+		log.Printf("%s\n\n", err.Error())
+		cli.ShowCommandHelp(c, c.Command.Name)
+		os.Exit(1)
+	}
+	logDebugf("Config: %# v\n", pretty.Formatter(arg_config))
+	setLogLevel(arg_config.LogLevel)
+	return arg_config
+}
+
+// Exits if the K/V backend can't be set up.
+func createCommandKvBackend(arg_config *ArgConfig) KvBackend {
+	kv_backend, err := createKvBackendFromArgs(arg_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if arg_config.DryRun == true {
+		kv_backend = newDryRunKvBackend(kv_backend)
+	}
+	return kv_backend
+}
+
+// Sets up eslRecorder if --record is set, exits if the file can't be opened.
+func startEslRecording(arg_config *ArgConfig) {
+	if len(arg_config.RecordFile) == 0 {
+		return
+	}
+	recorder, err := openEslRecorder(arg_config.RecordFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Recording messages from FreeSWITCH to '%s'.\n", arg_config.RecordFile)
+	eslRecorder = recorder
+}
+
+// Only results go to stdout, logging is on stderr.
+func writeCommandJson(v interface{}) {
+	encoded, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", encoded)
+}
+
+func syncCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parseSyncFlags)
+	kv_backend := createCommandKvBackend(arg_config)
+	esl_conn, err := NewEslConnection("sync", arg_config.FreeswitchHost, arg_config.FreeswitchPort, arg_config.FreeswitchEslPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+	startEslRecording(arg_config)
+	defer eslRecorder.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := notifyShutdownSignals()
+	go handleShutdownSignals(signals, cancel, esl_conn)
+
+	var wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	wg.Add(1)
+	go syncRegistrations(ctx, esl_conn, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, newRuntimeConfig(arg_config), &wg, true, nil, fatal_error_channel)
+	wg.Wait()
+	esl_conn.Close()
+	select {
+	case err := <-fatal_error_channel:
+		log.Fatal(err)
+	default:
+	}
+	return nil
+}
+
+func diffCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parseDiffFlags)
+	kv_backend := createCommandKvBackend(arg_config)
+	esl_conn, err := NewEslConnection("diff", arg_config.FreeswitchHost, arg_config.FreeswitchPort, arg_config.FreeswitchEslPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer esl_conn.Close()
+	startEslRecording(arg_config)
+	defer eslRecorder.Close()
+
+	plan, err := getSyncPlan(esl_conn, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, newRuntimeConfig(arg_config))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if arg_config.OutputFormat == "json" {
+		err = plan.WriteJson(os.Stdout)
+	} else {
+		err = plan.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+// Filters on the value, as per generateRegistrationListForThisInstance(), an empty host or 0 port matches any.
+func filterRegistrations(input *Registrations, host string, port int) *Registrations {
+	result := make(Registrations)
+	for k, v := range *input {
+		if (len(host) > 0 && v.Host != host) || (port != 0 && v.Port != port) {
+			continue
+		}
+		result[k] = v
+	}
+	return &result
+}
+
+func dumpCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parseDumpFlags)
+	kv_backend := createCommandKvBackend(arg_config)
+
+	registrations, err := readApiRegistrations(kv_backend, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeCommandRegistrations(filterRegistrations(registrations, arg_config.FilterHost, arg_config.FilterPort), arg_config.OutputFormat)
+	return nil
+}
+
+// One line per registration (sorted by key) for text, or a single JSON object.
+func writeCommandRegistrations(registrations *Registrations, format string) {
+	if format == "json" {
+		writeCommandJson(registrations)
+		return
+	}
+	var keys []string
+	for k, _ := range *registrations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := (*registrations)[k]
+		fmt.Printf("%s %s\n", k, getSyncPlanValueString(&v))
+	}
+}
+
+func lookupCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parseLookupFlags)
+	kv_backend := createCommandKvBackend(arg_config)
+
+	registrations, err := readApiRegistrations(kv_backend, arg_config.LookupAor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	results := groupRegistrationsByAor(registrations)
+	if len(results) == 0 {
+		log.Printf("'%s' is not registered.\n", arg_config.LookupAor)
+		os.Exit(1)
+	}
+	if arg_config.OutputFormat == "json" {
+		writeCommandJson(results[0])
+		return nil
+	}
+	for _, v := range results[0].Registrations {
+		fmt.Printf("%s %s\n", net.JoinHostPort(v.Host, strconv.Itoa(v.Port)), getSyncPlanValueString(&v))
+	}
+	return nil
+}
+
+func purgeCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parsePurgeFlags)
+	kv_backend := createCommandKvBackend(arg_config)
+
+	log.Printf("Purging registrations of %s from the K/V backend...\n", net.JoinHostPort(arg_config.FilterHost, strconv.Itoa(arg_config.FilterPort)))
+	err := withdrawRegistrations([]AdvertiseAddress{{arg_config.FilterHost, arg_config.FilterPort}}, kv_backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+func replayCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parseReplayFlags)
+	var kv_backend KvBackend
+	if arg_config.ReplayMemory == true {
+		kv_backend, _ = NewKvBackendMemory(map[string]string{"prefix": arg_config.KvPrefix})
+	} else {
+		kv_backend = createCommandKvBackend(arg_config)
+	}
+	f, err := os.Open(arg_config.ReplayFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := notifyShutdownSignals()
+	go handleShutdownSignals(signals, cancel)
+
+	result, err := replayEslRecords(ctx, f, arg_config.ReplaySpeed, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, newRuntimeConfig(arg_config))
+	log.Printf("Replayed %d events and %d full syncs (%d failed).\n", result.Events, result.Syncs, result.FailedSyncs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if arg_config.ReplayMemory == true {
+		registrations, err := readApiRegistrations(kv_backend, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeCommandRegistrations(registrations, "text")
+	}
+	return nil
+}
+
+func redirectCommand(c *cli.Context) error {
+	arg_config := setupCommand(c, parseRedirectFlags)
+	kv_backend := createCommandKvBackend(arg_config)
+
+	packet_conn, err := net.ListenPacket("udp", arg_config.RedirectListen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", arg_config.RedirectListen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := notifyShutdownSignals()
+	go handleShutdownSignals(signals, cancel)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go serveSip(ctx, packet_conn, listener, NewSipRedirector(kv_backend), &wg)
+	wg.Wait()
+	log.Printf("Shutdown complete.\n")
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterRegistrations(t *testing.T) {
+	input := Registrations{
+		"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+		"1000@domain/10.0.0.1:5080": KvBackendValue{Host: "10.0.0.1", Port: 5080},
+		"1000@domain/10.0.0.2:5060": KvBackendValue{Host: "10.0.0.2", Port: 5060},
+	}
+	expected_result1 := Registrations{
+		"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+		"1000@domain/10.0.0.1:5080": KvBackendValue{Host: "10.0.0.1", Port: 5080},
+	}
+	result1 := filterRegistrations(&input, "10.0.0.1", 0)
+	if reflect.DeepEqual(*result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", *result1)
+	}
+	expected_result2 := Registrations{
+		"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+	}
+	result2 := filterRegistrations(&input, "10.0.0.1", 5060)
+	if reflect.DeepEqual(*result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", *result2)
+	}
+	result3 := filterRegistrations(&input, "", 0)
+	if reflect.DeepEqual(*result3, input) != true {
+		t.Error("Expected", input, "got", *result3)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Settings in a --config file use the same names as the CLI flags, eg:
+//
+//   fshost: 10.0.0.5
+//   fsprofiles: [internal, external]
+//   kvoption:
+//     db: 2
+//
+// Flags (and environment variables) always override values from the file.
+
+// Only these are applied when reloading (on SIGHUP), anything else requires a restart.
+var reloadableSettings = []string{"fsprofiles", "fsprofilesinclude", "fsprofilesexclude", "syncinterval", "kvttl", "loglevel"}
+
+// Settings that can be given multiple times, as opposed to lists being comma separated.
+var repeatableSettings = []string{"kvoption"}
+
+type ConfigFile struct {
+	Path string
+	// Whether each setting in the file was set via a flag (or environment variable), and is left alone.
+	explicit map[string]bool
+	// The value of each setting before the file set it, restored on reload if it is removed from the file.
+	defaults map[string]string
+}
+
+// Setting name -> values, lists (and maps, as key=value) hold several values.
+func readConfigFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error: reading --config file: %s", err)
+	}
+	raw := make(map[string]interface{})
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("Error: parsing --config file '%s': %s", path, err)
+	}
+	result := make(map[string][]string)
+	for k, v := range raw {
+		switch typed_v := v.(type) {
+		case nil:
+			result[k] = []string{""}
+		case []interface{}:
+			for _, v2 := range typed_v {
+				result[k] = append(result[k], fmt.Sprint(v2))
+			}
+		case map[interface{}]interface{}:
+			for k2, v2 := range typed_v {
+				result[k] = append(result[k], fmt.Sprintf("%v=%v", k2, v2))
+			}
+			sort.Strings(result[k])
+		default:
+			result[k] = []string{fmt.Sprint(typed_v)}
+		}
+	}
+	return result, nil
+}
+
+// Applies --config file values (if --config is set) to the context, before parseFlags() is called.
+func loadConfigFile(c *cli.Context) (*ConfigFile, error) {
+	config_file := &ConfigFile{
+		Path:     c.String("config"),
+		explicit: make(map[string]bool),
+		defaults: make(map[string]string),
+	}
+	if len(config_file.Path) == 0 {
+		return config_file, nil
+	}
+	settings, err := readConfigFile(config_file.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := settings["config"]; ok == true {
+		return nil, fmt.Errorf("Error: --config file '%s' cannot itself set 'config'.", config_file.Path)
+	}
+	names := make([]string, 0, len(settings))
+	for k, _ := range settings {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	err = config_file.apply(c, settings, names)
+	if err != nil {
+		return nil, err
+	}
+	return config_file, nil
+}
+
+func (f *ConfigFile) apply(c *cli.Context, settings map[string][]string, names []string) error {
+	for _, name := range names {
+		values, ok := settings[name]
+		if ok == false {
+			continue
+		}
+		// Worked out the first time we see a setting, before we have set it ourselves.
+		if _, ok := f.explicit[name]; ok == false {
+			f.explicit[name] = c.IsSet(name)
+			f.defaults[name] = c.String(name)
+		}
+		if f.explicit[name] == true {
+			continue
+		}
+		if stringInSlice(name, repeatableSettings) == false {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			err := c.Set(name, v)
+			if err != nil {
+				return fmt.Errorf("Error: --config file '%s' setting '%s': %s", f.Path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Re-reads the file, applying reloadableSettings only. Settings removed from the file go back to their defaults.
+func (f *ConfigFile) Reload(c *cli.Context) (*ArgConfig, error) {
+	settings, err := readConfigFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range reloadableSettings {
+		default_value, ok := f.defaults[name]
+		if _, in_file := settings[name]; in_file == true || ok == false || f.explicit[name] == true {
+			continue
+		}
+		err = c.Set(name, default_value)
+		if err != nil {
+			return nil, fmt.Errorf("Error: --config file '%s' resetting '%s': %s", f.Path, name, err)
+		}
+	}
+	err = f.apply(c, settings, reloadableSettings)
+	if err != nil {
+		return nil, err
+	}
+	return parseFlags(c)
+}
+
+// Settings that can be changed while running, read by the goroutines from main() on each pass.
+type RuntimeConfig struct {
+	mutex                sync.RWMutex
+	sofiaProfiles        []string
+	sofiaProfilesAuto    bool
+	sofiaProfilesInclude []string
+	sofiaProfilesExclude []string
+	// With --fsprofiles auto, every running profile as of the last sync (before include/exclude).
+	discoveredSofiaProfiles []string
+	// With --fsadvertisefrom, the address of each profile as of the last sync, and every address advertised since
+	// starting (so registrations left on an old address are still removed by syncs and withdrawn on exit).
+	advertiseFrom       string
+	profileAddresses    map[string]AdvertiseAddress
+	advertisedAddresses []AdvertiseAddress
+	// With --dry-run, full syncs log their plan instead of applying it.
+	dryRun       bool
+	syncInterval uint32
+	kvTtl        int
+	logLevel     string
+}
+
+func newRuntimeConfig(arg_config *ArgConfig) *RuntimeConfig {
+	r := &RuntimeConfig{
+		// Not reloadable.
+		advertiseFrom:    arg_config.FreeswitchAdvertiseFrom,
+		profileAddresses: make(map[string]AdvertiseAddress),
+		dryRun:           arg_config.DryRun,
+	}
+	r.Update(arg_config)
+	return r
+}
+
+// Returns the names of the settings that changed.
+func (r *RuntimeConfig) Update(arg_config *ArgConfig) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var changed []string
+	if reflect.DeepEqual(r.sofiaProfiles, arg_config.FreeswitchSofiaProfiles) == false || r.sofiaProfilesAuto != arg_config.FreeswitchSofiaProfilesAuto {
+		r.sofiaProfiles = arg_config.FreeswitchSofiaProfiles
+		r.sofiaProfilesAuto = arg_config.FreeswitchSofiaProfilesAuto
+		changed = append(changed, "fsprofiles")
+	}
+	if reflect.DeepEqual(r.sofiaProfilesInclude, arg_config.FreeswitchSofiaProfilesInclude) == false {
+		r.sofiaProfilesInclude = arg_config.FreeswitchSofiaProfilesInclude
+		changed = append(changed, "fsprofilesinclude")
+	}
+	if reflect.DeepEqual(r.sofiaProfilesExclude, arg_config.FreeswitchSofiaProfilesExclude) == false {
+		r.sofiaProfilesExclude = arg_config.FreeswitchSofiaProfilesExclude
+		changed = append(changed, "fsprofilesexclude")
+	}
+	if r.syncInterval != arg_config.SyncInterval {
+		r.syncInterval = arg_config.SyncInterval
+		changed = append(changed, "syncinterval")
+	}
+	if r.kvTtl != arg_config.KvTtl {
+		r.kvTtl = arg_config.KvTtl
+		changed = append(changed, "kvttl")
+	}
+	if r.logLevel != arg_config.LogLevel {
+		r.logLevel = arg_config.LogLevel
+		changed = append(changed, "loglevel")
+		setLogLevel(r.logLevel)
+	}
+	return changed
+}
+
+// The Sofia profiles to sync and handle events for. With --fsprofiles auto, the discovered profiles that match the
+// include/exclude patterns (none until the first sync).
+func (r *RuntimeConfig) SofiaProfiles() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.sofiaProfilesAuto == false {
+		return r.sofiaProfiles
+	}
+	var result []string
+	for _, v := range r.discoveredSofiaProfiles {
+		if matchSofiaProfilePatterns(v, r.sofiaProfilesInclude, r.sofiaProfilesExclude) == true {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (r *RuntimeConfig) SofiaProfilesAuto() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sofiaProfilesAuto
+}
+
+// Records the running profiles fetched from FreeSWITCH, returns whether they changed since the last call.
+func (r *RuntimeConfig) SetDiscoveredSofiaProfiles(profiles []string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if reflect.DeepEqual(r.discoveredSofiaProfiles, profiles) == true {
+		return false
+	}
+	r.discoveredSofiaProfiles = profiles
+	return true
+}
+
+// Whether a profile would be watched, but hasn't been discovered yet (eg. it was started since the last sync).
+// Always false unless --fsprofiles auto.
+func (r *RuntimeConfig) IsUndiscoveredSofiaProfile(profile string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sofiaProfilesAuto == true && stringInSlice(profile, r.discoveredSofiaProfiles) == false && matchSofiaProfilePatterns(profile, r.sofiaProfilesInclude, r.sofiaProfilesExclude) == true
+}
+
+func (r *RuntimeConfig) DryRun() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.dryRun
+}
+
+// Empty unless --fsadvertisefrom is set.
+func (r *RuntimeConfig) AdvertiseFrom() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.advertiseFrom
+}
+
+// Records the address derived from a Sofia profile, returns whether it changed since the last call.
+func (r *RuntimeConfig) SetProfileAdvertiseAddress(profile string, address AdvertiseAddress) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if current, ok := r.profileAddresses[profile]; ok == true && current == address {
+		return false
+	}
+	r.profileAddresses[profile] = address
+	for _, v := range r.advertisedAddresses {
+		if v == address {
+			return true
+		}
+	}
+	r.advertisedAddresses = append(r.advertisedAddresses, address)
+	return true
+}
+
+// The address to advertise a registration on the Sofia profile with, advertise_ip:advertise_port unless
+// --fsadvertisefrom is set. Not ok if the profile's address hasn't been derived yet.
+func (r *RuntimeConfig) ProfileAdvertiseAddress(profile string, advertise_ip string, advertise_port int) (AdvertiseAddress, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.advertiseFrom) == 0 {
+		return AdvertiseAddress{Ip: advertise_ip, Port: advertise_port}, true
+	}
+	address, ok := r.profileAddresses[profile]
+	return address, ok
+}
+
+// The addresses whose registrations this instance owns, advertise_ip:advertise_port unless --fsadvertisefrom is set.
+func (r *RuntimeConfig) AdvertisedAddresses(advertise_ip string, advertise_port int) []AdvertiseAddress {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.advertiseFrom) == 0 {
+		return []AdvertiseAddress{{Ip: advertise_ip, Port: advertise_port}}
+	}
+	return append([]AdvertiseAddress(nil), r.advertisedAddresses...)
+}
+
+func (r *RuntimeConfig) SyncInterval() uint32 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.syncInterval
+}
+
+func (r *RuntimeConfig) KvTtl() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.kvTtl
+}
+
+// Call before starting handleReloadSignals(), so a SIGHUP arriving before it runs doesn't terminate the process.
+func notifyReloadSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	return signals
+}
+
+// Reloads the --config file on SIGHUP, run within a goroutine from main()
+// ESL connections are left alone, a full sync is requested so profile and interval changes take effect immediately.
+func handleReloadSignals(ctx context.Context, signals <-chan os.Signal, c *cli.Context, config_file *ConfigFile, runtime_config *RuntimeConfig, wg *sync.WaitGroup, sync_trigger chan<- struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+			return
+		}
+		if len(config_file.Path) == 0 {
+			log.Printf("WARNING: Received SIGHUP, but no --config file was given. Nothing to reload.\n")
+			continue
+		}
+		log.Printf("Received SIGHUP, reloading --config file '%s' (%s only)...\n", config_file.Path, strings.Join(reloadableSettings, ", "))
+		arg_config, err := config_file.Reload(c)
+		if err != nil {
+			log.Printf("WARNING: Reload failed, keeping the current configuration: %s\n", err)
+			continue
+		}
+		changed := runtime_config.Update(arg_config)
+		if len(changed) == 0 {
+			log.Printf("Reload complete, nothing changed.\n")
+			continue
+		}
+		log.Printf("Reload complete, changed: %s. Requesting a full sync.\n", strings.Join(changed, ", "))
+		triggerSync(sync_trigger)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+func writeTestConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "fs-registrator-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// All of the flags parseFlags() requires, with values from args (and defaults for the rest).
+func getTestConfigContext(t *testing.T, config_path string, args []string) *cli.Context {
+	set := flag.NewFlagSet("test", 0)
+	set.String("config", config_path, "doc")
+	set.String("fshost", "localhost", "doc")
+	set.Int("fsport", 8021, "doc")
+	set.String("fspassword", "ClueCon", "doc")
+	set.String("fsprofiles", "internal", "doc")
+	set.String("fsadvertiseip", "", "doc")
+	set.Int("fsadvertiseport", 0, "doc")
+	set.String("kvbackend", "etcd", "doc")
+	set.String("kvhost", "etcd", "doc")
+	set.Int("kvport", 2379, "doc")
+	set.String("kvprefix", "fs_registrations", "doc")
+	set.Int("kvttl", 300, "doc")
+	set.Var(&cli.StringSlice{}, "kvoption", "doc")
+	set.Int("syncinterval", 3600, "doc")
+	set.Int("livenessthreshold", 120, "doc")
+	set.String("loglevel", "info", "doc")
+	err := set.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeTestConfigFile(t, "fshost: 10.0.0.5\nfsport: 8022\nfsprofiles: [internal, external]\nkvoption:\n  password: secret\n  db: 2\nwithdrawonexit: true\nfspassword:\n")
+	defer os.Remove(path)
+	expected_result := map[string][]string{
+		"fshost":         []string{"10.0.0.5"},
+		"fsport":         []string{"8022"},
+		"fsprofiles":     []string{"internal", "external"},
+		"kvoption":       []string{"db=2", "password=secret"},
+		"withdrawonexit": []string{"true"},
+		"fspassword":     []string{""},
+	}
+	result, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+
+	_, err = readConfigFile(path + ".nonexistent")
+	if err == nil {
+		t.Error("Expected an error for a missing file, got nil")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeTestConfigFile(t, "fshost: 10.0.0.5\nfsprofiles: [internal, external]\nfsadvertiseip: 10.0.0.6\nfsadvertiseport: 5060\nkvhost: filekvhost\nkvoption:\n  db: 2\nkvttl: 120\n")
+	defer os.Remove(path)
+	// Flags override the file.
+	c := getTestConfigContext(t, path, []string{"-kvhost", "flagkvhost"})
+	config_file, err := loadConfigFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result1, err := parseFlags(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result1.FreeswitchHost != "10.0.0.5" || result1.KvHost != "flagkvhost" || result1.KvTtl != 120 {
+		t.Error("Expected FreeswitchHost 10.0.0.5, KvHost flagkvhost and KvTtl 120, got", result1)
+	}
+	if reflect.DeepEqual(result1.FreeswitchSofiaProfiles, []string{"internal", "external"}) != true {
+		t.Error("Expected [internal external], got", result1.FreeswitchSofiaProfiles)
+	}
+	if reflect.DeepEqual(result1.KvOptions, map[string]string{"db": "2"}) != true {
+		t.Error("Expected map[db:2], got", result1.KvOptions)
+	}
+
+	// Only the reloadable settings change on reload.
+	err = ioutil.WriteFile(path, []byte("fshost: 10.0.0.7\nfsprofiles: [internal]\nfsadvertiseip: 10.0.0.6\nfsadvertiseport: 5060\nkvhost: newfilekvhost\nkvoption:\n  db: 2\nkvttl: 60\nloglevel: debug\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result2, err := config_file.Reload(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result2.FreeswitchHost != "10.0.0.5" || result2.KvHost != "flagkvhost" || result2.KvTtl != 60 || result2.LogLevel != "debug" {
+		t.Error("Expected FreeswitchHost 10.0.0.5, KvHost flagkvhost, KvTtl 60 and LogLevel debug, got", result2)
+	}
+	if reflect.DeepEqual(result2.FreeswitchSofiaProfiles, []string{"internal"}) != true {
+		t.Error("Expected [internal], got", result2.FreeswitchSofiaProfiles)
+	}
+	// kvoption is repeatable, make sure reloading didn't apply it again.
+	if reflect.DeepEqual(result2.KvOptions, map[string]string{"db": "2"}) != true {
+		t.Error("Expected map[db:2], got", result2.KvOptions)
+	}
+
+	// Reloadable settings removed from the file go back to their defaults.
+	err = ioutil.WriteFile(path, []byte("fshost: 10.0.0.7\nfsprofiles: [internal]\nfsadvertiseip: 10.0.0.6\nfsadvertiseport: 5060\nkvoption:\n  db: 2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result3, err := config_file.Reload(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result3.KvTtl != 300 || result3.LogLevel != "info" {
+		t.Error("Expected KvTtl 300 and LogLevel info, got", result3)
+	}
+
+	// Unknown settings are rejected.
+	err = ioutil.WriteFile(path, []byte("fsnonexistent: 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfigFile(getTestConfigContext(t, path, []string{}))
+	if err == nil {
+		t.Error("Expected an error for an unknown setting, got nil")
+	}
+
+	// No --config, nothing to do.
+	config_file, err = loadConfigFile(getTestConfigContext(t, "", []string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config_file.Path != "" {
+		t.Error("Expected an empty path, got", config_file.Path)
+	}
+}
+
+func TestRuntimeConfigUpdate(t *testing.T) {
+	arg_config := &ArgConfig{
+		FreeswitchSofiaProfiles: []string{"internal"},
+		SyncInterval:            3600,
+		KvTtl:                   300,
+		LogLevel:                "info",
+	}
+	runtime_config := newRuntimeConfig(arg_config)
+	result1 := runtime_config.Update(arg_config)
+	if len(result1) != 0 {
+		t.Error("Expected no changes, got", result1)
+	}
+	result2 := runtime_config.Update(&ArgConfig{
+		FreeswitchSofiaProfiles: []string{"internal", "external"},
+		SyncInterval:            3600,
+		KvTtl:                   60,
+		LogLevel:                "info",
+	})
+	expected_result2 := []string{"fsprofiles", "kvttl"}
+	if reflect.DeepEqual(result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
+	if runtime_config.KvTtl() != 60 || runtime_config.SyncInterval() != 3600 || len(runtime_config.SofiaProfiles()) != 2 {
+		t.Error("Expected the updated values, got", runtime_config.SofiaProfiles(), runtime_config.SyncInterval(), runtime_config.KvTtl())
+	}
+}
+
+func TestRuntimeConfigSofiaProfilesAuto(t *testing.T) {
+	runtime_config := newRuntimeConfig(&ArgConfig{
+		FreeswitchSofiaProfilesAuto:    true,
+		FreeswitchSofiaProfilesExclude: []string{"*-ipv6"},
+		SyncInterval:                   3600,
+		KvTtl:                          300,
+		LogLevel:                       "info",
+	})
+	if result := runtime_config.SofiaProfiles(); len(result) != 0 {
+		t.Error("Expected no profiles before discovery, got", result)
+	}
+	if runtime_config.SetDiscoveredSofiaProfiles([]string{"external", "internal", "internal-ipv6"}) != true {
+		t.Error("Expected the discovered profiles to have changed")
+	}
+	if runtime_config.SetDiscoveredSofiaProfiles([]string{"external", "internal", "internal-ipv6"}) != false {
+		t.Error("Expected the discovered profiles to be unchanged")
+	}
+	expected_result1 := []string{"external", "internal"}
+	if result1 := runtime_config.SofiaProfiles(); reflect.DeepEqual(result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+	for profile, expected_result := range map[string]bool{"internal": false, "internal-ipv6": false, "internal2": true} {
+		if result := runtime_config.IsUndiscoveredSofiaProfile(profile); result != expected_result {
+			t.Error("Expected", expected_result, "for", profile, "got", result)
+		}
+	}
+
+	// Reloaded with a different pattern.
+	result2 := runtime_config.Update(&ArgConfig{
+		FreeswitchSofiaProfilesAuto:    true,
+		FreeswitchSofiaProfilesInclude: []string{"internal*"},
+		SyncInterval:                   3600,
+		KvTtl:                          300,
+		LogLevel:                       "info",
+	})
+	expected_result2 := []string{"fsprofilesinclude", "fsprofilesexclude"}
+	if reflect.DeepEqual(result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
+	expected_result3 := []string{"internal", "internal-ipv6"}
+	if result3 := runtime_config.SofiaProfiles(); reflect.DeepEqual(result3, expected_result3) != true {
+		t.Error("Expected", expected_result3, "got", result3)
+	}
+}
+
+func TestRuntimeConfigAdvertiseAddresses(t *testing.T) {
+	// Without --fsadvertisefrom, always the instance's address.
+	runtime_config1 := getTestRuntimeConfig([]string{"internal"})
+	if result, ok := runtime_config1.ProfileAdvertiseAddress("internal", "10.0.0.1", 5060); ok == false || result != (AdvertiseAddress{"10.0.0.1", 5060}) {
+		t.Error("Expected 10.0.0.1:5060, got", result, ok)
+	}
+	if result := runtime_config1.AdvertisedAddresses("10.0.0.1", 5060); reflect.DeepEqual(result, []AdvertiseAddress{{"10.0.0.1", 5060}}) != true {
+		t.Error("Expected [10.0.0.1:5060], got", result)
+	}
+
+	runtime_config2 := newRuntimeConfig(&ArgConfig{
+		FreeswitchSofiaProfiles: []string{"internal", "external"},
+		FreeswitchAdvertiseFrom: "sip-ip",
+		SyncInterval:            3600,
+		KvTtl:                   300,
+		LogLevel:                "info",
+	})
+	if result, ok := runtime_config2.ProfileAdvertiseAddress("internal", "", 0); ok == true {
+		t.Error("Expected no address before one is derived, got", result)
+	}
+	if runtime_config2.SetProfileAdvertiseAddress("internal", AdvertiseAddress{"10.0.0.1", 5060}) != true {
+		t.Error("Expected the address to have changed")
+	}
+	if runtime_config2.SetProfileAdvertiseAddress("internal", AdvertiseAddress{"10.0.0.1", 5060}) != false {
+		t.Error("Expected the address to be unchanged")
+	}
+	runtime_config2.SetProfileAdvertiseAddress("external", AdvertiseAddress{"10.0.0.1", 5080})
+	// Moved, the old address is still owned.
+	runtime_config2.SetProfileAdvertiseAddress("external", AdvertiseAddress{"10.0.0.1", 5090})
+	if result, ok := runtime_config2.ProfileAdvertiseAddress("external", "", 0); ok == false || result != (AdvertiseAddress{"10.0.0.1", 5090}) {
+		t.Error("Expected 10.0.0.1:5090, got", result, ok)
+	}
+	expected_result := []AdvertiseAddress{{"10.0.0.1", 5060}, {"10.0.0.1", 5080}, {"10.0.0.1", 5090}}
+	if result := runtime_config2.AdvertisedAddresses("", 0); reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
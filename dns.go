@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// Names under this label (within the zone) resolve to the IP address encoded in them, used as SRV targets.
+// An underscore can't appear in a SIP domain, so it can't clash with an AOR.
+const dnsIpLabel = "_ip"
+
+// Answers DNS queries for <user>.<domain>.<zone> (eg. alice.example.com.reg.local) with where that AOR is registered.
+// A/AAAA queries return the --fsadvertiseip of each instance it is registered on, SRV queries (optionally with a
+// _service._proto. prefix) return the --fsadvertiseip/--fsadvertiseport of each instance.
+// Users containing dots can't be represented, and names are matched in lower case.
+type DnsResponder struct {
+	KvBackend KvBackend
+	// Fully qualified, lower case.
+	Zone string
+	// Upper bound (in seconds) on answer TTLs, and how long lookups are cached for.
+	MaxTtl int
+	// Lookups per AOR, until the TTL of the answer expires.
+	cache      map[string]dnsCacheEntry
+	cacheMutex sync.Mutex
+	nextSweep  time.Time
+	now        func() time.Time
+}
+
+type dnsCacheEntry struct {
+	values  []KvBackendValue
+	expires time.Time
+}
+
+func NewDnsResponder(kv_backend KvBackend, zone string, max_ttl int) *DnsResponder {
+	return &DnsResponder{
+		KvBackend: kv_backend,
+		Zone:      dns.Fqdn(strings.ToLower(zone)),
+		MaxTtl:    max_ttl,
+		cache:     make(map[string]dnsCacheEntry),
+		now:       time.Now,
+	}
+}
+
+// The answer TTL is the time until the first of the registrations expires, capped at MaxTtl.
+func getDnsTtl(values []KvBackendValue, max_ttl int, now time.Time) uint32 {
+	ttl := int64(max_ttl)
+	for _, v := range values {
+		if v.Expires == 0 {
+			continue
+		}
+		remaining := v.Expires - now.Unix()
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if ttl < 1 {
+		ttl = 1
+	}
+	return uint32(ttl)
+}
+
+// Returns the registrations for an AOR (none if not registered) and the TTL to answer with.
+func (d *DnsResponder) lookup(aor string) ([]KvBackendValue, uint32, error) {
+	now := d.now()
+	d.cacheMutex.Lock()
+	entry, ok := d.cache[aor]
+	d.cacheMutex.Unlock()
+	if ok == true && now.Before(entry.expires) {
+		// Counts down as the cached entry gets older, rounded up so it never reaches 0.
+		return entry.values, uint32((entry.expires.Sub(now) + time.Second - 1) / time.Second), nil
+	}
+	registrations, err := readApiRegistrations(d.KvBackend, aor)
+	if err != nil {
+		return nil, 0, err
+	}
+	results := groupRegistrationsByAor(registrations)
+	// Not registered, don't cache so a new registration is found straight away.
+	if len(results) == 0 {
+		return nil, 0, nil
+	}
+	ttl := getDnsTtl(results[0].Registrations, d.MaxTtl, now)
+	d.cacheMutex.Lock()
+	defer d.cacheMutex.Unlock()
+	// Every so often, drop anything expired so AORs that are never looked up again don't build up.
+	if now.After(d.nextSweep) {
+		for k, v := range d.cache {
+			if now.After(v.expires) {
+				delete(d.cache, k)
+			}
+		}
+		d.nextSweep = now.Add(time.Duration(d.MaxTtl) * time.Second)
+	}
+	d.cache[aor] = dnsCacheEntry{
+		values:  results[0].Registrations,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+	return results[0].Registrations, ttl, nil
+}
+
+// eg. 10.0.0.1 -> 10-0-0-1._ip.<zone>, or the host itself if it isn't an IP address.
+func (d *DnsResponder) getIpTarget(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return dns.Fqdn(host)
+	}
+	var label string
+	if ip.To4() != nil {
+		label = strings.Replace(ip.String(), ".", "-", -1)
+	} else {
+		label = strings.Replace(ip.String(), ":", "-", -1)
+	}
+	return fmt.Sprintf("%s.%s.%s", label, dnsIpLabel, d.Zone)
+}
+
+// The reverse of getIpTarget(), label is the part before ._ip.<zone>
+func parseDnsIpLabel(label string) net.IP {
+	if ip := net.ParseIP(strings.Replace(label, "-", ".", -1)); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	if ip := net.ParseIP(strings.Replace(label, "-", ":", -1)); ip != nil && ip.To4() == nil {
+		return ip
+	}
+	return nil
+}
+
+// A or AAAA (depending on the address family), nil if ip doesn't match qtype.
+func getDnsAddressRecord(name string, ip net.IP, qtype uint16, ttl uint32) dns.RR {
+	header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+	if ip.To4() != nil && qtype == dns.TypeA {
+		header.Rrtype = dns.TypeA
+		return &dns.A{Hdr: header, A: ip.To4()}
+	}
+	if ip.To4() == nil && qtype == dns.TypeAAAA {
+		header.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: header, AAAA: ip}
+	}
+	return nil
+}
+
+func (d *DnsResponder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	defer func() {
+		err := w.WriteMsg(m)
+		if err != nil {
+			log.Printf("WARNING: DnsResponder.ServeDNS(): %s\n", err)
+		}
+	}()
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if dns.IsSubDomain(d.Zone, name) == false || name == d.Zone {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+d.Zone))
+
+	// <ip>._ip.<zone>, SRV targets.
+	if len(labels) == 2 && labels[1] == dnsIpLabel {
+		ip := parseDnsIpLabel(labels[0])
+		if ip == nil {
+			m.Rcode = dns.RcodeNameError
+			return
+		}
+		if rr := getDnsAddressRecord(q.Name, ip, q.Qtype, uint32(d.MaxTtl)); rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+		return
+	}
+
+	// Skip _service._proto. for SRV queries.
+	for len(labels) > 0 && strings.HasPrefix(labels[0], "_") {
+		labels = labels[1:]
+	}
+	if len(labels) < 2 {
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+	aor := fmt.Sprintf("%s@%s", labels[0], strings.Join(labels[1:], "."))
+	values, ttl, err := d.lookup(aor)
+	if err != nil {
+		log.Printf("WARNING: DnsResponder.ServeDNS(): Error looking up '%s': %s\n", aor, err)
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+	if len(values) == 0 {
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+	for _, v := range values {
+		switch q.Qtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if ip := net.ParseIP(v.Host); ip != nil {
+				if rr := getDnsAddressRecord(q.Name, ip, q.Qtype, ttl); rr != nil {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		case dns.TypeSRV:
+			target := d.getIpTarget(v.Host)
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+				Priority: 10,
+				Weight:   10,
+				Port:     uint16(v.Port),
+				Target:   target,
+			})
+			// Save the client a lookup for the target.
+			if ip := net.ParseIP(v.Host); ip != nil {
+				qtype := dns.TypeA
+				if ip.To4() == nil {
+					qtype = dns.TypeAAAA
+				}
+				m.Extra = append(m.Extra, getDnsAddressRecord(target, ip, qtype, ttl))
+			}
+		}
+	}
+}
+
+// Serves handler over UDP and TCP until ctx is cancelled, run within a goroutine from main()
+func serveDns(ctx context.Context, packet_conn net.PacketConn, listener net.Listener, handler dns.Handler, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log.Printf("serveDns(): Listening on %s (UDP/TCP).\n", packet_conn.LocalAddr())
+	servers := []*dns.Server{
+		&dns.Server{PacketConn: packet_conn, Handler: handler},
+		&dns.Server{Listener: listener, Handler: handler},
+	}
+	var servers_wg sync.WaitGroup
+	for _, v := range servers {
+		servers_wg.Add(1)
+		go func(server *dns.Server) {
+			defer servers_wg.Done()
+			err := server.ActivateAndServe()
+			if err != nil && ctx.Err() == nil {
+				log.Printf("WARNING: serveDns(): %s\n", err)
+			}
+		}(v)
+	}
+	// Closing the sockets on shutdown stops both servers.
+	<-ctx.Done()
+	packet_conn.Close()
+	listener.Close()
+	servers_wg.Wait()
+	log.Printf("serveDns(): Finished.\n")
+}
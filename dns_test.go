@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestGetDnsTtl(t *testing.T) {
+	now := time.Unix(1000, 0)
+	values := []KvBackendValue{
+		{Host: "10.0.0.1", Port: 5060, Expires: 1100},
+		{Host: "10.0.0.2", Port: 5060, Expires: 1030},
+		// From before Expires was recorded.
+		{Host: "10.0.0.3", Port: 5060},
+	}
+	if result := getDnsTtl(values, 300, now); result != 30 {
+		t.Error("Expected 30, got", result)
+	}
+	if result := getDnsTtl(values, 10, now); result != 10 {
+		t.Error("Expected 10, got", result)
+	}
+	// Already expired, but not removed yet.
+	if result := getDnsTtl(values, 300, time.Unix(2000, 0)); result != 1 {
+		t.Error("Expected 1, got", result)
+	}
+}
+
+func TestParseDnsIpLabel(t *testing.T) {
+	responder := NewDnsResponder(nil, "Reg.Local", 300)
+	for _, v := range []string{"10.0.0.1", "2001:db8::1"} {
+		target := responder.getIpTarget(v)
+		labels := dns.SplitDomainName(target)
+		if len(labels) != 4 || labels[1] != dnsIpLabel || dns.IsSubDomain("reg.local.", target) == false {
+			t.Errorf("Expected <ip>._ip.reg.local. for %s, got %s", v, target)
+			continue
+		}
+		if result := parseDnsIpLabel(labels[0]); result == nil || result.Equal(net.ParseIP(v)) == false {
+			t.Error("Expected", v, "got", result)
+		}
+	}
+	if result := parseDnsIpLabel("not-an-ip"); result != nil {
+		t.Error("Expected nil, got", result)
+	}
+}
+
+func TestDnsResponder(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	for k, v := range map[string]string{
+		"1000@example.com/10.0.0.1:5060":    "{\"host\":\"10.0.0.1\",\"port\":5060}",
+		"1000@example.com/10.0.0.2:5080":    "{\"host\":\"10.0.0.2\",\"port\":5080}",
+		"1001@example.com/2001:db8::1:5060": "{\"host\":\"2001:db8::1\",\"port\":5060}",
+	} {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packet_conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := NewDnsResponder(test_kv_backend, "reg.local", 300)
+	// Moved forward below, while the server is running.
+	var clock_offset int64
+	responder.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&clock_offset))) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	go serveDns(ctx, packet_conn, listener, responder, &test_wg)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		var result *dns.Msg
+		// The server may not have started yet.
+		for i := 0; i < 10; i++ {
+			result, err = dns.Exchange(m, packet_conn.LocalAddr().String())
+			if err == nil {
+				return result
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	result1 := query("1000.example.com.reg.local.", dns.TypeA)
+	if result1.Rcode != dns.RcodeSuccess || len(result1.Answer) != 2 {
+		t.Fatal("Expected 2 A records, got", result1)
+	}
+	for i, v := range []string{"10.0.0.1", "10.0.0.2"} {
+		if a, ok := result1.Answer[i].(*dns.A); ok != true || a.A.String() != v {
+			t.Error("Expected an A record for", v, "got", result1.Answer[i])
+		}
+	}
+
+	result2 := query("_sip._udp.1000.Example.com.reg.local.", dns.TypeSRV)
+	if result2.Rcode != dns.RcodeSuccess || len(result2.Answer) != 2 || len(result2.Extra) != 2 {
+		t.Fatal("Expected 2 SRV records with 2 additional records, got", result2)
+	}
+	srv, ok := result2.Answer[1].(*dns.SRV)
+	if ok != true || srv.Port != 5080 || srv.Target != "10-0-0-2._ip.reg.local." {
+		t.Error("Expected an SRV record for 10-0-0-2._ip.reg.local.:5080, got", result2.Answer[1])
+	}
+
+	result3 := query("10-0-0-2._ip.reg.local.", dns.TypeA)
+	if result3.Rcode != dns.RcodeSuccess || len(result3.Answer) != 1 || result3.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Error("Expected an A record for 10.0.0.2, got", result3)
+	}
+
+	result4 := query("1001.example.com.reg.local.", dns.TypeAAAA)
+	if result4.Rcode != dns.RcodeSuccess || len(result4.Answer) != 1 || result4.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::1" {
+		t.Error("Expected an AAAA record for 2001:db8::1, got", result4)
+	}
+	// Registered, but not over IPv4.
+	result5 := query("1001.example.com.reg.local.", dns.TypeA)
+	if result5.Rcode != dns.RcodeSuccess || len(result5.Answer) != 0 {
+		t.Error("Expected no answers, got", result5)
+	}
+
+	for name, expected_rcode := range map[string]int{
+		"1002.example.com.reg.local.": dns.RcodeNameError,
+		"example.reg.local.":          dns.RcodeNameError,
+		"reg.local.":                  dns.RcodeRefused,
+		"1000.example.com.":           dns.RcodeRefused,
+	} {
+		if result := query(name, dns.TypeA); result.Rcode != expected_rcode {
+			t.Errorf("Expected %s for %s, got %s", dns.RcodeToString[expected_rcode], name, dns.RcodeToString[result.Rcode])
+		}
+	}
+
+	// Answered from the cache until the TTL expires.
+	if err := test_kv_backend.Delete("1000@example.com/10.0.0.2:5080"); err != nil {
+		t.Fatal(err)
+	}
+	result6 := query("1000.example.com.reg.local.", dns.TypeA)
+	if len(result6.Answer) != 2 {
+		t.Error("Expected 2 (cached) A records, got", result6)
+	}
+	atomic.StoreInt64(&clock_offset, int64(301*time.Second))
+	result7 := query("1000.example.com.reg.local.", dns.TypeA)
+	if len(result7.Answer) != 1 {
+		t.Error("Expected 1 A record, got", result7)
+	}
+
+	// Should stop serving on shutdown.
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		test_wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for serveDns() to return after cancelling")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// What a full sync would change in the K/V backend, for this instance.
+type SyncPlan struct {
+	Add    []SyncPlanChange `json:"add"`
+	Update []SyncPlanChange `json:"update"`
+	Remove []SyncPlanChange `json:"remove"`
+}
+
+type SyncPlanChange struct {
+	Key string `json:"key"`
+	// Not set for adds.
+	Old *KvBackendValue `json:"old,omitempty"`
+	// Not set for removes.
+	New *KvBackendValue `json:"new,omitempty"`
+}
+
+func newSyncPlan(last_active_registrations *Registrations, current_active_registrations *Registrations) (*SyncPlan, error) {
+	add_registrations, remove_registrations, update_registrations, err := reconcileRegistrations(last_active_registrations, current_active_registrations)
+	if err != nil {
+		return nil, err
+	}
+	plan := &SyncPlan{Add: []SyncPlanChange{}, Update: []SyncPlanChange{}, Remove: []SyncPlanChange{}}
+	for _, k := range *add_registrations {
+		new_v := (*current_active_registrations)[k]
+		plan.Add = append(plan.Add, SyncPlanChange{Key: k, New: &new_v})
+	}
+	for _, k := range *update_registrations {
+		old_v := (*last_active_registrations)[k]
+		new_v := (*current_active_registrations)[k]
+		plan.Update = append(plan.Update, SyncPlanChange{Key: k, Old: &old_v, New: &new_v})
+	}
+	for _, k := range *remove_registrations {
+		old_v := (*last_active_registrations)[k]
+		plan.Remove = append(plan.Remove, SyncPlanChange{Key: k, Old: &old_v})
+	}
+	return plan, nil
+}
+
+// One line per change (+ add, ~ update, - remove) followed by a summary.
+func (p *SyncPlan) WriteText(w io.Writer) error {
+	for _, v := range p.Add {
+		if _, err := fmt.Fprintf(w, "+ %s %s\n", v.Key, getSyncPlanValueString(v.New)); err != nil {
+			return err
+		}
+	}
+	for _, v := range p.Update {
+		if _, err := fmt.Fprintf(w, "~ %s %s -> %s\n", v.Key, getSyncPlanValueString(v.Old), getSyncPlanValueString(v.New)); err != nil {
+			return err
+		}
+	}
+	for _, v := range p.Remove {
+		if _, err := fmt.Fprintf(w, "- %s %s\n", v.Key, getSyncPlanValueString(v.Old)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d to add, %d to update, %d to remove.\n", len(p.Add), len(p.Update), len(p.Remove))
+	return err
+}
+
+func (p *SyncPlan) WriteJson(w io.Writer) error {
+	encoded, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", encoded)
+	return err
+}
+
+func getSyncPlanValueString(v *KvBackendValue) string {
+	result, err := getKvBackendValueJsonString(*v)
+	if err != nil {
+		return fmt.Sprintf("%+v", *v)
+	}
+	return result
+}
+
+// Reads pass through, changes are logged and skipped, for --dry-run.
+type dryRunKvBackend struct {
+	KvBackend
+}
+
+func newDryRunKvBackend(kv_backend KvBackend) KvBackend {
+	return &dryRunKvBackend{KvBackend: kv_backend}
+}
+
+func (k *dryRunKvBackend) Write(key string, value string, ttl int) error {
+	log.Printf("DRY RUN: Not writing '%s': %s\n", key, value)
+	return nil
+}
+
+// Refreshes don't change anything visible, and happen for every key, only log them at debug.
+func (k *dryRunKvBackend) Refresh(key string, ttl int) error {
+	logDebugf("DRY RUN: Not refreshing '%s'\n", key)
+	return nil
+}
+
+func (k *dryRunKvBackend) Delete(key string) error {
+	log.Printf("DRY RUN: Not deleting '%s'\n", key)
+	return nil
+}
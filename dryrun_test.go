@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func getTestSyncPlan(t *testing.T) *SyncPlan {
+	last_input := Registrations{
+		"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060, Contact: "sip:1000@192.168.1.10:5060"},
+		"1001@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+	}
+	current_input := Registrations{
+		"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060, Contact: "sip:1000@192.168.1.11:5060"},
+		"1002@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060},
+	}
+	plan, err := newSyncPlan(&last_input, &current_input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestSyncPlanWriteText(t *testing.T) {
+	var result bytes.Buffer
+	err := getTestSyncPlan(t).WriteText(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_result := "+ 1002@domain/10.0.0.1:5060 {\"host\":\"10.0.0.1\",\"port\":5060}\n" +
+		"~ 1000@domain/10.0.0.1:5060 {\"host\":\"10.0.0.1\",\"port\":5060,\"contact\":\"sip:1000@192.168.1.10:5060\"} -> {\"host\":\"10.0.0.1\",\"port\":5060,\"contact\":\"sip:1000@192.168.1.11:5060\"}\n" +
+		"- 1001@domain/10.0.0.1:5060 {\"host\":\"10.0.0.1\",\"port\":5060}\n" +
+		"1 to add, 1 to update, 1 to remove.\n"
+	if result.String() != expected_result {
+		t.Errorf("Expected '%s', got '%s'", expected_result, result.String())
+	}
+}
+
+func TestSyncPlanWriteJson(t *testing.T) {
+	var result bytes.Buffer
+	err := getTestSyncPlan(t).WriteJson(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded_result SyncPlan
+	err = json.Unmarshal(result.Bytes(), &decoded_result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(&decoded_result, getTestSyncPlan(t)) != true {
+		t.Error("Expected", getTestSyncPlan(t), "got", decoded_result)
+	}
+
+	// Nothing to do is still a list (not null) of each.
+	result.Reset()
+	empty_plan, err := newSyncPlan(&Registrations{}, &Registrations{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = empty_plan.WriteJson(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_result := "{\n  \"add\": [],\n  \"update\": [],\n  \"remove\": []\n}\n"
+	if result.String() != expected_result {
+		t.Errorf("Expected '%s', got '%s'", expected_result, result.String())
+	}
+}
+
+func TestDryRunKvBackend(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	err := test_kv_backend.Write("1000@domain/10.0.0.1:5060", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv_backend := newDryRunKvBackend(test_kv_backend)
+
+	for _, err = range []error{
+		kv_backend.Write("1001@domain/10.0.0.1:5060", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300),
+		kv_backend.Refresh("1000@domain/10.0.0.1:5060", 300),
+		kv_backend.Delete("1000@domain/10.0.0.1:5060"),
+	} {
+		if err != nil {
+			t.Error("Expected nil error, got", err)
+		}
+	}
+	// Reads still go through, and nothing changed.
+	result, err := kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_result := map[string]string{"1000@domain/10.0.0.1:5060": "{\"host\":\"10.0.0.1\",\"port\":5060}"}
+	if reflect.DeepEqual(*result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", *result)
+	}
+}
+
+func TestReadRegistrationsForThisInstance(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	result1, err := readRegistrationsForThisInstance(test_kv_backend, []AdvertiseAddress{{"10.0.0.1", 5060}})
+	if err != nil || len(*result1) != 0 {
+		t.Error("Expected no registrations and nil error, got", result1, err)
+	}
+	for k, v := range map[string]string{
+		"1000@domain/10.0.0.1:5060": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+		"1000@domain/10.0.0.2:5060": "{\"host\":\"10.0.0.2\",\"port\":5060}",
+	} {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result2, err := readRegistrationsForThisInstance(test_kv_backend, []AdvertiseAddress{{"10.0.0.1", 5060}})
+	expected_result2 := Registrations{"1000@domain/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060}}
+	if err != nil || reflect.DeepEqual(*result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", result2, err)
+	}
+}
+
+// With --dry-run, a full sync logs the plan instead of applying it.
+func TestSyncRegistrationsOnceDryRun(t *testing.T) {
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	test_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer test_esl_conn.Close()
+	test_kv_backend := getTestMemoryKvBackend(t)
+	fake_esl_server.SetRegistrations("internal", []FsRegProfileRegistration{
+		getTestFakeEslRegistration("1000@sip.testserver.tld", 49210),
+	})
+	runtime_config := getTestRuntimeConfigWithArgs(&ArgConfig{
+		FreeswitchSofiaProfiles: []string{"internal"},
+		DryRun:                  true,
+	})
+
+	var log_output bytes.Buffer
+	log.SetOutput(&log_output)
+	err := syncRegistrationsOnce(context.Background(), test_esl_conn, "192.168.99.100", 5061, test_kv_backend, runtime_config)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = test_kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND error, got", err)
+	}
+	for _, v := range []string{
+		"DRY RUN: syncRegistrations(): + 1000@sip.testserver.tld/192.168.99.100:5061 ",
+		"DRY RUN: syncRegistrations(): 1 to add, 0 to update, 0 to remove.\n",
+	} {
+		if strings.Contains(log_output.String(), v) == false {
+			t.Errorf("Expected '%s' in the log, got '%s'", v, log_output.String())
+		}
+	}
+}
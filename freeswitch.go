@@ -6,16 +6,137 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/0x19/goesl"
 	"github.com/paulrosania/go-charset/charset"
 	_ "github.com/paulrosania/go-charset/data"
+	"golang.org/x/net/context"
 )
 
+// Reconnection attempts back off exponentially between these bounds.
+const eslReconnectMinBackoff = time.Second
+const eslReconnectMaxBackoff = time.Minute
+
+var errEslConnectionClosed = errors.New("ESL connection has been closed.")
+
+// FreeSWITCH doesn't know the Sofia profile, retrying won't fix this.
+type invalidSofiaProfileError struct {
+	Profile string
+}
+
+func (e *invalidSofiaProfileError) Error() string {
+	return fmt.Sprintf("Invalid Sofia Profile '%s'.", e.Profile)
+}
+
+// --fsprofiles value for watching every running Sofia profile.
+const sofiaProfilesAuto = "auto"
+
+// Wraps a goesl.Client, so the connection can be re-established if FreeSWITCH restarts.
+type EslConnection struct {
+	// Identifies the connection in metrics (eg. "event" or "sync").
+	Name     string
+	Host     string
+	Port     int
+	Password string
+	Client   *goesl.Client
+	// Guards Client against Close() being called from another goroutine (eg. on shutdown).
+	clientMutex sync.Mutex
+	closed      bool
+}
+
+// Makes a single connection attempt, the caller decides how to handle a failure.
+func NewEslConnection(name string, host string, port int, password string) (*EslConnection, error) {
+	esl_conn := &EslConnection{
+		Name:     name,
+		Host:     host,
+		Port:     port,
+		Password: password,
+	}
+	err := esl_conn.connect()
+	if err != nil {
+		return nil, err
+	}
+	return esl_conn, nil
+}
+
+func (e *EslConnection) connect() error {
+	client, err := goesl.NewClient(e.Host, uint(e.Port), e.Password, int(5))
+	if err != nil {
+		return err
+	}
+	e.clientMutex.Lock()
+	defer e.clientMutex.Unlock()
+	if e.closed == true {
+		client.Close()
+		return errEslConnectionClosed
+	}
+	go client.Handle()
+	e.Client = &client
+	metricEslConnectionUp.WithLabelValues(e.Name).Set(1)
+	return nil
+}
+
+// Closes the connection for good, any blocked ReadMessage() returns an error and it will not be re-established.
+func (e *EslConnection) Close() {
+	e.clientMutex.Lock()
+	defer e.clientMutex.Unlock()
+	e.closed = true
+	if e.Client != nil {
+		e.Client.Close()
+	}
+	metricEslConnectionUp.WithLabelValues(e.Name).Set(0)
+}
+
+// Blocks until a new connection is established, backing off exponentially between attempts.
+// Once goesl returns an error from ReadMessage() its Handle() loop has exited, so the old client is unusable.
+// Returns an error only if ctx is cancelled (or the connection closed) first.
+func (e *EslConnection) Reconnect(ctx context.Context) error {
+	e.clientMutex.Lock()
+	if e.Client != nil {
+		e.Client.Close()
+	}
+	e.clientMutex.Unlock()
+	metricEslConnectionUp.WithLabelValues(e.Name).Set(0)
+	backoff := eslReconnectMinBackoff
+	for {
+		log.Printf("Reconnecting to FreeSWITCH ESL (%s:%d) in %s...\n", e.Host, e.Port, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := e.connect()
+		if err == nil {
+			log.Printf("FreeSWITCH ESL Connection Re-established (%s:%d).\n", e.Host, e.Port)
+			return nil
+		}
+		if err == errEslConnectionClosed {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("WARNING: FreeSWITCH ESL Reconnection failed: %s\n", err.Error())
+		backoff *= 2
+		if backoff > eslReconnectMaxBackoff {
+			backoff = eslReconnectMaxBackoff
+		}
+	}
+}
+
 func subscribeToFreeswitchRegEvents(esl_client *goesl.Client) error {
 	// Ensure that we are listening to the required FreeSWITCH events, before we start watching the connection.
-	esl_client.Send("events json CUSTOM sofia::register sofia::unregister sofia::expire")
+	// HEARTBEAT events (every 20 seconds by default) let us tell an idle connection from a stuck one.
+	err := esl_client.Send("events json HEARTBEAT CUSTOM sofia::register sofia::unregister sofia::expire")
+	if err != nil {
+		return err
+	}
 	result, err := esl_client.ReadMessage()
 	if err != nil {
 		return err
@@ -35,21 +156,22 @@ func subscribeToFreeswitchRegEvents(esl_client *goesl.Client) error {
 }
 
 // These events don't have the full <user> like we get showing registrations, build it from username and from-host.
-// event_type string, user string, err error
-func parseFreeswitchRegEvent(event *goesl.Message) (string, string, error) {
+// The profile is empty if the event has no profile-name (it isn't required).
+// event_type string, user string, profile string, err error
+func parseFreeswitchRegEvent(event *goesl.Message) (string, string, string, error) {
 	for _, v := range []string{"Event-Subclass", "username", "from-host"} {
 		if _, ok := event.Headers[v]; ok == false {
-			return "", "", fmt.Errorf("getFreeswitchRegEvent() : '%s' field does not exist in FreeSWITCH Event, must be present.", v)
+			return "", "", "", fmt.Errorf("getFreeswitchRegEvent() : '%s' field does not exist in FreeSWITCH Event, must be present.", v)
 		}
 		if len(event.Headers[v]) == 0 {
-			return "", "", fmt.Errorf("getFreeswitchRegEvent() : '%s' field cannot be empty in FreeSWITCH Event.", v)
+			return "", "", "", fmt.Errorf("getFreeswitchRegEvent() : '%s' field cannot be empty in FreeSWITCH Event.", v)
 		}
 	}
 	valid_event_subclasses := []string{"sofia::register", "sofia::expire", "sofia::unregister"}
 	if stringInSlice(event.Headers["Event-Subclass"], valid_event_subclasses) == false {
-		return "", "", fmt.Errorf("getFreeswitchRegEvent() : 'Event-Subclass' field must be one of: %s", strings.Join(valid_event_subclasses, ", "))
+		return "", "", "", fmt.Errorf("getFreeswitchRegEvent() : 'Event-Subclass' field must be one of: %s", strings.Join(valid_event_subclasses, ", "))
 	}
-	return strings.Replace(event.Headers["Event-Subclass"], "sofia::", "", 1), fmt.Sprintf("%s@%s", event.Headers["username"], event.Headers["from-host"]), nil
+	return strings.Replace(event.Headers["Event-Subclass"], "sofia::", "", 1), fmt.Sprintf("%s@%s", event.Headers["username"], event.Headers["from-host"]), event.Headers["profile-name"], nil
 }
 
 type FsRegProfile struct {
@@ -73,36 +195,250 @@ type FsRegProfileRegistration struct {
 	MwiAccount   string  `xml:"mwi-account"`
 }
 
-func getFreeswitchRegistrations(esl_client *goesl.Client, sofia_profiles []string) (*[]string, error) {
-	var results []string
+// As listed by "sofia xmlstatus", gateways and aliases are separate elements so aren't included.
+type FsSofiaStatus struct {
+	Profiles []FsSofiaStatusProfile `xml:"profile"`
+}
+
+type FsSofiaStatusProfile struct {
+	Name  string `xml:"name"`
+	Type  string `xml:"type"`
+	State string `xml:"state"`
+}
+
+// The running Sofia profiles, for --fsprofiles auto.
+func getFreeswitchSofiaProfiles(esl_client *goesl.Client) ([]string, error) {
+	err := esl_client.Send("api sofia xmlstatus")
+	if err != nil {
+		return nil, err
+	}
+	msg, err := esl_client.ReadMessage()
+	if err != nil {
+		// goesl stops reading from the connection after any error, the caller needs to reconnect.
+		return nil, err
+	}
+	eslRecorder.Record("profiles", "", msg)
+	return parseFreeswitchSofiaStatus(msg.Body)
+}
+
+// Parses the response to "sofia xmlstatus", returning the names of the running profiles (sorted).
+func parseFreeswitchSofiaStatus(body []byte) ([]string, error) {
+	var parsed_msg FsSofiaStatus
+	decoder := xml.NewDecoder(bytes.NewBuffer(body))
+	decoder.CharsetReader = charset.NewReader
+	err := decoder.Decode(&parsed_msg)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, v := range parsed_msg.Profiles {
+		// eg. "RUNNING (0)", as opposed to a profile that failed to start.
+		if v.Type == "profile" && strings.HasPrefix(v.State, "RUNNING") == true {
+			result = append(result, v.Name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// --fsadvertisefrom values, which address of a Sofia profile to advertise its registrations with.
+var advertiseFromValues = []string{"sip-ip", "ext-sip-ip"}
+
+// As per "sofia xmlstatus profile <name>", only what is needed to derive the advertise address.
+type FsSofiaProfileInfo struct {
+	SipIp    string `xml:"profile-info>sip-ip"`
+	ExtSipIp string `xml:"profile-info>ext-sip-ip"`
+	SipPort  string `xml:"profile-info>sip-port"`
+}
+
+// The address to advertise registrations on the Sofia profile with, advertise_from is one of advertiseFromValues.
+func getFreeswitchProfileAdvertiseAddress(esl_client *goesl.Client, sofia_profile string, advertise_from string) (AdvertiseAddress, error) {
+	err := esl_client.Send(fmt.Sprintf("api sofia xmlstatus profile %s", sofia_profile))
+	if err != nil {
+		return AdvertiseAddress{}, err
+	}
+	msg, err := esl_client.ReadMessage()
+	if err != nil {
+		// goesl stops reading from the connection after any error, the caller needs to reconnect.
+		return AdvertiseAddress{}, err
+	}
+	eslRecorder.Record("profile_info", sofia_profile, msg)
+	return parseFreeswitchProfileAdvertiseAddress(sofia_profile, msg.Body, advertise_from)
+}
+
+// Parses the response to "sofia xmlstatus profile <name>". ext-sip-ip falls back to sip-ip if the profile doesn't set one.
+func parseFreeswitchProfileAdvertiseAddress(sofia_profile string, body []byte, advertise_from string) (AdvertiseAddress, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("Invalid Profile")) {
+		return AdvertiseAddress{}, &invalidSofiaProfileError{Profile: sofia_profile}
+	}
+	var parsed_msg FsSofiaProfileInfo
+	decoder := xml.NewDecoder(bytes.NewBuffer(body))
+	decoder.CharsetReader = charset.NewReader
+	err := decoder.Decode(&parsed_msg)
+	if err != nil {
+		return AdvertiseAddress{}, err
+	}
+	result := AdvertiseAddress{Ip: parsed_msg.SipIp}
+	if advertise_from == "ext-sip-ip" && len(parsed_msg.ExtSipIp) > 0 {
+		result.Ip = parsed_msg.ExtSipIp
+	}
+	if len(result.Ip) == 0 {
+		return AdvertiseAddress{}, fmt.Errorf("Sofia Profile '%s' has no %s.", sofia_profile, advertise_from)
+	}
+	result.Port, err = strconv.Atoi(parsed_msg.SipPort)
+	if err != nil || result.Port <= 0 {
+		return AdvertiseAddress{}, fmt.Errorf("Sofia Profile '%s' has an invalid sip-port '%s'.", sofia_profile, parsed_msg.SipPort)
+	}
+	return result, nil
+}
+
+// Whether a profile matches at least one include pattern (or there are none), and no exclude pattern.
+// The patterns have already been validated by parseFlags().
+func matchSofiaProfilePatterns(profile string, include []string, exclude []string) bool {
+	included := len(include) == 0
+	for _, v := range include {
+		if matched, _ := path.Match(v, profile); matched == true {
+			included = true
+			break
+		}
+	}
+	if included == false {
+		return false
+	}
+	for _, v := range exclude {
+		if matched, _ := path.Match(v, profile); matched == true {
+			return false
+		}
+	}
+	return true
+}
+
+// A registration as listed by "sofia xmlstatus", along with the Sofia Profile it was listed under.
+type FsRegistration struct {
+	Profile string
+	// With --fsadvertisefrom, the address derived from the Sofia profile. Otherwise empty/0, the instance's is used.
+	AdvertiseIp   string
+	AdvertisePort int
+	FsRegProfileRegistration
+}
+
+func getFreeswitchRegistrations(esl_client *goesl.Client, sofia_profiles []string) (*[]FsRegistration, error) {
+	var results []FsRegistration
+	seen_users := make(map[string]bool)
+	// Groups the responses for replayEslRecords(), a sync_end is only recorded if they were all fetched.
+	eslRecorder.RecordMarker("sync_begin")
 	for _, sofia_profile := range sofia_profiles {
 		log.Printf("getFreeswitchRegistrations(): Fetching Registrations for Sofia Profile '%s'.\n", sofia_profile)
-		esl_client.Send(fmt.Sprintf("api sofia xmlstatus profile %s reg", sofia_profile))
+		err := esl_client.Send(fmt.Sprintf("api sofia xmlstatus profile %s reg", sofia_profile))
+		if err != nil {
+			return new([]FsRegistration), err
+		}
 		msg, err := esl_client.ReadMessage()
 		if err != nil {
-			// TODO: decide on the right course of action here...
-			// If it contains EOF, we really dont care...
-			if !strings.Contains(err.Error(), "EOF") && err.Error() != "unexpected end of JSON input" {
-				log.Printf("Error while reading Freeswitch message: %s", err.Error())
-				continue
-			}
-			return new([]string), err
+			// goesl stops reading from the connection after any error, the caller needs to reconnect.
+			return new([]FsRegistration), err
 		}
+		eslRecorder.Record("xmlstatus", sofia_profile, msg)
 		// TODOLATER: do we want to check the msg.Headers at all?
-		var parsed_msg FsRegProfile
-		// The XML is ISO-8859-1 as received from FreeSWITCH, convert to UTF-8.
-		decoder := xml.NewDecoder(bytes.NewBuffer(msg.Body))
-		decoder.CharsetReader = charset.NewReader
-		err = decoder.Decode(&parsed_msg)
+		registrations, err := parseFreeswitchXmlStatus(sofia_profile, msg.Body)
 		if err != nil {
-			return new([]string), err
-		}
-		//log.Printf("Sofia Profile '%s' Registrations: %+v\n", sofia_profile, parsed_msg)
-		for _, v := range parsed_msg.Registrations {
-			if len(v.User) > 0 && stringInSlice(v.User, results) == false {
-				results = append(results, v.User)
-			}
+			return new([]FsRegistration), err
 		}
+		results = mergeFreeswitchRegistrations(results, seen_users, sofia_profile, registrations)
 	}
+	eslRecorder.RecordMarker("sync_end")
 	return &results, nil
 }
+
+// Parses the response to "sofia xmlstatus profile <name> reg".
+func parseFreeswitchXmlStatus(sofia_profile string, body []byte) ([]FsRegProfileRegistration, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("Invalid Profile")) {
+		return nil, &invalidSofiaProfileError{Profile: sofia_profile}
+	}
+	var parsed_msg FsRegProfile
+	// The XML is ISO-8859-1 as received from FreeSWITCH, convert to UTF-8.
+	decoder := xml.NewDecoder(bytes.NewBuffer(body))
+	decoder.CharsetReader = charset.NewReader
+	err := decoder.Decode(&parsed_msg)
+	if err != nil {
+		return nil, err
+	}
+	//log.Printf("Sofia Profile '%s' Registrations: %+v\n", sofia_profile, parsed_msg)
+	return parsed_msg.Registrations, nil
+}
+
+// Appends the registrations of a Sofia profile to results.
+// If a user is registered more than once (eg. on multiple profiles), the first one wins.
+func mergeFreeswitchRegistrations(results []FsRegistration, seen_users map[string]bool, sofia_profile string, registrations []FsRegProfileRegistration) []FsRegistration {
+	for _, v := range registrations {
+		if len(v.User) > 0 && seen_users[v.User] == false {
+			seen_users[v.User] = true
+			results = append(results, FsRegistration{
+				Profile:                  sofia_profile,
+				FsRegProfileRegistration: v,
+			})
+		}
+	}
+	return results
+}
+
+// Strips any display name and angle brackets from a Contact, eg. "Name" <sip:user@host:port;ob> becomes sip:user@host:port;ob
+func getSipUriFromContact(contact string) string {
+	start := strings.Index(contact, "<")
+	end := strings.LastIndex(contact, ">")
+	if start == -1 || end <= start {
+		return strings.TrimSpace(contact)
+	}
+	return contact[start+1 : end]
+}
+
+// The xmlstatus registration status looks like "Registered(UDP)(unknown) EXP(2016-08-05 03:22:51) EXPSECS(300)".
+// Returns 0 if the expiry cannot be found.
+func getExpirySecondsFromFreeswitchRegStatus(status string) int {
+	start := strings.Index(status, "EXPSECS(")
+	if start == -1 {
+		return 0
+	}
+	remainder := status[start+len("EXPSECS("):]
+	end := strings.Index(remainder, ")")
+	if end == -1 {
+		return 0
+	}
+	expiry_seconds, err := strconv.Atoi(remainder[:end])
+	if err != nil {
+		return 0
+	}
+	return expiry_seconds
+}
+
+// Builds the value to store in the K/V backend for a sofia::register event.
+func getKvBackendValueFromFreeswitchRegEvent(event *goesl.Message, advertise_ip string, advertise_port int, now time.Time) KvBackendValue {
+	result := getKvBackendValueType(advertise_ip, advertise_port)
+	result.Contact = getSipUriFromContact(event.Headers["contact"])
+	result.UserAgent = event.Headers["user-agent"]
+	result.NetworkIp = event.Headers["network-ip"]
+	// These are optional, leave them out if they can't be parsed.
+	result.NetworkPort, _ = strconv.Atoi(event.Headers["network-port"])
+	result.Profile = event.Headers["profile-name"]
+	if expiry_seconds, err := strconv.Atoi(event.Headers["expires"]); err == nil && expiry_seconds > 0 {
+		result.Expires = now.Unix() + int64(expiry_seconds)
+	}
+	result.RecordedAt = now.Unix()
+	return result
+}
+
+// Builds the value to store in the K/V backend for a registration listed by "sofia xmlstatus".
+func getKvBackendValueFromFreeswitchRegistration(registration FsRegistration, advertise_ip string, advertise_port int, now time.Time) KvBackendValue {
+	result := getKvBackendValueType(advertise_ip, advertise_port)
+	result.Contact = getSipUriFromContact(registration.Contact)
+	result.UserAgent = registration.Agent
+	result.NetworkIp = registration.NetworkIp
+	// Optional, leave it out if it can't be parsed.
+	result.NetworkPort, _ = strconv.Atoi(registration.NetworkPort)
+	result.Profile = registration.Profile
+	if expiry_seconds := getExpirySecondsFromFreeswitchRegStatus(registration.Status); expiry_seconds > 0 {
+		result.Expires = now.Unix() + int64(expiry_seconds)
+	}
+	result.RecordedAt = now.Unix()
+	return result
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process stand-in for FreeSWITCH's event socket, so the ESL handling can be tested without Docker.
+// Understands auth, "events json ...", "api sofia xmlstatus", "api sofia xmlstatus profile <name>" and
+// "api sofia xmlstatus profile <name> reg", and sends scripted events
+// to every subscribed connection.
+type fakeEslServer struct {
+	Password string
+	listener net.Listener
+	mutex    sync.Mutex
+	// Registrations listed by "sofia xmlstatus", by Sofia profile. Any other profile is invalid.
+	profiles map[string][]FsRegProfileRegistration
+	// sip-ip, ext-sip-ip and sip-port listed by "sofia xmlstatus profile <name>", 127.0.0.1 and 5060 if not set.
+	profileAddresses map[string][3]string
+	conns            map[*fakeEslConn]bool
+	// Notified on each subscription.
+	subscriptions chan struct{}
+}
+
+type fakeEslConn struct {
+	net.Conn
+	writeMutex sync.Mutex
+	subscribed bool
+}
+
+func (c *fakeEslConn) send(headers string, body string) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if len(body) > 0 {
+		headers += fmt.Sprintf("Content-Length: %d\n", len(body))
+	}
+	_, err := fmt.Fprintf(c, "%s\n%s", headers, body)
+	return err
+}
+
+// Listens on a random local port, until the test finishes.
+func newFakeEslServer(t *testing.T) *fakeEslServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeEslServer{
+		Password:         "ClueCon",
+		listener:         listener,
+		profiles:         make(map[string][]FsRegProfileRegistration),
+		profileAddresses: make(map[string][3]string),
+		conns:            make(map[*fakeEslConn]bool),
+		subscriptions:    make(chan struct{}, 10),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeEslServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Connects with the usual test password.
+func (s *fakeEslServer) getTestEslConnection(t *testing.T) *EslConnection {
+	test_conn, err := NewEslConnection("test", "127.0.0.1", s.Port(), "ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test_conn
+}
+
+func (s *fakeEslServer) Close() {
+	s.listener.Close()
+	s.DropConnections()
+}
+
+// Closes every connection, as if FreeSWITCH restarted.
+func (s *fakeEslServer) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c, _ := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+}
+
+func (s *fakeEslServer) SetRegistrations(profile string, registrations []FsRegProfileRegistration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.profiles[profile] = registrations
+}
+
+func (s *fakeEslServer) SetProfileAddress(profile string, sip_ip string, ext_sip_ip string, sip_port int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.profileAddresses[profile] = [3]string{sip_ip, ext_sip_ip, fmt.Sprintf("%d", sip_port)}
+}
+
+// Blocks until a connection subscribes to events.
+func (s *fakeEslServer) WaitForSubscription(t *testing.T) {
+	select {
+	case <-s.subscriptions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an ESL subscription")
+	}
+}
+
+// Sends an event (eg. from getTestFakeEslRegEvent()) to every subscribed connection.
+func (s *fakeEslServer) SendEvent(t *testing.T, headers map[string]string) {
+	body, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c, _ := range s.conns {
+		if c.subscribed == true {
+			if err := c.send("Content-Type: text/event-json\n", string(body)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func (s *fakeEslServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeEslConn{Conn: conn}
+		s.mutex.Lock()
+		s.conns[c] = true
+		s.mutex.Unlock()
+		go s.handleConn(c)
+	}
+}
+
+// Reads a command, terminated by a blank line.
+func readFakeEslCommand(reader *bufio.Reader) (string, error) {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			if len(lines) == 0 {
+				continue
+			}
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (s *fakeEslServer) handleConn(c *fakeEslConn) {
+	defer func() {
+		c.Close()
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+	}()
+	reader := bufio.NewReader(c)
+	c.send("Content-Type: auth/request\n", "")
+	command, err := readFakeEslCommand(reader)
+	if err != nil {
+		return
+	}
+	if command != fmt.Sprintf("auth %s", s.Password) {
+		c.send("Content-Type: command/reply\nReply-Text: -ERR invalid\n", "")
+		return
+	}
+	c.send("Content-Type: command/reply\nReply-Text: +OK accepted\n", "")
+	for {
+		command, err := readFakeEslCommand(reader)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(command)
+		switch {
+		case len(fields) >= 2 && fields[0] == "events" && fields[1] == "json":
+			s.mutex.Lock()
+			c.subscribed = true
+			s.mutex.Unlock()
+			c.send("Content-Type: command/reply\nReply-Text: +OK event listener enabled json\n", "")
+			s.subscriptions <- struct{}{}
+		case len(fields) == 6 && strings.Join(fields[:4], " ") == "api sofia xmlstatus profile" && fields[5] == "reg":
+			c.send("Content-Type: api/response\n", s.getXmlStatus(fields[4]))
+		case len(fields) == 5 && strings.Join(fields[:4], " ") == "api sofia xmlstatus profile":
+			c.send("Content-Type: api/response\n", s.getProfileInfoXmlStatus(fields[4]))
+		case command == "api sofia xmlstatus":
+			c.send("Content-Type: api/response\n", s.getProfilesXmlStatus())
+		case len(fields) == 1 && fields[0] == "exit":
+			c.send("Content-Type: command/reply\nReply-Text: +OK bye\n", "")
+			return
+		default:
+			log.Printf("fakeEslServer: Unknown command '%s'\n", command)
+			c.send("Content-Type: command/reply\nReply-Text: -ERR command not found\n", "")
+		}
+	}
+}
+
+// As per "sofia xmlstatus profile <name> reg".
+func (s *fakeEslServer) getXmlStatus(profile string) string {
+	s.mutex.Lock()
+	registrations, ok := s.profiles[profile]
+	s.mutex.Unlock()
+	if ok == false {
+		return "Invalid Profile!\n"
+	}
+	result, err := xml.MarshalIndent(struct {
+		XMLName       xml.Name                   `xml:"profile"`
+		Registrations []FsRegProfileRegistration `xml:"registrations>registration"`
+	}{Registrations: registrations}, "", "  ")
+	if err != nil {
+		log.Printf("fakeEslServer: %s\n", err)
+		return ""
+	}
+	return "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" + string(result) + "\n"
+}
+
+// As per "sofia xmlstatus profile <name>", trimmed.
+func (s *fakeEslServer) getProfileInfoXmlStatus(profile string) string {
+	s.mutex.Lock()
+	_, ok := s.profiles[profile]
+	address, address_ok := s.profileAddresses[profile]
+	s.mutex.Unlock()
+	if ok == false {
+		return "Invalid Profile!\n"
+	}
+	if address_ok == false {
+		address = [3]string{"127.0.0.1", "", "5060"}
+	}
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<profile>\n<profile-info>\n<name>%s</name>\n<domain-name>N/A</domain-name>\n<sip-ip>%s</sip-ip>\n<ext-sip-ip>%s</ext-sip-ip>\n<sip-port>%s</sip-port>\n</profile-info>\n</profile>\n", profile, address[0], address[1], address[2])
+}
+
+// As per "sofia xmlstatus", every profile with registrations set is running. Includes an alias and a gateway,
+// as FreeSWITCH would.
+func (s *fakeEslServer) getProfilesXmlStatus() string {
+	s.mutex.Lock()
+	var profiles []string
+	for k, _ := range s.profiles {
+		profiles = append(profiles, k)
+	}
+	s.mutex.Unlock()
+	sort.Strings(profiles)
+	result := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<profiles>\n"
+	for _, v := range profiles {
+		result += fmt.Sprintf("<profile>\n<name>%s</name>\n<type>profile</type>\n<data>sip:mod_sofia@127.0.0.1:5060</data>\n<state>RUNNING (0)</state>\n</profile>\n", v)
+		result += fmt.Sprintf("<gateway>\n<name>%s::gateway</name>\n<type>gateway</type>\n<data>sip:gateway@127.0.0.1</data>\n<state>NOREG</state>\n</gateway>\n", v)
+	}
+	result += "<alias>\n<name>127.0.0.1</name>\n<type>alias</type>\n<data>internal</data>\n<state>ALIASED</state>\n</alias>\n</profiles>\n"
+	return result
+}
+
+// A registration as listed by "sofia xmlstatus".
+func getTestFakeEslRegistration(user string, contact_port int) FsRegProfileRegistration {
+	username := strings.SplitN(user, "@", 2)[0]
+	return FsRegProfileRegistration{
+		CallId:      fmt.Sprintf("%s-call-id", username),
+		User:        user,
+		Contact:     fmt.Sprintf("\"%s\" <sip:%s@127.0.0.1:%d>", username, username, contact_port),
+		Agent:       "Telephone 1.1.7",
+		Status:      "Registered(UDP)(unknown) EXP(2016-08-05 03:22:51) EXPSECS(300)",
+		NetworkIp:   "127.0.0.1",
+		NetworkPort: fmt.Sprintf("%d", contact_port),
+	}
+}
+
+// A sofia::register, sofia::unregister or sofia::expire event for user@domain, on the internal profile.
+func getTestFakeEslRegEvent(subclass string, user string, contact_port int) map[string]string {
+	split_user := strings.SplitN(user, "@", 2)
+	headers := make(map[string]string)
+	for k, v := range getTestFreeswitchRegEvent().Headers {
+		headers[k] = v
+	}
+	headers["Event-Subclass"] = subclass
+	headers["username"] = split_user[0]
+	headers["from-user"] = split_user[0]
+	headers["to-user"] = split_user[0]
+	headers["from-host"] = split_user[1]
+	headers["contact"] = fmt.Sprintf("<sip:%s@127.0.0.1:%d>", split_user[0], contact_port)
+	headers["network-ip"] = "127.0.0.1"
+	headers["network-port"] = fmt.Sprintf("%d", contact_port)
+	headers["profile-name"] = "internal"
+	return headers
+}
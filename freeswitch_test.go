@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/0x19/goesl"
+	"golang.org/x/net/context"
 )
 
 func checkSipPortIsAvailable(t *testing.T) {
+	skipWithoutDocker(t)
 	if _, ok := dockerContainerPorts["freeswitch_1-5060/udp"]; ok == false {
 		t.Fatal("Docker Container port for FreeSWITCH SIP not found in dockerContainerPorts, did the container start?")
 	}
@@ -48,6 +54,7 @@ func simulateSipDeregister(host string, port uint, user string, password string,
 }
 
 func getTestEslClient(t *testing.T) *goesl.Client {
+	skipWithoutDocker(t)
 	if _, ok := dockerContainerPorts["freeswitch_1-8021/tcp"]; ok == false {
 		t.Fatal("Docker Container port for FreeSWITCH ESL not found in dockerContainerPorts, did the container start?")
 	}
@@ -60,6 +67,143 @@ func getTestEslClient(t *testing.T) *goesl.Client {
 	return &test_client
 }
 
+func getTestEslConnection(t *testing.T) *EslConnection {
+	skipWithoutDocker(t)
+	if _, ok := dockerContainerPorts["freeswitch_1-8021/tcp"]; ok == false {
+		t.Fatal("Docker Container port for FreeSWITCH ESL not found in dockerContainerPorts, did the container start?")
+	}
+	test_conn, err := NewEslConnection("test", dockerHost, int(dockerContainerPorts["freeswitch_1-8021/tcp"]), "ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test_conn
+}
+
+// Performs the server side of ESL authentication on a connection.
+func acceptTestEslAuth(conn net.Conn, password string) error {
+	fmt.Fprint(conn, "Content-Type: auth/request\n\n")
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != fmt.Sprintf("auth %s", password) {
+		fmt.Fprint(conn, "Content-Type: command/reply\nReply-Text: -ERR invalid\n\n")
+		return fmt.Errorf("Unexpected auth command: %s", line)
+	}
+	// Skip the blank line terminating the command.
+	reader.ReadString('\n')
+	fmt.Fprint(conn, "Content-Type: command/reply\nReply-Text: +OK accepted\n\n")
+	return nil
+}
+
+func TestEslConnectionReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if err := acceptTestEslAuth(conn, "ClueCon"); err != nil {
+				log.Printf("TestEslConnectionReconnect() : %s\n", err)
+			}
+			accepted <- conn
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	test_conn, err := NewEslConnection("test", "127.0.0.1", port, "ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first_client := test_conn.Client
+	// Simulate FreeSWITCH going away.
+	(<-accepted).Close()
+	_, err = test_conn.Client.ReadMessage()
+	if err == nil {
+		t.Fatal("Expected an error after the connection was closed, got nil")
+	}
+
+	err = test_conn.Reconnect(context.Background())
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	second_conn := <-accepted
+	defer second_conn.Close()
+	if test_conn.Client == first_client {
+		t.Error("Expected a new client after reconnecting, got the original")
+	}
+	// And the new connection should be usable.
+	fmt.Fprint(second_conn, "Content-Type: command/reply\nReply-Text: +OK event listener enabled json\n\n")
+	msg, err := test_conn.Client.ReadMessage()
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if msg.Headers["Reply-Text"] != "+OK event listener enabled json" {
+		t.Error("Expected a Reply-Text of +OK event listener enabled json, got", msg.Headers["Reply-Text"])
+	}
+}
+
+func TestEslConnectionClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if err := acceptTestEslAuth(conn, "ClueCon"); err != nil {
+				log.Printf("TestEslConnectionClose() : %s\n", err)
+			}
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	test_conn, err := NewEslConnection("test", "127.0.0.1", port, "ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing should unblock a pending read, as happens on shutdown.
+	read_err := make(chan error)
+	go func() {
+		_, err := test_conn.Client.ReadMessage()
+		read_err <- err
+	}()
+	test_conn.Close()
+	select {
+	case err = <-read_err:
+		if err == nil {
+			t.Error("Expected an error after the connection was closed, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for ReadMessage() to return after Close()")
+	}
+	// And it should not be re-established.
+	err = test_conn.Reconnect(context.Background())
+	if err != errEslConnectionClosed {
+		t.Error("Expected", errEslConnectionClosed, "got", err)
+	}
+
+	// A cancelled context stops reconnection attempts.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	test_conn2 := &EslConnection{Host: "127.0.0.1", Port: port, Password: "ClueCon"}
+	err = test_conn2.Reconnect(ctx)
+	if err != context.Canceled {
+		t.Error("Expected", context.Canceled, "got", err)
+	}
+}
+
 /*
 // TODO: we may have to rely on the tests in goroutine_test.go for this one,
 // as its blocking and would need to be run in a goroutine otherwise. could possibly do it with channels standalone...
@@ -72,10 +216,9 @@ func TestSubscribeToFreeswitchRegEvents(t *testing.T) {
 }
 */
 
-func TestParseFreeswitchRegEvent(t *testing.T) {
-	expected_result1 := "register"
-	expected_result2 := "someuser@sip.somedomain.com"
-	input := goesl.Message{
+// A sofia::register event, as received from FreeSWITCH.
+func getTestFreeswitchRegEvent() *goesl.Message {
+	return &goesl.Message{
 		Headers: map[string]string{
 			"call-id":                   "AbtneHy2nQkhY-S.ypzYrl25I9zEIPGN",
 			"contact":                   "\"Firstname Lastname\" <sip:someuser@192.168.99.1:58843;ob>",
@@ -110,7 +253,13 @@ func TestParseFreeswitchRegEvent(t *testing.T) {
 		},
 		Body: []byte{},
 	}
-	result1, result2, err := parseFreeswitchRegEvent(&input)
+}
+
+func TestParseFreeswitchRegEvent(t *testing.T) {
+	expected_result1 := "register"
+	expected_result2 := "someuser@sip.somedomain.com"
+	expected_result3 := "someprofile"
+	result1, result2, result3, err := parseFreeswitchRegEvent(getTestFreeswitchRegEvent())
 	if err != nil {
 		t.Error("Expected nil error, got", err)
 	}
@@ -120,6 +269,61 @@ func TestParseFreeswitchRegEvent(t *testing.T) {
 	if result2 != expected_result2 {
 		t.Error("Expected", expected_result2, "got", result2)
 	}
+	if result3 != expected_result3 {
+		t.Error("Expected", expected_result3, "got", result3)
+	}
+	// profile-name is optional.
+	event := getTestFreeswitchRegEvent()
+	delete(event.Headers, "profile-name")
+	_, _, result4, err := parseFreeswitchRegEvent(event)
+	if err != nil || len(result4) != 0 {
+		t.Error("Expected an empty profile and nil error, got", result4, err)
+	}
+}
+
+func TestGetKvBackendValueFromFreeswitchRegEvent(t *testing.T) {
+	expected_result := KvBackendValue{
+		Host:        "10.20.30.40",
+		Port:        5061,
+		Contact:     "sip:someuser@192.168.99.1:58843;ob",
+		UserAgent:   "Telephone 1.1.7",
+		NetworkIp:   "192.168.99.1",
+		NetworkPort: 58843,
+		Profile:     "someprofile",
+		Expires:     1470367371,
+		RecordedAt:  1470367071,
+	}
+	result := getKvBackendValueFromFreeswitchRegEvent(getTestFreeswitchRegEvent(), "10.20.30.40", 5061, time.Unix(1470367071, 0))
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
+
+func TestGetSipUriFromContact(t *testing.T) {
+	for input, expected_result := range map[string]string{
+		"\"Firstname Lastname\" <sip:someuser@192.168.99.1:58843;ob>": "sip:someuser@192.168.99.1:58843;ob",
+		"<sip:1000@127.0.0.1:49201>":                                  "sip:1000@127.0.0.1:49201",
+		"sip:1000@127.0.0.1:49201":                                    "sip:1000@127.0.0.1:49201",
+		"":                                                            "",
+	} {
+		result := getSipUriFromContact(input)
+		if result != expected_result {
+			t.Error("Expected", expected_result, "got", result)
+		}
+	}
+}
+
+func TestGetExpirySecondsFromFreeswitchRegStatus(t *testing.T) {
+	for input, expected_result := range map[string]int{
+		"Registered(UDP)(unknown) EXP(2016-08-05 03:22:51) EXPSECS(300)": 300,
+		"Registered(UDP)(unknown) EXP(2016-08-05 03:22:51)":              0,
+		"Registered(UDP)(unknown) EXPSECS(abc)":                          0,
+	} {
+		result := getExpirySecondsFromFreeswitchRegStatus(input)
+		if result != expected_result {
+			t.Error("Expected", expected_result, "got", result)
+		}
+	}
 }
 
 func TestGetFreeswitchRegistrations(t *testing.T) {
@@ -136,9 +340,161 @@ func TestGetFreeswitchRegistrations(t *testing.T) {
 		t.Error("Expected nil error, got", err)
 	}
 	//log.Printf("Test FS Registrations: %+v\n", result)
-	if reflect.DeepEqual(*result, expected_result) != true {
-		t.Error("Expected", expected_result, "got", result)
+	var result_users []string
+	for _, v := range *result {
+		result_users = append(result_users, v.User)
+		if v.Profile != "internal" {
+			t.Error("Expected a Profile of internal, got", v.Profile)
+		}
+		if strings.Contains(v.Contact, "127.0.0.1:49201") == false {
+			t.Error("Expected a Contact containing 127.0.0.1:49201, got", v.Contact)
+		}
+	}
+	if reflect.DeepEqual(result_users, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result_users)
 	}
 	// Cleanup so other tests can make registrations if required.
 	simulateSipDeregister(dockerHost, uint(dockerContainerPorts["freeswitch_1-5060/udp"]), "1000", "1234", uint(49201), t)
 }
+
+func TestGetFreeswitchRegistrationsFake(t *testing.T) {
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	test_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer test_esl_conn.Close()
+	fake_esl_server.SetRegistrations("internal", []FsRegProfileRegistration{getTestFakeEslRegistration("1000@sip.testserver.tld", 49201)})
+	// The same user on another profile, the first one wins.
+	fake_esl_server.SetRegistrations("external", []FsRegProfileRegistration{
+		getTestFakeEslRegistration("1000@sip.testserver.tld", 49202),
+		getTestFakeEslRegistration("1001@sip.testserver.tld", 49203),
+	})
+	result, err := getFreeswitchRegistrations(test_esl_conn.Client, []string{"internal", "external"})
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected_result := []string{"1000@sip.testserver.tld internal 127.0.0.1:49201", "1001@sip.testserver.tld external 127.0.0.1:49203"}
+	var result_users []string
+	for _, v := range *result {
+		result_users = append(result_users, fmt.Sprintf("%s %s %s:%s", v.User, v.Profile, v.NetworkIp, v.NetworkPort))
+	}
+	if reflect.DeepEqual(result_users, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result_users)
+	}
+
+	_, err = getFreeswitchRegistrations(test_esl_conn.Client, []string{"internal", "missing"})
+	if _, ok := err.(*invalidSofiaProfileError); ok == false || err.Error() != "Invalid Sofia Profile 'missing'." {
+		t.Error("Expected an invalidSofiaProfileError, got", err)
+	}
+}
+
+func TestParseFreeswitchSofiaStatus(t *testing.T) {
+	// As per "sofia xmlstatus" on FreeSWITCH 1.6, trimmed.
+	body := []byte(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<profiles>
+<profile>
+<name>external</name>
+<type>profile</type>
+<data>sip:mod_sofia@192.168.99.100:5080</data>
+<state>RUNNING (0)</state>
+</profile>
+<gateway>
+<name>external::carrier</name>
+<type>gateway</type>
+<data>sip:carrier.example.com</data>
+<state>NOREG</state>
+</gateway>
+<alias>
+<name>192.168.99.100</name>
+<type>alias</type>
+<data>internal</data>
+<state>ALIASED</state>
+</alias>
+<profile>
+<name>internal</name>
+<type>profile</type>
+<data>sip:mod_sofia@192.168.99.100:5060</data>
+<state>RUNNING (2)</state>
+</profile>
+<profile>
+<name>internal-ipv6</name>
+<type>profile</type>
+<data>sip:mod_sofia@[::1]:5060</data>
+<state>DOWN</state>
+</profile>
+</profiles>
+`)
+	result, err := parseFreeswitchSofiaStatus(body)
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected_result := []string{"external", "internal"}
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+	if _, err = parseFreeswitchSofiaStatus([]byte("-ERR sofia Command not found!\n")); err == nil {
+		t.Error("Expected an error, got nil")
+	}
+}
+
+func TestMatchSofiaProfilePatterns(t *testing.T) {
+	for _, v := range []struct {
+		profile         string
+		include         []string
+		exclude         []string
+		expected_result bool
+	}{
+		{"internal", nil, nil, true},
+		{"internal", []string{"internal*"}, nil, true},
+		{"internal-ipv6", []string{"internal*"}, []string{"*-ipv6"}, false},
+		{"external", []string{"internal*"}, nil, false},
+		{"external", []string{"internal*", "external"}, nil, true},
+		{"external", nil, []string{"ext*"}, false},
+	} {
+		result := matchSofiaProfilePatterns(v.profile, v.include, v.exclude)
+		if result != v.expected_result {
+			t.Error("Expected", v.expected_result, "for", v.profile, v.include, v.exclude, "got", result)
+		}
+	}
+}
+
+func TestParseFreeswitchProfileAdvertiseAddress(t *testing.T) {
+	// As per "sofia xmlstatus profile external" on FreeSWITCH 1.6, trimmed.
+	body := []byte(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<profile>
+<profile-info>
+<name>external</name>
+<domain-name>N/A</domain-name>
+<rtp-ip>10.0.0.5</rtp-ip>
+<ext-rtp-ip>203.0.113.5</ext-rtp-ip>
+<sip-ip>10.0.0.5</sip-ip>
+<ext-sip-ip>203.0.113.5</ext-sip-ip>
+<url>sip:mod_sofia@10.0.0.5:5080</url>
+<sip-port>5080</sip-port>
+</profile-info>
+</profile>
+`)
+	for advertise_from, expected_result := range map[string]AdvertiseAddress{
+		"sip-ip":     {"10.0.0.5", 5080},
+		"ext-sip-ip": {"203.0.113.5", 5080},
+	} {
+		result, err := parseFreeswitchProfileAdvertiseAddress("external", body, advertise_from)
+		if err != nil || result != expected_result {
+			t.Error("Expected", expected_result, "and nil error for", advertise_from, "got", result, err)
+		}
+	}
+	// No ext-sip-ip set on the profile.
+	body = []byte("<profile><profile-info><sip-ip>10.0.0.5</sip-ip><ext-sip-ip></ext-sip-ip><sip-port>5060</sip-port></profile-info></profile>")
+	result, err := parseFreeswitchProfileAdvertiseAddress("internal", body, "ext-sip-ip")
+	if expected_result := (AdvertiseAddress{"10.0.0.5", 5060}); err != nil || result != expected_result {
+		t.Error("Expected", expected_result, "and nil error, got", result, err)
+	}
+
+	_, err = parseFreeswitchProfileAdvertiseAddress("internal", []byte("<profile><profile-info><sip-ip>10.0.0.5</sip-ip></profile-info></profile>"), "sip-ip")
+	if err == nil || err.Error() != "Sofia Profile 'internal' has an invalid sip-port ''." {
+		t.Error("Expected an invalid sip-port error, got", err)
+	}
+	_, err = parseFreeswitchProfileAdvertiseAddress("missing", []byte("Invalid Profile!\n"), "sip-ip")
+	if _, ok := err.(*invalidSofiaProfileError); ok == false {
+		t.Error("Expected an invalidSofiaProfileError, got", err)
+	}
+}
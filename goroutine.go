@@ -1,27 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/0x19/goesl"
+	"golang.org/x/net/context"
 )
 
-// All 3 of the below functions are run within goroutines (in parallel) from main()
+// All 4 of the below functions are run within goroutines (in parallel) from main()
+// Each returns once ctx is cancelled (on shutdown).
 
 // Just act as a /dev/null event channel receiver.
-func nullEventChannelReceiver(wg *sync.WaitGroup, event_channel <-chan struct{}) {
+func nullEventChannelReceiver(ctx context.Context, wg *sync.WaitGroup, event_channel <-chan struct{}) {
 	defer wg.Done()
 	for {
-		<-event_channel
+		select {
+		case <-event_channel:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Notifies event_channel that "something happened", unless we are shutting down (the receiver may be gone).
+func notifyEventChannel(ctx context.Context, event_channel chan<- struct{}) {
+	select {
+	case event_channel <- struct{}{}:
+	case <-ctx.Done():
+	}
+}
+
+// Requests an immediate full sync from syncRegistrations(), without blocking if one is already pending.
+func triggerSync(sync_trigger chan<- struct{}) {
+	select {
+	case sync_trigger <- struct{}{}:
+	default:
 	}
 }
 
 // test_mode_max_events of 0 == run indefinitely.
 // The initial subscription counts as an event, make sure you account for it when using test_mode_max_events
-func watchForRegistrationEvents(esl_client *goesl.Client, advertise_ip string, advertise_port int, kv_backend KvBackend, wg *sync.WaitGroup, test_mode_max_events int, event_channel chan<- struct{}) {
+// The caller closes esl_conn on shutdown to unblock any pending read.
+func watchForRegistrationEvents(ctx context.Context, esl_conn *EslConnection, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig, wg *sync.WaitGroup, test_mode_max_events int, event_channel chan<- struct{}, sync_trigger chan<- struct{}) {
 	defer wg.Done()
 	log.Printf("watchForRegistrationEvents(): Starting.\n")
 	event_counter := 0
@@ -29,12 +54,23 @@ func watchForRegistrationEvents(esl_client *goesl.Client, advertise_ip string, a
 		log.Printf("watchForRegistrationEvents(): Test Mode enabled, max events - %d.\n", test_mode_max_events)
 	}
 	// The events for subscribing (and the reply) don't count towards the test_mode_max_events count.
-	err := subscribeToFreeswitchRegEvents(esl_client)
-	if err != nil {
-		// TODO: log to an error channel?
-		log.Fatal(err)
+	for {
+		err := subscribeToFreeswitchRegEvents(esl_conn.Client)
+		if err == nil {
+			healthState.SetSubscribed(true)
+			break
+		}
+		if ctx.Err() != nil {
+			log.Printf("watchForRegistrationEvents(): Shutting down.\n")
+			return
+		}
+		log.Printf("WARNING: watchForRegistrationEvents(): Subscription failed: %s\n", err.Error())
+		if esl_conn.Reconnect(ctx) != nil {
+			log.Printf("watchForRegistrationEvents(): Shutting down.\n")
+			return
+		}
 	}
-	event_channel <- struct{}{}
+	notifyEventChannel(ctx, event_channel)
 	event_counter++
 	if test_mode_max_events > 0 && event_counter >= test_mode_max_events {
 		log.Printf("watchForRegistrationEvents(): Test Mode Max Events of %d reached (or exceeded) by subscription event.\n", event_counter)
@@ -43,48 +79,41 @@ func watchForRegistrationEvents(esl_client *goesl.Client, advertise_ip string, a
 	log.Printf("watchForRegistrationEvents(): Started.\n")
 	// For anything that returns a WARNING here, full state syncs should act as an insurance policy.
 	for {
-		msg, err := esl_client.ReadMessage()
+		msg, err := esl_conn.Client.ReadMessage()
 		if err != nil {
-			// If it contains EOF, we really dont care...
-			if !strings.Contains(err.Error(), "EOF") && err.Error() != "unexpected end of JSON input" {
-				log.Printf("(Ignored) Error while reading FreeSWITCH message: %s", err)
-				continue
+			healthState.SetSubscribed(false)
+			if ctx.Err() != nil {
+				break
 			}
+			// goesl stops reading from the connection after any error (EOF or otherwise), so reconnect.
 			log.Printf("WARNING: Error reading FreeSWITCH message: %s", err.Error())
+			for {
+				if esl_conn.Reconnect(ctx) != nil {
+					log.Printf("watchForRegistrationEvents(): Shutting down.\n")
+					return
+				}
+				err = subscribeToFreeswitchRegEvents(esl_conn.Client)
+				if err == nil {
+					healthState.SetSubscribed(true)
+					break
+				}
+				log.Printf("WARNING: watchForRegistrationEvents(): Subscription failed: %s\n", err.Error())
+			}
+			// Any events while we were disconnected have been missed.
+			log.Printf("watchForRegistrationEvents(): Resubscribed, requesting a full sync.\n")
+			triggerSync(sync_trigger)
 			continue
 		}
-		log.Printf("watchForRegistrationEvents() : New Message from FreeSWITCH - %+v\n", msg)
-		reg_event, reg_event_user, err := parseFreeswitchRegEvent(msg)
-		if err != nil {
-			// TODO: log to an error channel?
-			log.Printf("WARNING: %s", err.Error())
-		}
-		log.Printf("watchForRegistrationEvents() : Event - %s, User - %s\n", reg_event, reg_event_user)
-		if reg_event == "register" {
-			kv_backend_value_string, err := getKvBackendValueJsonString(KvBackendValue{
-				Host: advertise_ip,
-				Port: advertise_port,
-			})
-			if err != nil {
-				// TODO: log to an error channel?
-				log.Printf("WARNING: %s", err.Error())
-			}
-			// TODO: move the TTL out to somewhere more reusable
-			err = kv_backend.Write(reg_event_user, kv_backend_value_string, 300)
-			if err != nil {
-				// TODO: log to an error channel?
-				log.Printf("WARNING: %s", err.Error())
-			}
-		} else if reg_event == "unregister" || reg_event == "expire" {
-			err = kv_backend.Delete(reg_event_user)
-			if err != nil {
-				// TODO: log to an error channel?
-				log.Printf("WARNING: %s", err.Error())
-			}
+		healthState.TouchEventLoop()
+		eslRecorder.Record("event", "", msg)
+		// Only used for liveness, they don't count towards test_mode_max_events either.
+		if msg.Headers["Event-Name"] == "HEARTBEAT" {
+			continue
 		}
+		handleFreeswitchRegEvent(msg, advertise_ip, advertise_port, kv_backend, runtime_config, sync_trigger)
 		// Increment the event counter, send a message on the event channel that "something happened"
 		event_counter++
-		event_channel <- struct{}{}
+		notifyEventChannel(ctx, event_channel)
 		if test_mode_max_events > 0 && event_counter >= test_mode_max_events {
 			log.Printf("watchForRegistrationEvents(): Test Mode Max Events of %d reached (or exceeded).\n", event_counter)
 			break
@@ -93,61 +122,403 @@ func watchForRegistrationEvents(esl_client *goesl.Client, advertise_ip string, a
 	log.Printf("watchForRegistrationEvents(): Finished.\n")
 }
 
-func syncRegistrations(esl_client *goesl.Client, sofia_profiles []string, advertise_ip string, advertise_port int, sync_interval uint32, kv_backend KvBackend, wg *sync.WaitGroup, once bool) {
-	defer wg.Done()
-	for {
-		log.Printf("syncRegistrations(): Starting.\n")
+// Applies a registration event to this instance's entry in the K/V backend, as received by watchForRegistrationEvents()
+// (or replayed). Events for Sofia profiles that aren't synced are ignored, a full sync is requested (if sync_trigger
+// isn't nil) for one that --fsprofiles auto hasn't discovered yet, or whose --fsadvertisefrom address isn't known yet.
+func handleFreeswitchRegEvent(msg *goesl.Message, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig, sync_trigger chan<- struct{}) {
+	logDebugf("handleFreeswitchRegEvent() : New Message from FreeSWITCH - %+v\n", msg)
+	reg_event, reg_event_user, reg_event_profile, err := parseFreeswitchRegEvent(msg)
+	if err != nil {
+		// TODO: log to an error channel?
+		log.Printf("WARNING: %s", err.Error())
+		metricEslEventParseFailures.Inc()
+	} else {
+		metricEslEventsReceived.WithLabelValues(reg_event).Inc()
+	}
+	log.Printf("handleFreeswitchRegEvent() : Event - %s, User - %s\n", reg_event, reg_event_user)
+	// Otherwise the next sync would only remove it again. Older FreeSWITCH versions may not send profile-name.
+	if len(reg_event_profile) > 0 && stringInSlice(reg_event_profile, runtime_config.SofiaProfiles()) == false {
+		metricEslEventsIgnored.WithLabelValues(reg_event_profile).Inc()
+		if runtime_config.IsUndiscoveredSofiaProfile(reg_event_profile) == true {
+			log.Printf("handleFreeswitchRegEvent() : Sofia Profile '%s' has not been discovered yet, requesting a full sync.\n", reg_event_profile)
+			if sync_trigger != nil {
+				triggerSync(sync_trigger)
+			}
+		} else {
+			log.Printf("handleFreeswitchRegEvent() : Ignoring event for unwatched Sofia Profile '%s'.\n", reg_event_profile)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	// With --fsadvertisefrom, the address of the profile the event is for, which is only known once synced.
+	// Without profile-name, that's only known if a single profile is synced. A sync wouldn't help otherwise.
+	if len(reg_event_profile) == 0 && len(runtime_config.AdvertiseFrom()) > 0 {
+		sofia_profiles := runtime_config.SofiaProfiles()
+		if len(sofia_profiles) != 1 {
+			log.Printf("handleFreeswitchRegEvent() : No profile-name to derive the address from (of %d Sofia Profiles), leaving '%s' to the next full sync.\n", len(sofia_profiles), reg_event_user)
+			return
+		}
+		reg_event_profile = sofia_profiles[0]
+	}
+	address, ok := runtime_config.ProfileAdvertiseAddress(reg_event_profile, advertise_ip, advertise_port)
+	if ok == false {
+		log.Printf("handleFreeswitchRegEvent() : No address has been derived for Sofia Profile '%s' yet, requesting a full sync.\n", reg_event_profile)
+		if sync_trigger != nil {
+			triggerSync(sync_trigger)
+		}
+		return
+	}
+	// Only ever touch this instance's entry, the user may also be registered elsewhere.
+	reg_event_key := getRegistrationKey(reg_event_user, address.Ip, address.Port)
+	if reg_event == "register" {
+		kv_backend_value := getKvBackendValueFromFreeswitchRegEvent(msg, address.Ip, address.Port, time.Now())
+		// Matches what the next sync writes, when the profile was worked out above.
+		kv_backend_value.Profile = reg_event_profile
+		kv_backend_value_string, err := getKvBackendValueJsonString(kv_backend_value)
+		if err != nil {
+			// TODO: log to an error channel?
+			log.Printf("WARNING: %s", err.Error())
+		}
+		err = kv_backend.Write(reg_event_key, kv_backend_value_string, runtime_config.KvTtl())
+		if err != nil {
+			// TODO: log to an error channel?
+			log.Printf("WARNING: %s", err.Error())
+		}
+	} else if reg_event == "unregister" || reg_event == "expire" {
+		err = kv_backend.Delete(reg_event_key)
+		if err != nil {
+			// TODO: log to an error channel?
+			log.Printf("WARNING: %s", err.Error())
+		}
+	}
+}
 
-		raw_last_active_registrations, err := kv_backend.Read("", true)
+// Failed syncs are retried, backing off exponentially between these bounds. A var so tests can shorten it.
+var syncRetryMinBackoff = time.Second
+
+const syncRetryMaxBackoff = time.Minute
+
+// Consecutive configuration errors (eg. an unknown Sofia profile) tolerated before giving up, in case the
+// configuration is being reloaded. In once off mode, consecutive errors of any kind.
+const syncMaxConfigErrors = 5
+
+// Why a single sync failed, reason is one of freeswitch, kv_backend, config or internal (used as the metric label).
+type syncError struct {
+	reason string
+	err    error
+}
+
+func (e *syncError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err)
+}
+
+// Performs a single full sync of this instance's registrations, from FreeSWITCH to the K/V backend.
+func syncRegistrationsOnce(ctx context.Context, esl_conn *EslConnection, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig) error {
+	plan, err := getSyncPlan(esl_conn, advertise_ip, advertise_port, kv_backend, runtime_config)
+	if err != nil {
+		return err
+	}
+	if runtime_config.DryRun() == true {
+		logSyncPlan(plan)
+		return nil
+	}
+	return applySyncPlan(ctx, plan, kv_backend, runtime_config)
+}
+
+// Compares FreeSWITCH with the K/V backend, without changing anything. Used by every full sync, and the diff command.
+func getSyncPlan(esl_conn *EslConnection, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig) (*SyncPlan, error) {
+	raw_last_active_registrations, err := readSyncLastRegistrations(kv_backend)
+	if err != nil {
+		return nil, err
+	}
+	sofia_profiles, err := getSyncSofiaProfiles(esl_conn.Client, runtime_config)
+	if err != nil {
+		return nil, err
+	}
+	err = getSyncAdvertiseAddresses(esl_conn.Client, sofia_profiles, runtime_config)
+	if err != nil {
+		return nil, err
+	}
+	raw_current_active_registrations, err := getFreeswitchRegistrations(esl_conn.Client, sofia_profiles)
+	if err != nil {
+		if _, ok := err.(*invalidSofiaProfileError); ok == true {
+			return nil, &syncError{reason: "config", err: err}
+		}
+		return nil, &syncError{reason: "freeswitch", err: fmt.Errorf("Error fetching FreeSWITCH registrations: %s", err)}
+	}
+	return newFreeswitchSyncPlan(raw_last_active_registrations, raw_current_active_registrations, advertise_ip, advertise_port, runtime_config)
+}
+
+// The Sofia profiles to sync. With --fsprofiles auto, the running profiles are fetched from FreeSWITCH first, so any
+// started or stopped since the last sync are picked up.
+func getSyncSofiaProfiles(esl_client *goesl.Client, runtime_config *RuntimeConfig) ([]string, error) {
+	if runtime_config.SofiaProfilesAuto() == false {
+		return runtime_config.SofiaProfiles(), nil
+	}
+	running_profiles, err := getFreeswitchSofiaProfiles(esl_client)
+	if err != nil {
+		return nil, &syncError{reason: "freeswitch", err: fmt.Errorf("Error fetching FreeSWITCH Sofia Profiles: %s", err)}
+	}
+	changed := runtime_config.SetDiscoveredSofiaProfiles(running_profiles)
+	sofia_profiles := runtime_config.SofiaProfiles()
+	if changed == true {
+		log.Printf("getSyncSofiaProfiles(): Running Sofia Profiles: %s, watching: %s.\n", strings.Join(running_profiles, ", "), strings.Join(sofia_profiles, ", "))
+	}
+	// Eg. FreeSWITCH is still starting, so retry rather than removing every registration of this instance.
+	if len(running_profiles) == 0 {
+		return nil, &syncError{reason: "freeswitch", err: fmt.Errorf("No Sofia Profiles are running.")}
+	}
+	// Most likely the include/exclude patterns.
+	if len(sofia_profiles) == 0 {
+		return nil, &syncError{reason: "config", err: fmt.Errorf("No running Sofia Profiles (of: %s) match --fsprofilesinclude/--fsprofilesexclude.", strings.Join(running_profiles, ", "))}
+	}
+	return sofia_profiles, nil
+}
+
+// With --fsadvertisefrom, derives the address of each Sofia profile from FreeSWITCH, so a changed address is
+// picked up by the sync. Does nothing otherwise.
+func getSyncAdvertiseAddresses(esl_client *goesl.Client, sofia_profiles []string, runtime_config *RuntimeConfig) error {
+	advertise_from := runtime_config.AdvertiseFrom()
+	if len(advertise_from) == 0 {
+		return nil
+	}
+	for _, sofia_profile := range sofia_profiles {
+		address, err := getFreeswitchProfileAdvertiseAddress(esl_client, sofia_profile, advertise_from)
 		if err != nil {
-			if err.Error() == "KEY_NOT_FOUND" {
-				log.Printf("No active registrations found within K/V backend. Clean slate.\n")
-			} else {
-				log.Fatalf("Error reading from K/V Backend: %s\n", err)
+			if _, ok := err.(*invalidSofiaProfileError); ok == true {
+				return &syncError{reason: "config", err: err}
 			}
+			return &syncError{reason: "freeswitch", err: fmt.Errorf("Error fetching the address of Sofia Profile '%s': %s", sofia_profile, err)}
+		}
+		if runtime_config.SetProfileAdvertiseAddress(sofia_profile, address) == true {
+			log.Printf("getSyncAdvertiseAddresses(): Advertising Sofia Profile '%s' registrations as %s:%d.\n", sofia_profile, address.Ip, address.Port)
 		}
-		log.Printf("raw_last_active_registrations: %+v\n", raw_last_active_registrations)
+	}
+	return nil
+}
 
-		raw_current_active_registrations, err := getFreeswitchRegistrations(esl_client, sofia_profiles)
-		if err != nil {
-			// TODO: return an error channel or something?
-			log.Fatal(err)
+// Sets the address of each registration (when derived from its Sofia profile), before generateCurrentRegistrationsType().
+func setFreeswitchRegistrationAddresses(registrations *[]FsRegistration, runtime_config *RuntimeConfig) error {
+	if len(runtime_config.AdvertiseFrom()) == 0 {
+		return nil
+	}
+	for i, v := range *registrations {
+		address, ok := runtime_config.ProfileAdvertiseAddress(v.Profile, "", 0)
+		if ok == false {
+			return fmt.Errorf("No address has been derived for Sofia Profile '%s'.", v.Profile)
 		}
-		log.Printf("raw_current_active_registrations: %+v\n", raw_current_active_registrations)
+		(*registrations)[i].AdvertiseIp = address.Ip
+		(*registrations)[i].AdvertisePort = address.Port
+	}
+	return nil
+}
 
-		last_active_registrations_typed, err := generateLastRegistrationsType(raw_last_active_registrations)
-		if err != nil {
-			log.Fatal(err)
+// Everything in the K/V backend (all instances), an empty result if there's nothing yet.
+func readSyncLastRegistrations(kv_backend KvBackend) (*map[string]string, error) {
+	raw_last_active_registrations, err := kv_backend.Read("", true)
+	if err != nil {
+		if err.Error() != "KEY_NOT_FOUND" {
+			return nil, &syncError{reason: "kv_backend", err: fmt.Errorf("Error reading from K/V Backend: %s", err)}
 		}
-		// As we receive all last active registrations from the K/V backend, we need to filter by this instance only before reconciling.
-		last_active_registrations := generateRegistrationListForThisInstance(last_active_registrations_typed, advertise_ip, advertise_port)
-		log.Printf("last_active_registrations: %+v\n", last_active_registrations)
-		current_active_registrations := generateCurrentRegistrationsType(raw_current_active_registrations, advertise_ip, advertise_port)
-		log.Printf("current_active_registrations: %+v\n", current_active_registrations)
+		log.Printf("No active registrations found within K/V backend. Clean slate.\n")
+		raw_last_active_registrations = &map[string]string{}
+	}
+	logDebugf("raw_last_active_registrations: %+v\n", raw_last_active_registrations)
+	return raw_last_active_registrations, nil
+}
+
+// Reconciles the registrations read from the K/V backend with those fetched from FreeSWITCH.
+func newFreeswitchSyncPlan(raw_last_active_registrations *map[string]string, raw_current_active_registrations *[]FsRegistration, advertise_ip string, advertise_port int, runtime_config *RuntimeConfig) (*SyncPlan, error) {
+	logDebugf("raw_current_active_registrations: %+v\n", raw_current_active_registrations)
+	last_active_registrations_typed, err := generateLastRegistrationsType(raw_last_active_registrations)
+	if err != nil {
+		return nil, &syncError{reason: "internal", err: err}
+	}
+	// As we receive all last active registrations from the K/V backend, we need to filter by this instance only before reconciling.
+	last_active_registrations := generateRegistrationListForThisInstance(last_active_registrations_typed, runtime_config.AdvertisedAddresses(advertise_ip, advertise_port))
+	logDebugf("last_active_registrations: %+v\n", last_active_registrations)
+	err = setFreeswitchRegistrationAddresses(raw_current_active_registrations, runtime_config)
+	if err != nil {
+		return nil, &syncError{reason: "internal", err: err}
+	}
+	current_active_registrations := generateCurrentRegistrationsType(raw_current_active_registrations, advertise_ip, advertise_port, time.Now())
+	logDebugf("current_active_registrations: %+v\n", current_active_registrations)
+	metricRegistrationsOwned.Set(float64(len(*current_active_registrations)))
+
+	plan, err := newSyncPlan(last_active_registrations, current_active_registrations)
+	if err != nil {
+		return nil, &syncError{reason: "internal", err: err}
+	}
+	return plan, nil
+}
 
-		add_registrations, remove_registrations, err := reconcileRegistrations(last_active_registrations, current_active_registrations)
+// For --dry-run, in place of applying the plan.
+func logSyncPlan(plan *SyncPlan) {
+	var buf bytes.Buffer
+	plan.WriteText(&buf)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		log.Printf("DRY RUN: syncRegistrations(): %s\n", line)
+	}
+}
+
+func applySyncPlan(ctx context.Context, plan *SyncPlan, kv_backend KvBackend, runtime_config *RuntimeConfig) error {
+	log.Printf("syncRegistrations(): %d to add, %d to update, %d to remove.\n", len(plan.Add), len(plan.Update), len(plan.Remove))
+	logDebugf("plan: %+v\n", plan)
+	metricSyncRegistrations.WithLabelValues("add").Add(float64(len(plan.Add)))
+	metricSyncRegistrations.WithLabelValues("update").Add(float64(len(plan.Update)))
+	metricSyncRegistrations.WithLabelValues("remove").Add(float64(len(plan.Remove)))
+
+	// Removes first, a leftover user@domain key (from before per-instance keys) would otherwise block
+	// writing user@domain/ip:port on backends with real directories (etcd v2).
+	var operations []syncOperation
+	for _, v_remove := range plan.Remove {
+		operations = append(operations, syncOperation{Delete: true, Key: v_remove.Key})
+	}
+	// Updates are just rewritten, with the current value.
+	for _, v_add := range append(plan.Add, plan.Update...) {
+		add_json_string, err := getKvBackendValueJsonString(*v_add.New)
 		if err != nil {
-			// TODO: return an error channel or something?
-			log.Fatal(err)
+			return &syncError{reason: "internal", err: err}
 		}
-		log.Printf("add_registrations: %+v\n", add_registrations)
-		log.Printf("remove_registrations: %+v\n", remove_registrations)
+		operations = append(operations, syncOperation{Key: v_add.Key, Value: add_json_string})
+	}
+	failed_operations := applySyncOperations(ctx, kv_backend, operations, runtime_config.KvTtl())
+	if len(failed_operations) > 0 {
+		// Fails the sync, so it is retried (with backoff) rather than waiting for the next sync interval.
+		return &syncError{reason: "kv_backend", err: fmt.Errorf("%d of %d K/V operations failed (%s)", len(failed_operations), len(operations), getSyncOperationsSummary(failed_operations))}
+	}
+	return nil
+}
 
-		add_json_string, err := getKvBackendValueJsonString(KvBackendValue{
-			Host: advertise_ip,
-			Port: advertise_port,
-		})
-		if err != nil {
-			// TODO: return an error channel or something?
-			log.Fatal(err)
+// Attempts at each K/V operation within a single sync, before leaving it to a re-sync.
+const syncMaxOperationAttempts = 3
+
+// A write (or delete) of a single key in the K/V backend, made by a sync.
+type syncOperation struct {
+	Delete bool
+	Key    string
+	// Not set for deletes.
+	Value string
+	// Error from the last attempt.
+	err error
+}
+
+func (o *syncOperation) Name() string {
+	if o.Delete == true {
+		return "delete"
+	}
+	return "write"
+}
+
+// Applies operations in order, then retries any that failed (in the same order) after a short backoff,
+// up to syncMaxOperationAttempts in total. Returns the operations that still failed.
+func applySyncOperations(ctx context.Context, kv_backend KvBackend, operations []syncOperation, kv_ttl int) []syncOperation {
+	queue := operations
+	backoff := syncRetryMinBackoff
+	for attempt := 1; ; attempt++ {
+		var failed []syncOperation
+		for _, v := range queue {
+			if v.Delete == true {
+				v.err = kv_backend.Delete(v.Key)
+			} else {
+				v.err = kv_backend.Write(v.Key, v.Value, kv_ttl)
+			}
+			if v.err != nil {
+				log.Printf("WARNING: applySyncOperations(): Error on %s of '%s' (attempt %d of %d): %s\n", v.Name(), v.Key, attempt, syncMaxOperationAttempts, v.err)
+				failed = append(failed, v)
+			}
+		}
+		if len(failed) == 0 || attempt >= syncMaxOperationAttempts {
+			return failed
 		}
-		for _, v_add := range *add_registrations {
-			// TODO: move the TTL out to somewhere more reusable
-			err = kv_backend.Write(v_add, add_json_string, 300)
+		queue = failed
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return failed
 		}
-		for _, v_remove := range *remove_registrations {
-			err = kv_backend.Delete(v_remove)
+		backoff *= 2
+	}
+}
+
+// eg. "2 write, 1 delete"
+func getSyncOperationsSummary(operations []syncOperation) string {
+	counts := make(map[string]int)
+	for _, v := range operations {
+		counts[v.Name()]++
+	}
+	var result []string
+	for _, name := range []string{"write", "delete"} {
+		if counts[name] > 0 {
+			result = append(result, fmt.Sprintf("%d %s", counts[name], name))
+		}
+	}
+	return strings.Join(result, ", ")
+}
+
+// A sync is performed every sync interval, or immediately when requested via sync_trigger.
+// The Sofia profiles, sync interval and TTL are read from runtime_config on each pass, as they can be reloaded.
+// Failed syncs are retried with backoff, only an error that persists and retrying won't fix (see syncMaxConfigErrors)
+// is sent on fatal_error_channel (buffered), after which this returns.
+// The caller closes esl_conn on shutdown to unblock any pending read.
+func syncRegistrations(ctx context.Context, esl_conn *EslConnection, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig, wg *sync.WaitGroup, once bool, sync_trigger <-chan struct{}, fatal_error_channel chan<- error) {
+	defer wg.Done()
+	backoff := syncRetryMinBackoff
+	failure_count := 0
+	for {
+		log.Printf("syncRegistrations(): Starting.\n")
+		sync_start := time.Now()
+		err := syncRegistrationsOnce(ctx, esl_conn, advertise_ip, advertise_port, kv_backend, runtime_config)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("syncRegistrations(): Shutting down.\n")
+				return
+			}
+			sync_err, ok := err.(*syncError)
+			if ok == false {
+				sync_err = &syncError{reason: "internal", err: err}
+				err = sync_err
+			}
+			metricSyncFailures.WithLabelValues(sync_err.reason).Inc()
+			if sync_err.reason == "config" || once == true {
+				failure_count++
+			} else {
+				failure_count = 0
+			}
+			if failure_count >= syncMaxConfigErrors {
+				log.Printf("syncRegistrations(): Giving up after %d consecutive failures.\n", failure_count)
+				fatal_error_channel <- err
+				return
+			}
+			log.Printf("WARNING: syncRegistrations(): Sync failed (%s), retrying in %s.\n", err, backoff)
+			// The connection may have dropped since the last sync (eg. FreeSWITCH restarted), reconnect before retrying.
+			// Not in once off mode (the sync command), where Reconnect() would wait indefinitely for FreeSWITCH to come back.
+			if sync_err.reason == "freeswitch" && once == false {
+				if esl_conn.Reconnect(ctx) != nil {
+					log.Printf("syncRegistrations(): Shutting down.\n")
+					return
+				}
+			}
+			select {
+			case <-time.After(backoff):
+			case <-sync_trigger:
+				log.Printf("syncRegistrations(): Sync requested.\n")
+			case <-ctx.Done():
+				log.Printf("syncRegistrations(): Shutting down.\n")
+				return
+			}
+			backoff *= 2
+			if backoff > syncRetryMaxBackoff {
+				backoff = syncRetryMaxBackoff
+			}
+			continue
 		}
+		backoff = syncRetryMinBackoff
+		failure_count = 0
+		metricSyncDuration.Observe(time.Since(sync_start).Seconds())
+		healthState.SetSynced()
 
 		// Used for test suite, to only do a once-off sync.
 		if once == true {
@@ -156,7 +527,79 @@ func syncRegistrations(esl_client *goesl.Client, sofia_profiles []string, advert
 		}
 
 		// Sleep between syncs, this is run in a goroutine.
+		sync_interval := runtime_config.SyncInterval()
 		log.Printf("syncRegistrations(): Finished, sleeping for %d seconds.\n", sync_interval)
-		time.Sleep(time.Duration(sync_interval) * time.Second)
+		select {
+		case <-time.After(time.Duration(sync_interval) * time.Second):
+		case <-sync_trigger:
+			log.Printf("syncRegistrations(): Sync requested.\n")
+		case <-ctx.Done():
+			log.Printf("syncRegistrations(): Shutting down.\n")
+			return
+		}
+	}
+}
+
+// Keeps the TTL of this instance's registrations in the K/V backend from expiring while we are running.
+// Registrations are refreshed (not rewritten), so anything removed in the meantime stays removed.
+// If a refresh fails or fewer registrations are found than last time (eg. some expired during a K/V backend
+// outage), a full sync is requested via sync_trigger to rewrite them.
+func refreshRegistrations(ctx context.Context, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig, wg *sync.WaitGroup, once bool, sync_trigger chan<- struct{}) {
+	defer wg.Done()
+	last_count := 0
+	for {
+		// The TTL can be reloaded, so work this out each time.
+		kv_ttl := runtime_config.KvTtl()
+		// Refresh well before expiry, so a slow or failed refresh can be retried.
+		refresh_interval := time.Duration(kv_ttl) * time.Second / 3
+		if refresh_interval < time.Second {
+			refresh_interval = time.Second
+		}
+		// The initial sync writes everything with a fresh TTL, so sleep first.
+		if once == false {
+			select {
+			case <-time.After(refresh_interval):
+			case <-ctx.Done():
+				log.Printf("refreshRegistrations(): Shutting down.\n")
+				return
+			}
+		}
+		log.Printf("refreshRegistrations(): Starting.\n")
+
+		raw_last_active_registrations, err := kv_backend.Read("", true)
+		if err != nil && err.Error() != "KEY_NOT_FOUND" {
+			log.Printf("WARNING: refreshRegistrations(): Error reading from K/V Backend: %s\n", err)
+		} else {
+			last_active_registrations_typed, err := generateLastRegistrationsType(raw_last_active_registrations)
+			if err != nil {
+				log.Printf("WARNING: refreshRegistrations(): %s\n", err)
+			} else {
+				last_active_registrations := generateRegistrationListForThisInstance(last_active_registrations_typed, runtime_config.AdvertisedAddresses(advertise_ip, advertise_port))
+				refresh_count := 0
+				for k, _ := range *last_active_registrations {
+					err = kv_backend.Refresh(k, kv_ttl)
+					if err != nil {
+						log.Printf("WARNING: refreshRegistrations(): Error refreshing '%s': %s\n", k, err)
+						continue
+					}
+					refresh_count++
+				}
+				log.Printf("refreshRegistrations(): Refreshed %d of %d registrations.\n", refresh_count, len(*last_active_registrations))
+				metricRegistrationsOwned.Set(float64(len(*last_active_registrations)))
+				if refresh_count < len(*last_active_registrations) || len(*last_active_registrations) < last_count {
+					log.Printf("refreshRegistrations(): Registrations are missing (%d refreshed, %d last time), requesting a full sync.\n", refresh_count, last_count)
+					if sync_trigger != nil {
+						triggerSync(sync_trigger)
+					}
+				}
+				last_count = refresh_count
+			}
+		}
+
+		// Used for test suite, to only do a once-off refresh.
+		if once == true {
+			log.Printf("refreshRegistrations(): Once off mode enabled, finished.\n")
+			return
+		}
 	}
 }
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"errors"
 	//"log"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/0x19/goesl"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
 )
 
 func getTestKvBackend(t *testing.T) KvBackend {
+	skipWithoutDocker(t)
 	if _, ok := dockerContainerPorts["etcd_1-2379/tcp"]; ok == false {
 		t.Fatal("Docker Container port for etcd not found in dockerContainerPorts, did the container start?")
 	}
@@ -24,28 +33,80 @@ func getTestKvBackend(t *testing.T) KvBackend {
 	return test_kv_backend
 }
 
+// A sync interval and TTL of 300 seconds.
+func getTestRuntimeConfig(sofia_profiles []string) *RuntimeConfig {
+	return getTestRuntimeConfigWithArgs(&ArgConfig{FreeswitchSofiaProfiles: sofia_profiles})
+}
+
+// As getTestRuntimeConfig(), with any other settings (eg. --fsprofiles auto, --fsadvertisefrom or --dry-run) from arg_config.
+func getTestRuntimeConfigWithArgs(arg_config *ArgConfig) *RuntimeConfig {
+	arg_config.SyncInterval = 300
+	arg_config.KvTtl = 300
+	arg_config.LogLevel = "info"
+	return newRuntimeConfig(arg_config)
+}
+
+// Registration details from FreeSWITCH vary (timestamps, NAT, etc), only compare the stable fields.
+// The expected Contact only needs to be a prefix of the stored one, as FreeSWITCH may append parameters.
+func checkTestRegistrations(t *testing.T, input *map[string]string, expected_result Registrations) {
+	result, err := generateLastRegistrationsType(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*result) != len(expected_result) {
+		t.Fatal("Expected", expected_result, "got", *result)
+	}
+	for k, expected_v := range expected_result {
+		v, ok := (*result)[k]
+		if ok == false {
+			t.Errorf("Expected '%s' to exist, got %+v", k, *result)
+			continue
+		}
+		if v.Host != expected_v.Host || v.Port != expected_v.Port || v.Profile != expected_v.Profile || strings.HasPrefix(v.Contact, expected_v.Contact) == false {
+			t.Errorf("Expected '%s' to match %+v, got %+v", k, expected_v, v)
+		}
+		if v.RecordedAt == 0 {
+			t.Errorf("Expected '%s' to have a non-zero RecordedAt, got %+v", k, v)
+		}
+	}
+}
+
 func TestWatchForRegistrationEvents(t *testing.T) {
-	test_esl_client := getTestEslClient(t)
+	test_esl_conn := getTestEslConnection(t)
 	test_kv_backend := getTestKvBackend(t)
 	test_advertise_ip := "192.168.99.100"
 	test_advertise_port := 5062
 	test_sip_user := "1002"
 	test_sip_pass := "1234"
 	test_sip_contact_port := uint(49203)
-	expected_result1 := map[string]string{
-		"1002@sip.testserver.tld": "{\"host\":\"192.168.99.100\",\"port\":5062}",
+	expected_result1 := Registrations{
+		"1002@sip.testserver.tld/192.168.99.100:5062": KvBackendValue{
+			Host:    "192.168.99.100",
+			Port:    5062,
+			Contact: "sip:1002@127.0.0.1:49203",
+			Profile: "internal",
+		},
 	}
-	// result 2 is an empty map
+	// The same user registered on another instance, which should be left alone.
+	other_instance_key := getRegistrationKey("1002@sip.testserver.tld", "192.168.99.101", 5062)
+	other_instance_value := "{\"host\":\"192.168.99.101\",\"port\":5062,\"recorded_at\":1470367071}"
+	err := test_kv_backend.Write(other_instance_key, other_instance_value, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer test_kv_backend.Delete(other_instance_key)
+	expected_result1[other_instance_key] = KvBackendValue{Host: "192.168.99.101", Port: 5062}
+	expected_result2 := map[string]string{other_instance_key: other_instance_value}
 
 	var test_wg sync.WaitGroup
-	go test_esl_client.Handle()
 	// This channel is triggered on each event execution.
 	event_channel := make(chan struct{})
 	defer close(event_channel)
+	sync_trigger := make(chan struct{}, 1)
 
 	// Start our watcher which will update the K/V store on changes.
 	test_wg.Add(1)
-	go watchForRegistrationEvents(test_esl_client, test_advertise_ip, test_advertise_port, test_kv_backend, &test_wg, 3, event_channel)
+	go watchForRegistrationEvents(context.Background(), test_esl_conn, test_advertise_ip, test_advertise_port, test_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, 3, event_channel, sync_trigger)
 
 	// Make sure that we are watching for events before proceeding.
 	//log.Printf("Wait for event: 1\n")
@@ -67,9 +128,7 @@ func TestWatchForRegistrationEvents(t *testing.T) {
 	}
 	//log.Printf("TestWatchForRegistrationEvents() Read Error: %+v\n", err)
 	//log.Printf("TestWatchForRegistrationEvents() Read Result 1: %+v\n", result1)
-	if reflect.DeepEqual(*result1, expected_result1) != true {
-		t.Error("Expected", expected_result1, "got", result1)
-	}
+	checkTestRegistrations(t, result1, expected_result1)
 
 	// Cleanup the registration, before performing another sync.
 	simulateSipDeregister(dockerHost, uint(dockerContainerPorts["freeswitch_1-5060/udp"]), test_sip_user, test_sip_pass, test_sip_contact_port, t)
@@ -86,13 +145,13 @@ func TestWatchForRegistrationEvents(t *testing.T) {
 	}
 	//log.Printf("TestWatchForRegistrationEvents() Read Error 2: %+v\n", err)
 	//log.Printf("TestWatchForRegistrationEvents() Read Result 2: %+v\n", result2)
-	if len(*result2) > 0 {
-		t.Errorf("Expected a zero length result from K/V backend, got %d results: %+v\n", len(*result2), *result2)
+	if reflect.DeepEqual(*result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", *result2)
 	}
 }
 
 func TestSyncRegistrations(t *testing.T) {
-	test_esl_client := getTestEslClient(t)
+	test_esl_conn := getTestEslConnection(t)
 	test_kv_backend := getTestKvBackend(t)
 	checkSipPortIsAvailable(t)
 	test_sofia_profiles := []string{"internal"}
@@ -101,8 +160,13 @@ func TestSyncRegistrations(t *testing.T) {
 	test_sip_user := "1001"
 	test_sip_pass := "1234"
 	test_sip_contact_port := uint(49202)
-	expected_result1 := map[string]string{
-		"1001@sip.testserver.tld": "{\"host\":\"192.168.99.100\",\"port\":5061}",
+	expected_result1 := Registrations{
+		"1001@sip.testserver.tld/192.168.99.100:5061": KvBackendValue{
+			Host:    "192.168.99.100",
+			Port:    5061,
+			Contact: "sip:1001@127.0.0.1:49202",
+			Profile: "internal",
+		},
 	}
 	// result 2 is an empty map
 
@@ -110,27 +174,25 @@ func TestSyncRegistrations(t *testing.T) {
 	simulateSipRegister(dockerHost, uint(dockerContainerPorts["freeswitch_1-5060/udp"]), test_sip_user, test_sip_pass, test_sip_contact_port, t)
 
 	var test_wg sync.WaitGroup
-	go test_esl_client.Handle()
+	sync_trigger := make(chan struct{})
 
 	// First sync, should perform an add to the K/V backend.
 	test_wg.Add(1)
-	syncRegistrations(test_esl_client, test_sofia_profiles, test_advertise_ip, test_advertise_port, 300, test_kv_backend, &test_wg, true)
+	syncRegistrations(context.Background(), test_esl_conn, test_advertise_ip, test_advertise_port, test_kv_backend, getTestRuntimeConfig(test_sofia_profiles), &test_wg, true, sync_trigger, make(chan error, 1))
 	result1, err := test_kv_backend.Read("", true)
 	if err != nil {
 		t.Fatal(err)
 	}
 	//log.Printf("TestSyncRegistrations() Read Error: %+v\n", err)
 	//log.Printf("TestSyncRegistrations() Read Result 1: %+v\n", result1)
-	if reflect.DeepEqual(*result1, expected_result1) != true {
-		t.Error("Expected", expected_result1, "got", result1)
-	}
+	checkTestRegistrations(t, result1, expected_result1)
 
 	// Cleanup the registration, before performing another sync.
 	simulateSipDeregister(dockerHost, uint(dockerContainerPorts["freeswitch_1-5060/udp"]), test_sip_user, test_sip_pass, test_sip_contact_port, t)
 
 	// Second sync, should perform a remove from the K/V backend.
 	test_wg.Add(1)
-	syncRegistrations(test_esl_client, test_sofia_profiles, test_advertise_ip, test_advertise_port, 300, test_kv_backend, &test_wg, true)
+	syncRegistrations(context.Background(), test_esl_conn, test_advertise_ip, test_advertise_port, test_kv_backend, getTestRuntimeConfig(test_sofia_profiles), &test_wg, true, sync_trigger, make(chan error, 1))
 	result2, err := test_kv_backend.Read("", true)
 	if err != nil {
 		t.Fatal(err)
@@ -141,3 +203,631 @@ func TestSyncRegistrations(t *testing.T) {
 		t.Errorf("Expected a zero length result from K/V backend, got %d results: %+v\n", len(*result2), *result2)
 	}
 }
+
+// As TestWatchForRegistrationEvents(), against a fake ESL server and the memory backend, so no Docker is needed.
+// Also covers resubscribing (and requesting a sync) after FreeSWITCH drops the connection.
+func TestWatchForRegistrationEventsFake(t *testing.T) {
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	test_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer test_esl_conn.Close()
+	test_kv_backend := getTestMemoryKvBackend(t)
+	// The same user registered on another instance, which should be left alone.
+	other_instance_key := getRegistrationKey("1000@sip.testserver.tld", "192.168.99.101", 5062)
+	other_instance_value := "{\"host\":\"192.168.99.101\",\"port\":5062,\"recorded_at\":1470367071}"
+	if err := test_kv_backend.Write(other_instance_key, other_instance_value, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	var test_wg sync.WaitGroup
+	event_channel := make(chan struct{})
+	defer close(event_channel)
+	sync_trigger := make(chan struct{}, 1)
+	test_wg.Add(1)
+	go watchForRegistrationEvents(context.Background(), test_esl_conn, "192.168.99.100", 5062, test_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, 4, event_channel, sync_trigger)
+	<-event_channel
+	fake_esl_server.WaitForSubscription(t)
+
+	fake_esl_server.SendEvent(t, getTestFakeEslRegEvent("sofia::register", "1000@sip.testserver.tld", 49210))
+	<-event_channel
+	result1, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result1, Registrations{
+		"1000@sip.testserver.tld/192.168.99.100:5062": KvBackendValue{Host: "192.168.99.100", Port: 5062, Contact: "sip:1000@127.0.0.1:49210", Profile: "internal"},
+		other_instance_key: KvBackendValue{Host: "192.168.99.101", Port: 5062},
+	})
+
+	// FreeSWITCH restarts, anything missed while disconnected is caught up on by a full sync.
+	fake_esl_server.DropConnections()
+	fake_esl_server.WaitForSubscription(t)
+	select {
+	case <-sync_trigger:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a sync to be requested after resubscribing")
+	}
+
+	fake_esl_server.SendEvent(t, getTestFakeEslRegEvent("sofia::register", "1001@sip.testserver.tld", 49211))
+	<-event_channel
+	fake_esl_server.SendEvent(t, getTestFakeEslRegEvent("sofia::expire", "1000@sip.testserver.tld", 49210))
+	<-event_channel
+	test_wg.Wait()
+	result2, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result2, Registrations{
+		"1001@sip.testserver.tld/192.168.99.100:5062": KvBackendValue{Host: "192.168.99.100", Port: 5062, Contact: "sip:1001@127.0.0.1:49211", Profile: "internal"},
+		other_instance_key: KvBackendValue{Host: "192.168.99.101", Port: 5062},
+	})
+}
+
+func TestHandleFreeswitchRegEventUnwatchedProfile(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	runtime_config := getTestRuntimeConfig([]string{"internal"})
+	sync_trigger := make(chan struct{}, 1)
+	ignored_before := testutil.ToFloat64(metricEslEventsIgnored.WithLabelValues("unwatched"))
+	event := &goesl.Message{Headers: getTestFakeEslRegEvent("sofia::register", "1000@sip.testserver.tld", 49210)}
+	event.Headers["profile-name"] = "unwatched"
+	handleFreeswitchRegEvent(event, "192.168.99.100", 5062, test_kv_backend, runtime_config, sync_trigger)
+	// Without a profile-name, it can't be filtered.
+	event = &goesl.Message{Headers: getTestFakeEslRegEvent("sofia::register", "1001@sip.testserver.tld", 49211)}
+	delete(event.Headers, "profile-name")
+	handleFreeswitchRegEvent(event, "192.168.99.100", 5062, test_kv_backend, runtime_config, sync_trigger)
+	result, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result, Registrations{
+		"1001@sip.testserver.tld/192.168.99.100:5062": KvBackendValue{Host: "192.168.99.100", Port: 5062, Contact: "sip:1001@127.0.0.1:49211"},
+	})
+	select {
+	case <-sync_trigger:
+		t.Error("Expected no sync to be requested without --fsprofiles auto")
+	default:
+	}
+
+	ignored_increase := testutil.ToFloat64(metricEslEventsIgnored.WithLabelValues("unwatched")) - ignored_before
+	if ignored_increase != 1 {
+		t.Error("Expected 1 ignored event for the unwatched profile, got", ignored_increase)
+	}
+}
+
+// As TestSyncRegistrations(), against a fake ESL server and the memory backend, so no Docker is needed.
+func TestSyncRegistrationsFake(t *testing.T) {
+	defer func(v time.Duration) { syncRetryMinBackoff = v }(syncRetryMinBackoff)
+	syncRetryMinBackoff = time.Millisecond
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	test_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer test_esl_conn.Close()
+	test_kv_backend := getTestMemoryKvBackend(t)
+	fake_esl_server.SetRegistrations("internal", []FsRegProfileRegistration{
+		getTestFakeEslRegistration("1000@sip.testserver.tld", 49210),
+		getTestFakeEslRegistration("1001@sip.testserver.tld", 49211),
+	})
+	// Left over from before a restart, no longer registered.
+	for k, v := range map[string]string{
+		getRegistrationKey("1002@sip.testserver.tld", "192.168.99.100", 5061): "{\"host\":\"192.168.99.100\",\"port\":5061}",
+		getRegistrationKey("1002@sip.testserver.tld", "192.168.99.101", 5061): "{\"host\":\"192.168.99.101\",\"port\":5061,\"recorded_at\":1470367071}",
+	} {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), test_esl_conn, "192.168.99.100", 5061, test_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, true, nil, fatal_error_channel)
+	result1, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result1, Registrations{
+		"1000@sip.testserver.tld/192.168.99.100:5061": KvBackendValue{Host: "192.168.99.100", Port: 5061, Contact: "sip:1000@127.0.0.1:49210", Profile: "internal"},
+		"1001@sip.testserver.tld/192.168.99.100:5061": KvBackendValue{Host: "192.168.99.100", Port: 5061, Contact: "sip:1001@127.0.0.1:49211", Profile: "internal"},
+		"1002@sip.testserver.tld/192.168.99.101:5061": KvBackendValue{Host: "192.168.99.101", Port: 5061},
+	})
+
+	// A profile FreeSWITCH doesn't know about is a configuration error, reported rather than retried forever.
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), test_esl_conn, "192.168.99.100", 5061, test_kv_backend, getTestRuntimeConfig([]string{"missing"}), &test_wg, true, nil, fatal_error_channel)
+	select {
+	case err := <-fatal_error_channel:
+		if sync_err, ok := err.(*syncError); ok == false || sync_err.reason != "config" {
+			t.Error("Expected a config syncError, got", err)
+		}
+	default:
+		t.Error("Expected an error on fatal_error_channel")
+	}
+}
+
+// The sync command gives up rather than waiting for FreeSWITCH to come back.
+func TestSyncRegistrationsOnceFreeswitchDown(t *testing.T) {
+	defer func(v time.Duration) { syncRetryMinBackoff = v }(syncRetryMinBackoff)
+	syncRetryMinBackoff = time.Millisecond
+	fake_esl_server := newFakeEslServer(t)
+	test_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer test_esl_conn.Close()
+	fake_esl_server.Close()
+
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	test_wg.Add(1)
+	go syncRegistrations(context.Background(), test_esl_conn, "192.168.99.100", 5061, getTestMemoryKvBackend(t), getTestRuntimeConfig([]string{"internal"}), &test_wg, true, nil, fatal_error_channel)
+	select {
+	case err := <-fatal_error_channel:
+		if sync_err, ok := err.(*syncError); ok == false || sync_err.reason != "freeswitch" {
+			t.Error("Expected a freeswitch syncError, got", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for syncRegistrations() to give up")
+	}
+	test_wg.Wait()
+}
+
+// --fsprofiles auto, with the profiles discovered from the fake ESL server on each sync.
+func TestSyncRegistrationsAutoProfilesFake(t *testing.T) {
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	sync_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer sync_esl_conn.Close()
+	event_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer event_esl_conn.Close()
+	test_kv_backend := getTestMemoryKvBackend(t)
+	fake_esl_server.SetRegistrations("internal", []FsRegProfileRegistration{getTestFakeEslRegistration("1000@sip.testserver.tld", 49210)})
+	fake_esl_server.SetRegistrations("external", []FsRegProfileRegistration{getTestFakeEslRegistration("1001@sip.testserver.tld", 49211)})
+	runtime_config := getTestRuntimeConfigWithArgs(&ArgConfig{
+		FreeswitchSofiaProfilesAuto:    true,
+		FreeswitchSofiaProfilesExclude: []string{"external"},
+	})
+
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), sync_esl_conn, "192.168.99.100", 5061, test_kv_backend, runtime_config, &test_wg, true, nil, fatal_error_channel)
+	result1, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result1, Registrations{
+		"1000@sip.testserver.tld/192.168.99.100:5061": KvBackendValue{Host: "192.168.99.100", Port: 5061, Contact: "sip:1000@127.0.0.1:49210", Profile: "internal"},
+	})
+
+	event_channel := make(chan struct{})
+	defer close(event_channel)
+	sync_trigger := make(chan struct{}, 1)
+	test_wg.Add(1)
+	go watchForRegistrationEvents(context.Background(), event_esl_conn, "192.168.99.100", 5061, test_kv_backend, runtime_config, &test_wg, 3, event_channel, sync_trigger)
+	<-event_channel
+	fake_esl_server.WaitForSubscription(t)
+	// Excluded, so ignored.
+	external_event := getTestFakeEslRegEvent("sofia::register", "1002@sip.testserver.tld", 49212)
+	external_event["profile-name"] = "external"
+	fake_esl_server.SendEvent(t, external_event)
+	<-event_channel
+	select {
+	case <-sync_trigger:
+		t.Error("Expected no sync to be requested for an excluded profile")
+	default:
+	}
+	// Started since the last sync, a sync is requested to pick it up.
+	fake_esl_server.SetRegistrations("internal2", []FsRegProfileRegistration{getTestFakeEslRegistration("1003@sip.testserver.tld", 49213)})
+	internal2_event := getTestFakeEslRegEvent("sofia::register", "1003@sip.testserver.tld", 49213)
+	internal2_event["profile-name"] = "internal2"
+	fake_esl_server.SendEvent(t, internal2_event)
+	<-event_channel
+	select {
+	case <-sync_trigger:
+	default:
+		t.Error("Expected a sync to be requested for an undiscovered profile")
+	}
+	test_wg.Wait()
+	result2, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*result2) != 1 {
+		t.Error("Expected the events to be ignored, got", *result2)
+	}
+
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), sync_esl_conn, "192.168.99.100", 5061, test_kv_backend, runtime_config, &test_wg, true, nil, fatal_error_channel)
+	result3, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result3, Registrations{
+		"1000@sip.testserver.tld/192.168.99.100:5061": KvBackendValue{Host: "192.168.99.100", Port: 5061, Contact: "sip:1000@127.0.0.1:49210", Profile: "internal"},
+		"1003@sip.testserver.tld/192.168.99.100:5061": KvBackendValue{Host: "192.168.99.100", Port: 5061, Contact: "sip:1003@127.0.0.1:49213", Profile: "internal2"},
+	})
+	select {
+	case err := <-fatal_error_channel:
+		t.Error("Expected no fatal errors, got", err)
+	default:
+	}
+}
+
+// With --fsprofiles auto, no running profiles is a (retryable) FreeSWITCH error, none matching the patterns is a configuration error.
+func TestSyncRegistrationsAutoProfilesNoneFake(t *testing.T) {
+	defer func(v time.Duration) { syncRetryMinBackoff = v }(syncRetryMinBackoff)
+	syncRetryMinBackoff = time.Millisecond
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	sync_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer sync_esl_conn.Close()
+	runtime_config := getTestRuntimeConfigWithArgs(&ArgConfig{
+		FreeswitchSofiaProfilesAuto:    true,
+		FreeswitchSofiaProfilesExclude: []string{"external"},
+	})
+
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	for _, expected_reason := range []string{"freeswitch", "config"} {
+		if expected_reason == "config" {
+			fake_esl_server.SetRegistrations("external", []FsRegProfileRegistration{})
+		}
+		test_wg.Add(1)
+		syncRegistrations(context.Background(), sync_esl_conn, "192.168.99.100", 5061, getTestMemoryKvBackend(t), runtime_config, &test_wg, true, nil, fatal_error_channel)
+		select {
+		case err := <-fatal_error_channel:
+			if sync_err, ok := err.(*syncError); ok == false || sync_err.reason != expected_reason {
+				t.Errorf("Expected a %s syncError, got %s", expected_reason, err)
+			}
+		default:
+			t.Error("Expected an error on fatal_error_channel")
+		}
+	}
+}
+
+// --fsadvertisefrom, with each Sofia profile's address derived from the fake ESL server.
+func TestSyncRegistrationsAdvertiseFromFake(t *testing.T) {
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	sync_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer sync_esl_conn.Close()
+	test_kv_backend := getTestMemoryKvBackend(t)
+	fake_esl_server.SetRegistrations("internal", []FsRegProfileRegistration{getTestFakeEslRegistration("1000@sip.testserver.tld", 49210)})
+	fake_esl_server.SetProfileAddress("internal", "10.0.0.1", "", 5060)
+	fake_esl_server.SetRegistrations("external", []FsRegProfileRegistration{getTestFakeEslRegistration("1001@sip.testserver.tld", 49211)})
+	fake_esl_server.SetProfileAddress("external", "10.0.0.1", "203.0.113.1", 5080)
+	runtime_config := getTestRuntimeConfigWithArgs(&ArgConfig{
+		FreeswitchSofiaProfiles: []string{"internal", "external"},
+		FreeswitchAdvertiseFrom: "ext-sip-ip",
+	})
+
+	// Events before the first sync can't be keyed yet.
+	sync_trigger := make(chan struct{}, 1)
+	handleFreeswitchRegEvent(&goesl.Message{Headers: getTestFakeEslRegEvent("sofia::register", "1002@sip.testserver.tld", 49212)}, "", 0, test_kv_backend, runtime_config, sync_trigger)
+	select {
+	case <-sync_trigger:
+	default:
+		t.Error("Expected a sync to be requested for a profile without an address")
+	}
+
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), sync_esl_conn, "", 0, test_kv_backend, runtime_config, &test_wg, true, nil, fatal_error_channel)
+	handleFreeswitchRegEvent(&goesl.Message{Headers: getTestFakeEslRegEvent("sofia::register", "1002@sip.testserver.tld", 49212)}, "", 0, test_kv_backend, runtime_config, sync_trigger)
+	result1, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result1, Registrations{
+		"1000@sip.testserver.tld/10.0.0.1:5060":    KvBackendValue{Host: "10.0.0.1", Port: 5060, Contact: "sip:1000@127.0.0.1:49210", Profile: "internal"},
+		"1001@sip.testserver.tld/203.0.113.1:5080": KvBackendValue{Host: "203.0.113.1", Port: 5080, Contact: "sip:1001@127.0.0.1:49211", Profile: "external"},
+		"1002@sip.testserver.tld/10.0.0.1:5060":    KvBackendValue{Host: "10.0.0.1", Port: 5060, Contact: "sip:1002@127.0.0.1:49212", Profile: "internal"},
+	})
+
+	// The external profile moves, its registrations under the old address are removed.
+	fake_esl_server.SetProfileAddress("external", "10.0.0.1", "203.0.113.1", 5090)
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), sync_esl_conn, "", 0, test_kv_backend, runtime_config, &test_wg, true, nil, fatal_error_channel)
+	result2, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestRegistrations(t, result2, Registrations{
+		"1000@sip.testserver.tld/10.0.0.1:5060":    KvBackendValue{Host: "10.0.0.1", Port: 5060, Contact: "sip:1000@127.0.0.1:49210", Profile: "internal"},
+		"1001@sip.testserver.tld/203.0.113.1:5090": KvBackendValue{Host: "203.0.113.1", Port: 5090, Contact: "sip:1001@127.0.0.1:49211", Profile: "external"},
+	})
+	select {
+	case err := <-fatal_error_channel:
+		t.Error("Expected no fatal errors, got", err)
+	default:
+	}
+}
+
+// Older FreeSWITCH versions don't send profile-name, which --fsadvertisefrom needs unless a single profile is synced.
+func TestHandleFreeswitchRegEventAdvertiseFromWithoutProfile(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	sync_trigger := make(chan struct{}, 1)
+	for _, v := range []struct {
+		sofia_profiles  []string
+		expected_result Registrations
+	}{
+		{[]string{"internal"}, Registrations{
+			"1002@sip.testserver.tld/10.0.0.1:5060": KvBackendValue{Host: "10.0.0.1", Port: 5060, Contact: "sip:1002@127.0.0.1:49212", Profile: "internal"},
+		}},
+		// Can't tell which profile (so which address) it's for, left to the next sync.
+		{[]string{"internal", "external"}, Registrations{}},
+	} {
+		runtime_config := getTestRuntimeConfigWithArgs(&ArgConfig{
+			FreeswitchSofiaProfiles: v.sofia_profiles,
+			FreeswitchAdvertiseFrom: "sip-ip",
+		})
+		runtime_config.SetProfileAdvertiseAddress("internal", AdvertiseAddress{Ip: "10.0.0.1", Port: 5060})
+		runtime_config.SetProfileAdvertiseAddress("external", AdvertiseAddress{Ip: "10.0.0.1", Port: 5080})
+		event := &goesl.Message{Headers: getTestFakeEslRegEvent("sofia::register", "1002@sip.testserver.tld", 49212)}
+		delete(event.Headers, "profile-name")
+		handleFreeswitchRegEvent(event, "", 0, test_kv_backend, runtime_config, sync_trigger)
+		result, err := test_kv_backend.Read("", true)
+		if err != nil && err.Error() != "KEY_NOT_FOUND" {
+			t.Fatal(err)
+		}
+		checkTestRegistrations(t, result, v.expected_result)
+		select {
+		case <-sync_trigger:
+			t.Error("Expected no sync to be requested for", v.sofia_profiles)
+		default:
+		}
+		test_kv_backend.Delete("1002@sip.testserver.tld/10.0.0.1:5060")
+	}
+}
+
+// Fails every read, as if the K/V backend is unreachable.
+type failingReadKvBackend struct {
+	KvBackend
+	reads int
+}
+
+func (k *failingReadKvBackend) Read(key string, recursive bool) (*map[string]string, error) {
+	k.reads++
+	return nil, errors.New("connection refused")
+}
+
+func TestSyncRegistrationsRetries(t *testing.T) {
+	defer func(v time.Duration) { syncRetryMinBackoff = v }(syncRetryMinBackoff)
+	syncRetryMinBackoff = time.Millisecond
+	test_kv_backend := getTestMemoryKvBackend(t)
+	failing_kv_backend := &failingReadKvBackend{KvBackend: test_kv_backend}
+
+	// Once off mode gives up after syncMaxConfigErrors attempts, reporting (rather than exiting on) the error.
+	// The K/V backend is read before anything is fetched from FreeSWITCH, so no ESL connection is needed.
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), nil, "192.168.99.100", 5061, failing_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, true, nil, fatal_error_channel)
+	if failing_kv_backend.reads != syncMaxConfigErrors {
+		t.Errorf("Expected %d attempts, got %d", syncMaxConfigErrors, failing_kv_backend.reads)
+	}
+	select {
+	case err := <-fatal_error_channel:
+		if sync_err, ok := err.(*syncError); ok == false || sync_err.reason != "kv_backend" {
+			t.Error("Expected a kv_backend syncError, got", err)
+		}
+	default:
+		t.Error("Expected an error on fatal_error_channel")
+	}
+
+	// Otherwise K/V backend errors are retried until shutdown, without reporting an error.
+	syncRetryMinBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	failing_kv_backend.reads = 0
+	test_wg.Add(1)
+	go syncRegistrations(ctx, nil, "192.168.99.100", 5061, failing_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, false, nil, fatal_error_channel)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		test_wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for syncRegistrations() to return after cancelling")
+	}
+	// Backing off 10ms, 20ms, 40ms, 80ms, 160ms... so 5 or so attempts within 200ms, never one every 10ms.
+	if failing_kv_backend.reads < 2 || failing_kv_backend.reads > syncMaxConfigErrors+1 {
+		t.Error("Expected retries with backoff, got", failing_kv_backend.reads, "attempts")
+	}
+	select {
+	case err := <-fatal_error_channel:
+		t.Error("Expected no error on fatal_error_channel, got", err)
+	default:
+	}
+}
+
+// Fails writes, deletes and refreshes of a key the first failures[key] times (every time if -1).
+type flakyKvBackend struct {
+	KvBackend
+	failures map[string]int
+	attempts map[string]int
+}
+
+func (k *flakyKvBackend) fail(key string) error {
+	k.attempts[key]++
+	if k.failures[key] == -1 || k.attempts[key] <= k.failures[key] {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (k *flakyKvBackend) Write(key string, value string, ttl int) error {
+	if err := k.fail(key); err != nil {
+		return err
+	}
+	return k.KvBackend.Write(key, value, ttl)
+}
+
+func (k *flakyKvBackend) Delete(key string) error {
+	if err := k.fail(key); err != nil {
+		return err
+	}
+	return k.KvBackend.Delete(key)
+}
+
+func (k *flakyKvBackend) Refresh(key string, ttl int) error {
+	if err := k.fail(key); err != nil {
+		return err
+	}
+	return k.KvBackend.Refresh(key, ttl)
+}
+
+func TestApplySyncOperations(t *testing.T) {
+	defer func(v time.Duration) { syncRetryMinBackoff = v }(syncRetryMinBackoff)
+	syncRetryMinBackoff = time.Millisecond
+	test_kv_backend := getTestMemoryKvBackend(t)
+	if err := test_kv_backend.Write("1000@domain/10.0.0.1:5060", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300); err != nil {
+		t.Fatal(err)
+	}
+	flaky_kv_backend := &flakyKvBackend{
+		KvBackend: test_kv_backend,
+		failures: map[string]int{
+			"1000@domain/10.0.0.1:5060": 1,
+			"1001@domain/10.0.0.1:5060": 2,
+			"1002@domain/10.0.0.1:5060": -1,
+		},
+		attempts: make(map[string]int),
+	}
+	operations := []syncOperation{
+		{Delete: true, Key: "1000@domain/10.0.0.1:5060"},
+		{Key: "1001@domain/10.0.0.1:5060", Value: "{\"host\":\"10.0.0.1\",\"port\":5060}"},
+		{Key: "1002@domain/10.0.0.1:5060", Value: "{\"host\":\"10.0.0.1\",\"port\":5060}"},
+		{Key: "1003@domain/10.0.0.1:5060", Value: "{\"host\":\"10.0.0.1\",\"port\":5060}"},
+	}
+	failed := applySyncOperations(context.Background(), flaky_kv_backend, operations, 300)
+
+	// Only the key that always fails is left, after syncMaxOperationAttempts.
+	if len(failed) != 1 || failed[0].Key != "1002@domain/10.0.0.1:5060" || failed[0].err == nil {
+		t.Error("Expected only 1002@domain/10.0.0.1:5060 to fail, got", failed)
+	}
+	expected_attempts := map[string]int{
+		"1000@domain/10.0.0.1:5060": 2,
+		"1001@domain/10.0.0.1:5060": 3,
+		"1002@domain/10.0.0.1:5060": syncMaxOperationAttempts,
+		"1003@domain/10.0.0.1:5060": 1,
+	}
+	if reflect.DeepEqual(flaky_kv_backend.attempts, expected_attempts) != true {
+		t.Error("Expected", expected_attempts, "got", flaky_kv_backend.attempts)
+	}
+	result, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_keys := []string{"1001@domain/10.0.0.1:5060", "1003@domain/10.0.0.1:5060"}
+	var result_keys []string
+	for k, _ := range *result {
+		result_keys = append(result_keys, k)
+	}
+	sort.Strings(result_keys)
+	if reflect.DeepEqual(result_keys, expected_keys) != true {
+		t.Error("Expected", expected_keys, "got", result_keys)
+	}
+
+	summary := getSyncOperationsSummary(append(failed, syncOperation{Delete: true}, syncOperation{}))
+	if summary != "2 write, 1 delete" {
+		t.Error("Expected '2 write, 1 delete', got", summary)
+	}
+}
+
+func TestRefreshRegistrations(t *testing.T) {
+	test_kv_backend := getTestKvBackend(t)
+	test_advertise_ip := "192.168.99.100"
+	test_advertise_port := 5063
+	this_instance_value := "{\"host\":\"192.168.99.100\",\"port\":5063}"
+	other_instance_value := "{\"host\":\"192.168.99.101\",\"port\":5063}"
+
+	this_instance_key := getRegistrationKey("1003@sip.testserver.tld", "192.168.99.100", 5063)
+	other_instance_key := getRegistrationKey("1003@sip.testserver.tld", "192.168.99.101", 5063)
+
+	// Start with short TTLs, only our own registration should be refreshed.
+	for k, v := range map[string]string{this_instance_key: this_instance_value, other_instance_key: other_instance_value} {
+		err := test_kv_backend.Write(k, v, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer test_kv_backend.Delete(k)
+	}
+
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	refreshRegistrations(context.Background(), test_advertise_ip, test_advertise_port, test_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, true, nil)
+
+	kapi := test_kv_backend.(*KvBackendEtcd).Kapi
+	resp1, err := kapi.Get(context.Background(), getKvKeyWithPrefix(test_kv_backend.GetPrefix(), this_instance_key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp1.Node.TTL <= 10 {
+		t.Error("Expected a refreshed TTL above 10 seconds, got", resp1.Node.TTL)
+	}
+	// Refreshing should never change the value.
+	if resp1.Node.Value != this_instance_value {
+		t.Error("Expected", this_instance_value, "got", resp1.Node.Value)
+	}
+	resp2, err := kapi.Get(context.Background(), getKvKeyWithPrefix(test_kv_backend.GetPrefix(), other_instance_key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp2.Node.TTL > 10 {
+		t.Error("Expected another instance's TTL to be left alone (10 seconds or less), got", resp2.Node.TTL)
+	}
+}
+
+func TestRefreshRegistrationsTriggersSync(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	for _, k := range []string{"1000@domain/192.168.99.100:5063", "1001@domain/192.168.99.100:5063"} {
+		if err := test_kv_backend.Write(k, "{\"host\":\"192.168.99.100\",\"port\":5063}", 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flaky_kv_backend := &flakyKvBackend{
+		KvBackend: test_kv_backend,
+		failures:  map[string]int{"1001@domain/192.168.99.100:5063": -1},
+		attempts:  make(map[string]int),
+	}
+	sync_trigger := make(chan struct{}, 1)
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	refreshRegistrations(context.Background(), "192.168.99.100", 5063, flaky_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, true, sync_trigger)
+	select {
+	case <-sync_trigger:
+	default:
+		t.Error("Expected a failed refresh to request a full sync")
+	}
+
+	// Nothing missing, so no sync.
+	flaky_kv_backend.failures = map[string]int{}
+	test_wg.Add(1)
+	refreshRegistrations(context.Background(), "192.168.99.100", 5063, flaky_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, true, sync_trigger)
+	select {
+	case <-sync_trigger:
+		t.Error("Expected no sync to be requested when every registration was refreshed")
+	default:
+	}
+}
+
+func TestRefreshRegistrationsShutdown(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	// Would otherwise sleep for a third of the TTL before the first refresh.
+	go refreshRegistrations(ctx, "192.168.99.100", 5063, test_kv_backend, getTestRuntimeConfig([]string{"internal"}), &test_wg, false, nil)
+	done := make(chan struct{})
+	go func() {
+		test_wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for refreshRegistrations() to return after cancelling")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Updated by the goroutines started from main(), reported on /healthz and /readyz.
+var healthState = newHealthState()
+
+type HealthState struct {
+	mutex sync.Mutex
+	// Whether the event watcher currently has a working ESL subscription.
+	subscribed bool
+	// Whether at least one full sync has completed.
+	synced bool
+	// Last time the event watcher subscribed or received a message (including HEARTBEAT events).
+	lastEventLoopActivity time.Time
+}
+
+// Starts with the event loop considered active, so liveness doesn't fail before the first subscription is given a chance.
+func newHealthState() *HealthState {
+	return &HealthState{lastEventLoopActivity: time.Now()}
+}
+
+func (h *HealthState) SetSubscribed(subscribed bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.subscribed = subscribed
+	if subscribed == true {
+		h.lastEventLoopActivity = time.Now()
+	}
+}
+
+func (h *HealthState) TouchEventLoop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastEventLoopActivity = time.Now()
+}
+
+func (h *HealthState) SetSynced() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.synced = true
+}
+
+// Returns an error if the event loop has been inactive (stuck, or disconnected) for longer than threshold.
+func (h *HealthState) checkLiveness(threshold time.Duration, now time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	inactive := now.Sub(h.lastEventLoopActivity)
+	if inactive > threshold {
+		return fmt.Errorf("no activity from the FreeSWITCH event loop for %s (threshold %s)", inactive, threshold)
+	}
+	return nil
+}
+
+// Returns an error for each readiness check that is failing, keyed by check name.
+func (h *HealthState) checkReadiness(kv_backend KvBackend) map[string]error {
+	results := make(map[string]error)
+	h.mutex.Lock()
+	if h.subscribed == false {
+		results["esl_subscription"] = fmt.Errorf("not subscribed to FreeSWITCH registration events")
+	}
+	if h.synced == false {
+		results["sync"] = fmt.Errorf("no full sync has completed yet")
+	}
+	h.mutex.Unlock()
+	// Reads what a sync would, as a lookup of a key that can't exist may not reach the backend at all (eg. Kamailio).
+	_, err := kv_backend.Read("", true)
+	if err != nil && err.Error() != "KEY_NOT_FOUND" {
+		results["kv_backend"] = err
+	}
+	return results
+}
+
+// Liveness, fails if the event loop has been stuck or disconnected for longer than threshold.
+func healthzHandler(h *HealthState, threshold time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := h.checkLiveness(threshold, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("event_loop: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "OK\n")
+	}
+}
+
+// Readiness, fails until we are subscribed to events, the K/V backend is reachable and a full sync has completed.
+func readyzHandler(h *HealthState, kv_backend KvBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := h.checkReadiness(kv_backend)
+		if len(results) > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, v := range []string{"esl_subscription", "kv_backend", "sync"} {
+				if err, ok := results[v]; ok == true {
+					fmt.Fprintf(w, "%s: %s\n", v, err)
+				}
+			}
+			return
+		}
+		fmt.Fprint(w, "OK\n")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthStateCheckLiveness(t *testing.T) {
+	test_health := newHealthState()
+	now := time.Now()
+	err := test_health.checkLiveness(time.Minute, now)
+	if err != nil {
+		t.Error("Expected nil error on startup, got", err)
+	}
+	err = test_health.checkLiveness(time.Minute, now.Add(2*time.Minute))
+	if err == nil {
+		t.Error("Expected an error after the threshold, got nil")
+	}
+	// A message (eg. HEARTBEAT) from the event loop resets it.
+	test_health.TouchEventLoop()
+	err = test_health.checkLiveness(time.Minute, time.Now().Add(30*time.Second))
+	if err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+}
+
+func TestHealthStateCheckReadiness(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	test_health := newHealthState()
+
+	result1 := test_health.checkReadiness(test_kv_backend)
+	expected_result1 := []string{"esl_subscription", "sync"}
+	checkTestReadinessResults(t, result1, expected_result1)
+
+	test_health.SetSubscribed(true)
+	test_health.SetSynced()
+	result2 := test_health.checkReadiness(test_kv_backend)
+	checkTestReadinessResults(t, result2, []string{})
+
+	// Losing the subscription (eg. FreeSWITCH restarted) or the K/V backend makes us unready again.
+	test_health.SetSubscribed(false)
+	result3 := test_health.checkReadiness(&failingReadKvBackend{KvBackend: test_kv_backend})
+	expected_result3 := []string{"esl_subscription", "kv_backend"}
+	checkTestReadinessResults(t, result3, expected_result3)
+}
+
+func TestHealthStateCheckReadinessKamailio(t *testing.T) {
+	test_kv_backend, cleanup := getTestKamailioKvBackend(t)
+	defer cleanup()
+	test_health := newHealthState()
+	test_health.SetSubscribed(true)
+	test_health.SetSynced()
+	result1 := test_health.checkReadiness(test_kv_backend)
+	checkTestReadinessResults(t, result1, []string{})
+
+	test_kv_backend.Db.Close()
+	result2 := test_health.checkReadiness(test_kv_backend)
+	checkTestReadinessResults(t, result2, []string{"kv_backend"})
+}
+
+func checkTestReadinessResults(t *testing.T, input map[string]error, expected_result []string) {
+	result := []string{}
+	for _, v := range []string{"esl_subscription", "kv_backend", "sync"} {
+		if _, ok := input[v]; ok == true {
+			result = append(result, v)
+		}
+	}
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected failing checks", expected_result, "got", input)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	test_health := newHealthState()
+
+	recorder1 := httptest.NewRecorder()
+	healthzHandler(test_health, time.Minute)(recorder1, getTestHttpRequest(t, "/healthz"))
+	if recorder1.Code != http.StatusOK {
+		t.Error("Expected a status code of 200, got", recorder1.Code)
+	}
+	recorder2 := httptest.NewRecorder()
+	healthzHandler(test_health, 0)(recorder2, getTestHttpRequest(t, "/healthz"))
+	if recorder2.Code != http.StatusServiceUnavailable {
+		t.Error("Expected a status code of 503, got", recorder2.Code)
+	}
+
+	recorder3 := httptest.NewRecorder()
+	readyzHandler(test_health, test_kv_backend)(recorder3, getTestHttpRequest(t, "/readyz"))
+	if recorder3.Code != http.StatusServiceUnavailable {
+		t.Error("Expected a status code of 503, got", recorder3.Code)
+	}
+	expected_body3 := "esl_subscription: not subscribed to FreeSWITCH registration events\nsync: no full sync has completed yet\n"
+	if recorder3.Body.String() != expected_body3 {
+		t.Error("Expected", expected_body3, "got", recorder3.Body.String())
+	}
+	test_health.SetSubscribed(true)
+	test_health.SetSynced()
+	recorder4 := httptest.NewRecorder()
+	readyzHandler(test_health, test_kv_backend)(recorder4, getTestHttpRequest(t, "/readyz"))
+	if recorder4.Code != http.StatusOK || strings.TrimSpace(recorder4.Body.String()) != "OK" {
+		t.Error("Expected a status code of 200 and OK, got", recorder4.Code, recorder4.Body.String())
+	}
+}
+
+func getTestHttpRequest(t *testing.T, path string) *http.Request {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
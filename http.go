@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+)
+
+// Endpoints served on --httplisten.
+func newHttpMux(kv_backend KvBackend, liveness_threshold time.Duration) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthzHandler(healthState, liveness_threshold))
+	mux.Handle("/readyz", readyzHandler(healthState, kv_backend))
+	mux.Handle("/registrations", registrationsHandler(kv_backend))
+	mux.Handle("/registrations/", registrationsHandler(kv_backend))
+	return mux
+}
+
+// Serves handler on listener until ctx is cancelled, run within a goroutine from main()
+func serveHttp(ctx context.Context, listener net.Listener, handler http.Handler, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log.Printf("serveHttp(): Listening on %s.\n", listener.Addr())
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	err := http.Serve(listener, handler)
+	// Closing the listener on shutdown is the only way out of http.Serve().
+	if ctx.Err() == nil {
+		log.Printf("WARNING: serveHttp(): %s\n", err)
+	}
+	log.Printf("serveHttp(): Finished.\n")
+}
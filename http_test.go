@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServeHttp(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	go serveHttp(ctx, listener, newHttpMux(test_kv_backend, time.Minute), &test_wg)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected a status code of 200, got", resp.StatusCode)
+	}
+	if strings.Contains(string(body), "fs_registrator_sync_duration_seconds") == false {
+		t.Error("Expected fs_registrator_sync_duration_seconds in /metrics, got", string(body))
+	}
+
+	// Should stop serving on shutdown.
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		test_wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for serveHttp() to return after cancelling")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -12,7 +14,11 @@ type KvBackend interface {
 	BackendName() string
 	GetPrefix() string
 	Read(key string, recursive bool) (*map[string]string, error)
+	// Keys should expire after ttl seconds unless written or refreshed again.
+	// Consul only expires keys with the session holding them, which can take up to a few TTLs.
 	Write(key string, value string, ttl int) error
+	// Extend the TTL of an existing key, without recreating it if it has since been deleted.
+	Refresh(key string, ttl int) error
 	Delete(key string) error
 }
 
@@ -20,6 +26,11 @@ type KvBackend interface {
 
 func init() {
 	RegisterKvBackend("etcd", NewKvBackendEtcd)
+	RegisterKvBackend("etcd3", NewKvBackendEtcd3)
+	RegisterKvBackend("consul", NewKvBackendConsul)
+	RegisterKvBackend("redis", NewKvBackendRedis)
+	RegisterKvBackend("kamailio", NewKvBackendKamailio)
+	RegisterKvBackend("memory", NewKvBackendMemory)
 	// Add new backends here as they become available.
 }
 
@@ -38,12 +49,13 @@ func RegisterKvBackend(name string, factory KvBackendFactory) {
 	kvBackendFactories[name] = factory
 }
 
-// Make a list of all available K/V backend factories
+// Make a list of all available K/V backend factories (sorted, map ordering is random)
 func availableKvBackends() []string {
 	var available_kv_backends []string
 	for k, _ := range kvBackendFactories {
 		available_kv_backends = append(available_kv_backends, k)
 	}
+	sort.Strings(available_kv_backends)
 	return available_kv_backends
 }
 
@@ -63,11 +75,37 @@ func CreateKvBackend(conf map[string]string) (KvBackend, error) {
 	return kvBackendFactory(conf)
 }
 
+// Creates the K/V backend from the --kv* flags.
+func createKvBackendFromArgs(arg_config *ArgConfig) (KvBackend, error) {
+	kv_backend_conf := map[string]string{
+		"backend": arg_config.KvBackend,
+		"host":    arg_config.KvHost,
+		"port":    strconv.Itoa(int(arg_config.KvPort)),
+		"prefix":  arg_config.KvPrefix,
+	}
+	for k, v := range arg_config.KvOptions {
+		if _, ok := kv_backend_conf[k]; ok == false {
+			kv_backend_conf[k] = v
+		}
+	}
+	return CreateKvBackend(kv_backend_conf)
+}
+
 //
 
 type KvBackendValue struct {
+	// Where to send SIP traffic for this registration (ie. this FreeSWITCH instance).
 	Host string `json:"host"`
 	Port int    `json:"port"`
+	// Registration details, all optional so older values (host/port only) still decode, and older readers ignore them.
+	Contact     string `json:"contact,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	NetworkIp   string `json:"network_ip,omitempty"`
+	NetworkPort int    `json:"network_port,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+	// Unix timestamps.
+	Expires    int64 `json:"expires,omitempty"`
+	RecordedAt int64 `json:"recorded_at,omitempty"`
 }
 
 func getKvBackendValueType(ip string, port int) KvBackendValue {
@@ -125,3 +163,18 @@ func stripKvKeyPrefix(prefix string, full_key string) string {
 	//log.Printf("stripKvKeyPrefix(%s, %s) new use_key 2: %s\n", prefix, full_key, use_key)
 	return use_key
 }
+
+// Strips the prefix from a key read back from a backend.
+func getKvResultKey(prefix string, full_key string) string {
+	result_key := stripKvKeyPrefix(prefix, full_key)
+	if len(result_key) == 0 {
+		// If we strip the prefix, there would be no key at all. Leave it in place, just remove leading slash instead.
+		// This use case should be rare in this app.
+		if full_key[0:1] == "/" && len(full_key) > 1 {
+			result_key = full_key[1:]
+		} else {
+			result_key = full_key
+		}
+	}
+	return result_key
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// Consul enforces these bounds on session TTLs.
+const consulMinSessionTtl = 10
+const consulMaxSessionTtl = 86400
+
+// How often to retry acquiring a key held by another session.
+const consulAcquireAttempts = 3
+
+type consulSession struct {
+	id      string
+	created time.Time
+}
+
+type KvBackendConsul struct {
+	Client *consul_api.Client
+	Prefix string
+	// Session ID per TTL, keys are acquired against a session so they are removed when it expires.
+	sessions      map[int]*consulSession
+	sessionsMutex sync.Mutex
+	now           func() time.Time
+}
+
+func NewKvBackendConsul(conf map[string]string) (KvBackend, error) {
+	for _, v := range []string{"host", "port", "prefix"} {
+		if _, ok := conf[v]; ok == false {
+			return nil, fmt.Errorf("consul: '%s' key does not exist in conf.", v)
+		}
+	}
+	cfg := consul_api.DefaultConfig()
+	cfg.Address = fmt.Sprintf("%s:%s", conf["host"], conf["port"])
+	c, err := consul_api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &KvBackendConsul{
+		Client:   c,
+		Prefix:   conf["prefix"],
+		sessions: make(map[int]*consulSession),
+		now:      time.Now,
+	}, nil
+}
+
+func (k *KvBackendConsul) BackendName() string {
+	return "consul"
+}
+
+func (k *KvBackendConsul) GetPrefix() string {
+	return k.Prefix
+}
+
+// If the key is a prefix (recursive lookup), set recursive = true
+// Results will be key/value in a map.
+func (k *KvBackendConsul) Read(key string, recursive bool) (*map[string]string, error) {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("consul.Read(): Getting '%s' key value (recursive: %t)", use_key, recursive)
+	results := make(map[string]string)
+	if recursive == true {
+		// Consul has no directories, list everything below the key instead.
+		// The trailing slash stops a prefix of "foo" also matching "foobar".
+		pairs, _, err := k.Client.KV().List(fmt.Sprintf("%s/", use_key), nil)
+		if err != nil {
+			return &results, err
+		}
+		for _, v := range pairs {
+			results[stripKvKeyPrefix(k.Prefix, v.Key)] = string(v.Value)
+		}
+		if len(results) > 0 {
+			return &results, nil
+		}
+	}
+	// Either a single key lookup, or a recursive lookup where the key is not a prefix.
+	pair, _, err := k.Client.KV().Get(use_key, nil)
+	if err != nil {
+		return &results, err
+	}
+	if pair == nil {
+		return &results, errors.New("KEY_NOT_FOUND")
+	}
+	results[getKvResultKey(k.Prefix, pair.Key)] = string(pair.Value)
+	return &results, nil
+}
+
+// Returns a session for the requested TTL, creating (and renewing in the background) one if required.
+// A session is only handed out for one TTL, and renewed for one more so a refresh can move its keys to
+// the next session. Keys that are not written or refreshed again are deleted when the old session expires.
+func (k *KvBackendConsul) getSession(ttl int) (string, error) {
+	if ttl < consulMinSessionTtl {
+		ttl = consulMinSessionTtl
+	} else if ttl > consulMaxSessionTtl {
+		ttl = consulMaxSessionTtl
+	}
+	session_ttl := time.Duration(ttl) * time.Second
+	k.sessionsMutex.Lock()
+	defer k.sessionsMutex.Unlock()
+	if session, ok := k.sessions[ttl]; ok == true && k.now().Sub(session.created) < session_ttl {
+		return session.id, nil
+	}
+	session_id, _, err := k.Client.Session().Create(&consul_api.SessionEntry{
+		Name:     "fs-registrator",
+		TTL:      fmt.Sprintf("%ds", ttl),
+		Behavior: consul_api.SessionBehaviorDelete,
+		// Default is 15 seconds, which would block re-acquiring keys after a restart.
+		LockDelay: time.Millisecond,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	session := &consulSession{id: session_id, created: k.now()}
+	k.sessions[ttl] = session
+	// If this process dies, the session stops being renewed and Consul deletes the keys once it expires.
+	go func() {
+		for {
+			time.Sleep(session_ttl / 2)
+			if k.now().Sub(session.created) >= 2*session_ttl {
+				return
+			}
+			entry, _, err := k.Client.Session().Renew(session_id, nil)
+			if err == nil && entry == nil {
+				err = consul_api.ErrSessionExpired
+			}
+			if err != nil {
+				log.Printf("WARNING: consul: Session '%s' is no longer being renewed: %v", session_id, err)
+				k.sessionsMutex.Lock()
+				defer k.sessionsMutex.Unlock()
+				if k.sessions[ttl] == session {
+					delete(k.sessions, ttl)
+				}
+				return
+			}
+		}
+	}()
+	return session_id, nil
+}
+
+// Acquire the key against our session, taking it over from any other session holding it
+// (eg. from before a restart, or our previous session). Otherwise that session would delete it on expiry.
+func (k *KvBackendConsul) acquire(use_key string, value []byte, session_id string) error {
+	for i := 0; i < consulAcquireAttempts; i++ {
+		pair := &consul_api.KVPair{
+			Key:     use_key,
+			Value:   value,
+			Session: session_id,
+		}
+		acquired, _, err := k.Client.KV().Acquire(pair, nil)
+		if err != nil {
+			return err
+		}
+		if acquired == true {
+			return nil
+		}
+		existing, _, err := k.Client.KV().Get(use_key, nil)
+		if err != nil {
+			return err
+		}
+		if existing == nil || len(existing.Session) == 0 {
+			continue
+		}
+		log.Printf("consul.acquire(): '%s' is held by session '%s', releasing it.\n", use_key, existing.Session)
+		_, _, err = k.Client.KV().Release(existing, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("consul: Unable to acquire '%s' after %d attempts", use_key, consulAcquireAttempts)
+}
+
+func (k *KvBackendConsul) Write(key string, value string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("consul.Write(): Writing '%s' key value", use_key)
+	session_id, err := k.getSession(ttl)
+	if err != nil {
+		return err
+	}
+	return k.acquire(use_key, []byte(value), session_id)
+}
+
+// Keys expire with the session holding them, so move the key to the current session if required.
+func (k *KvBackendConsul) Refresh(key string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("consul.Refresh(): Refreshing '%s' key TTL", use_key)
+	session_id, err := k.getSession(ttl)
+	if err != nil {
+		return err
+	}
+	pair, _, err := k.Client.KV().Get(use_key, nil)
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return errors.New("KEY_NOT_FOUND")
+	}
+	if pair.Session == session_id {
+		return nil
+	}
+	return k.acquire(use_key, pair.Value, session_id)
+}
+
+func (k *KvBackendConsul) Delete(key string) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("consul.Delete(): Deleting '%s' key value", use_key)
+	_, err := k.Client.KV().Delete(use_key, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
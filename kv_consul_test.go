@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testConsulPair struct {
+	Key     string
+	Value   []byte
+	Session string `json:",omitempty"`
+}
+
+// Just enough of the Consul KV and Session HTTP API to exercise KvBackendConsul.
+type testConsulServer struct {
+	sync.Mutex
+	pairs    map[string]testConsulPair
+	sessions map[string]map[string]interface{}
+}
+
+func (s *testConsulServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		var entry map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		session_id := fmt.Sprintf("session-%d", len(s.sessions)+1)
+		s.sessions[session_id] = entry
+		fmt.Fprintf(w, "{\"ID\":\"%s\"}", session_id)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		session_id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		if _, ok := s.sessions[session_id]; ok == false {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "[{\"ID\":\"%s\"}]", session_id)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case "GET":
+			var results []testConsulPair
+			for k, v := range s.pairs {
+				if k == key || (r.URL.Query()["recurse"] != nil && strings.HasPrefix(k, key)) {
+					results = append(results, v)
+				}
+			}
+			if len(results) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(results)
+		case "PUT":
+			value, _ := ioutil.ReadAll(r.Body)
+			if release_id := r.URL.Query().Get("release"); len(release_id) > 0 {
+				existing, ok := s.pairs[key]
+				if ok == false || existing.Session != release_id {
+					fmt.Fprint(w, "false")
+					return
+				}
+				s.pairs[key] = testConsulPair{Key: key, Value: value}
+				fmt.Fprint(w, "true")
+				return
+			}
+			session_id := r.URL.Query().Get("acquire")
+			if existing, ok := s.pairs[key]; ok == true && len(session_id) > 0 && len(existing.Session) > 0 && existing.Session != session_id {
+				fmt.Fprint(w, "false")
+				return
+			}
+			if len(session_id) == 0 {
+				session_id = s.pairs[key].Session
+			}
+			s.pairs[key] = testConsulPair{Key: key, Value: value, Session: session_id}
+			fmt.Fprint(w, "true")
+		case "DELETE":
+			delete(s.pairs, key)
+			fmt.Fprint(w, "true")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func getTestConsulKvBackend(t *testing.T) (KvBackend, *testConsulServer, func()) {
+	test_consul := &testConsulServer{
+		pairs:    make(map[string]testConsulPair),
+		sessions: make(map[string]map[string]interface{}),
+	}
+	server := httptest.NewServer(test_consul)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_kv_backend, err := CreateKvBackend(map[string]string{
+		"backend": "consul",
+		"host":    host,
+		"port":    port,
+		"prefix":  "fs_test_registrations",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test_kv_backend, test_consul, server.Close
+}
+
+func TestKvBackendConsul(t *testing.T) {
+	test_kv_backend, test_consul, cleanup := getTestConsulKvBackend(t)
+	defer cleanup()
+	if test_kv_backend.BackendName() != "consul" {
+		t.Error("Expected a return type of consul, got", test_kv_backend.BackendName())
+	}
+	if test_kv_backend.GetPrefix() != "fs_test_registrations" {
+		t.Error("Expected a prefix of fs_test_registrations, got", test_kv_backend.GetPrefix())
+	}
+
+	// Nothing written yet.
+	_, err := test_kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Fatal("Expected KEY_NOT_FOUND error, got", err)
+	}
+
+	// Keys outside of our prefix should never be returned.
+	test_consul.Lock()
+	test_consul.pairs["fs_test_registrations_other/1003@domain"] = testConsulPair{Key: "fs_test_registrations_other/1003@domain", Value: []byte("{}")}
+	test_consul.Unlock()
+
+	expected_result1 := map[string]string{
+		"1001@domain": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+		"1002@domain": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+	}
+	for k, v := range expected_result1 {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result1, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(*result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", *result1)
+	}
+
+	// Both keys should be held by a single session with the requested TTL, that deletes keys on expiry.
+	test_consul.Lock()
+	if len(test_consul.sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d: %+v", len(test_consul.sessions), test_consul.sessions)
+	}
+	for session_id, session := range test_consul.sessions {
+		if session["TTL"] != "300s" || session["Behavior"] != "delete" {
+			t.Error("Expected a session with TTL 300s and Behavior delete, got", session)
+		}
+		for _, k := range []string{"fs_test_registrations/1001@domain", "fs_test_registrations/1002@domain"} {
+			if test_consul.pairs[k].Session != session_id {
+				t.Errorf("Expected '%s' to be held by session '%s', got '%s'", k, session_id, test_consul.pairs[k].Session)
+			}
+		}
+	}
+	test_consul.Unlock()
+
+	// Single key lookup.
+	result2, err := test_kv_backend.Read("1001@domain", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_result2 := map[string]string{
+		"1001@domain": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+	}
+	if reflect.DeepEqual(*result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", *result2)
+	}
+
+	// TTLs below the Consul minimum get a separate (clamped) session.
+	if err := test_kv_backend.Write("1004@domain", "{}", 5); err != nil {
+		t.Fatal(err)
+	}
+	var session_ttls []string
+	test_consul.Lock()
+	for _, session := range test_consul.sessions {
+		session_ttls = append(session_ttls, session["TTL"].(string))
+	}
+	test_consul.Unlock()
+	sort.Strings(session_ttls)
+	expected_session_ttls := []string{"10s", "300s"}
+	if reflect.DeepEqual(session_ttls, expected_session_ttls) != true {
+		t.Error("Expected session TTLs", expected_session_ttls, "got", session_ttls)
+	}
+
+	// And deletes.
+	for _, k := range []string{"1001@domain", "1002@domain", "1004@domain"} {
+		if err := test_kv_backend.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = test_kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Fatal("Expected KEY_NOT_FOUND error, got", err)
+	}
+}
+
+func TestKvBackendConsulSessions(t *testing.T) {
+	test_kv_backend, test_consul, cleanup := getTestConsulKvBackend(t)
+	defer cleanup()
+	now := time.Now()
+	test_kv_backend.(*KvBackendConsul).now = func() time.Time { return now }
+
+	// A key still held by the session of a previous run should be taken over, not left to expire with it.
+	test_consul.Lock()
+	test_consul.sessions["session-old"] = map[string]interface{}{}
+	test_consul.pairs["fs_test_registrations/1001@domain"] = testConsulPair{Key: "fs_test_registrations/1001@domain", Value: []byte("{}"), Session: "session-old"}
+	test_consul.Unlock()
+	if err := test_kv_backend.Write("1001@domain", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := test_kv_backend.Write("1002@domain", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300); err != nil {
+		t.Fatal(err)
+	}
+	getSessions := func() map[string]string {
+		test_consul.Lock()
+		defer test_consul.Unlock()
+		sessions := make(map[string]string)
+		for k, v := range test_consul.pairs {
+			sessions[strings.TrimPrefix(k, "fs_test_registrations/")] = v.Session
+		}
+		return sessions
+	}
+	expected_sessions1 := map[string]string{"1001@domain": "session-2", "1002@domain": "session-2"}
+	if sessions := getSessions(); reflect.DeepEqual(sessions, expected_sessions1) != true {
+		t.Error("Expected", expected_sessions1, "got", sessions)
+	}
+	test_consul.Lock()
+	if value := string(test_consul.pairs["fs_test_registrations/1001@domain"].Value); value != "{\"host\":\"10.0.0.1\",\"port\":5060}" {
+		t.Error("Expected the value to be updated, got", value)
+	}
+	test_consul.Unlock()
+
+	// Once a session has been used for a TTL, a new one takes over and refreshes move keys to it.
+	// Keys that are not refreshed stay with the old session, and expire with it.
+	now = now.Add(300 * time.Second)
+	if err := test_kv_backend.Refresh("1001@domain", 300); err != nil {
+		t.Fatal(err)
+	}
+	expected_sessions2 := map[string]string{"1001@domain": "session-3", "1002@domain": "session-2"}
+	if sessions := getSessions(); reflect.DeepEqual(sessions, expected_sessions2) != true {
+		t.Error("Expected", expected_sessions2, "got", sessions)
+	}
+
+	// Refreshing a deleted key should not recreate it.
+	if err := test_kv_backend.Delete("1002@domain"); err != nil {
+		t.Fatal(err)
+	}
+	err := test_kv_backend.Refresh("1002@domain", 300)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND error, got", err)
+	}
+	expected_sessions3 := map[string]string{"1001@domain": "session-3"}
+	if sessions := getSessions(); reflect.DeepEqual(sessions, expected_sessions3) != true {
+		t.Error("Expected", expected_sessions3, "got", sessions)
+	}
+}
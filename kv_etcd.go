@@ -5,7 +5,6 @@ import (
 	"fmt"
 	etcd_client "github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
-	"log"
 	"strings"
 	"time"
 )
@@ -68,43 +67,53 @@ func (k *KvBackendEtcd) Read(key string, recursive bool) (*map[string]string, er
 	//log.Printf("%q key has %q value\n", resp.Node.Key, resp.Node.Value)
 	//log.Printf("Count of child nodes: %d\n", len(resp.Node.Nodes))
 	if resp.Node.Dir == true {
-		for _, v := range resp.Node.Nodes {
-			// We only support a single layer of keys under a single parent directory currently, as opposed to recursive keys.
-			// Can support more layers in future as required (using a separate function call), this use case doesn't require it.
-			if v.Dir == true {
-				return new(map[string]string), errors.New("UNSUPPORTED_CHILD_KEY_AS_DIRECTORY")
-			}
-			results[stripKvKeyPrefix(k.Prefix, v.Key)] = v.Value
-		}
+		flattenEtcdNodes(k.Prefix, resp.Node.Nodes, results)
 	} else {
-		result_key := stripKvKeyPrefix(k.Prefix, resp.Node.Key)
-		if len(result_key) == 0 {
-			// If we strip the prefix, there would be no key at all. Leave it in place, just remove leading slash instead.
-			// This use case should be rare in this app.
-			if resp.Node.Key[0:1] == "/" && len(resp.Node.Key) > 1 {
-				result_key = resp.Node.Key[1:]
-			} else {
-				result_key = resp.Node.Key
-			}
-		}
-		results[result_key] = resp.Node.Value
+		results[getKvResultKey(k.Prefix, resp.Node.Key)] = resp.Node.Value
 	}
 	return &results, nil
 }
 
+// Registrations are stored as user@domain/ip:port, so each AOR is a directory of keys.
+// Adds every key below nodes to results, skipping empty directories.
+func flattenEtcdNodes(prefix string, nodes etcd_client.Nodes, results map[string]string) {
+	for _, v := range nodes {
+		if v.Dir == true {
+			flattenEtcdNodes(prefix, v.Nodes, results)
+			continue
+		}
+		results[stripKvKeyPrefix(prefix, v.Key)] = v.Value
+	}
+}
+
+// A ttl of 0 means the key never expires.
 func (k *KvBackendEtcd) Write(key string, value string, ttl int) error {
 	use_key := getKvKeyWithPrefix(k.Prefix, key)
 	//log.Printf("etcd.Write(): Writing '%s' key value", use_key)
-	resp, err := k.Kapi.Set(context.Background(), use_key, value, nil)
+	resp, err := k.Kapi.Set(context.Background(), use_key, value, &etcd_client.SetOptions{
+		TTL: time.Duration(ttl) * time.Second,
+	})
 	if err != nil {
 		return err
 	} else {
 		// print common key info
-		log.Printf("Set is done. Metadata is %q\n", resp)
+		logDebugf("Set is done. Metadata is %+v\n", resp)
 	}
 	return nil
 }
 
+func (k *KvBackendEtcd) Refresh(key string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("etcd.Refresh(): Refreshing '%s' key TTL", use_key)
+	// A refresh only updates the TTL (the value must be empty), and fails if the key no longer exists.
+	_, err := k.Kapi.Set(context.Background(), use_key, "", &etcd_client.SetOptions{
+		TTL:       time.Duration(ttl) * time.Second,
+		Refresh:   true,
+		PrevExist: etcd_client.PrevExist,
+	})
+	return err
+}
+
 func (k *KvBackendEtcd) Delete(key string) error {
 	use_key := getKvKeyWithPrefix(k.Prefix, key)
 	//log.Printf("etcd.Delete(): Deleting '%s' key value", use_key)
@@ -113,7 +122,12 @@ func (k *KvBackendEtcd) Delete(key string) error {
 		return err
 	} else {
 		// print common key info
-		log.Printf("Delete is done. Metadata is %q\n", resp)
+		logDebugf("Delete is done. Metadata is %+v\n", resp)
+	}
+	// Directories don't expire or go away by themselves, remove the parent if this was the last key in it.
+	// This fails harmlessly if other keys remain (eg. the AOR is registered on another instance).
+	if i := strings.LastIndex(key, "/"); i > 0 {
+		k.Kapi.Delete(context.Background(), getKvKeyWithPrefix(k.Prefix, key[:i]), &etcd_client.DeleteOptions{Dir: true})
 	}
 	return nil
 }
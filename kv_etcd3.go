@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	etcd_clientv3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// Fail fast when the target endpoint is unavailable.
+const etcd3RequestTimeout = 5 * time.Second
+
+// Uses the etcd v3 (gRPC) API, for clusters that have the v2 API disabled.
+type KvBackendEtcd3 struct {
+	Client *etcd_clientv3.Client
+	Prefix string
+	// Lease ID per TTL, kept alive while this process is running.
+	leases      map[int]etcd_clientv3.LeaseID
+	leasesMutex sync.Mutex
+}
+
+func NewKvBackendEtcd3(conf map[string]string) (KvBackend, error) {
+	for _, v := range []string{"host", "port", "prefix"} {
+		if _, ok := conf[v]; ok == false {
+			return nil, fmt.Errorf("etcd3: '%s' key does not exist in conf.", v)
+		}
+	}
+	c, err := etcd_clientv3.New(etcd_clientv3.Config{
+		// TODO: do we want to specify multiple etcd hosts?
+		Endpoints:   []string{fmt.Sprintf("http://%s:%s", conf["host"], conf["port"])},
+		DialTimeout: etcd3RequestTimeout,
+		// Optional, via --kvoption
+		Username: conf["username"],
+		Password: conf["password"],
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KvBackendEtcd3{
+		Client: c,
+		Prefix: conf["prefix"],
+		leases: make(map[int]etcd_clientv3.LeaseID),
+	}, nil
+}
+
+func (k *KvBackendEtcd3) BackendName() string {
+	return "etcd3"
+}
+
+func (k *KvBackendEtcd3) GetPrefix() string {
+	return k.Prefix
+}
+
+// If the key is a prefix (recursive lookup), set recursive = true
+// Results will be key/value in a map.
+func (k *KvBackendEtcd3) Read(key string, recursive bool) (*map[string]string, error) {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("etcd3.Read(): Getting '%s' key value (recursive: %t)", use_key, recursive)
+	results := make(map[string]string)
+	if recursive == true {
+		// The trailing slash stops a prefix of "foo" also matching "foobar".
+		err := k.readInto(results, fmt.Sprintf("%s/", use_key), etcd_clientv3.WithPrefix())
+		if err != nil {
+			return &results, err
+		}
+		if len(results) > 0 {
+			return &results, nil
+		}
+	}
+	// Either a single key lookup, or a recursive lookup where the key is not a prefix.
+	err := k.readInto(results, use_key)
+	if err != nil {
+		return &results, err
+	}
+	// Matches the v2 API behaviour, which syncRegistrations() relies on.
+	if len(results) == 0 {
+		return &results, errors.New("KEY_NOT_FOUND")
+	}
+	return &results, nil
+}
+
+// Adds the keys found for use_key to results, without the prefix.
+func (k *KvBackendEtcd3) readInto(results map[string]string, use_key string, get_options ...etcd_clientv3.OpOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	resp, err := k.Client.Get(ctx, use_key, get_options...)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for _, v := range resp.Kvs {
+		results[getKvResultKey(k.Prefix, string(v.Key))] = string(v.Value)
+	}
+	return nil
+}
+
+// Returns a lease for the requested TTL, granting (and keeping alive in the background) one if required.
+func (k *KvBackendEtcd3) getLease(ttl int) (etcd_clientv3.LeaseID, error) {
+	k.leasesMutex.Lock()
+	defer k.leasesMutex.Unlock()
+	if lease_id, ok := k.leases[ttl]; ok == true {
+		return lease_id, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	resp, err := k.Client.Grant(ctx, int64(ttl))
+	cancel()
+	if err != nil {
+		return etcd_clientv3.NoLease, err
+	}
+	// If this process dies, the lease stops being kept alive and etcd deletes the keys once it expires.
+	keep_alive, err := k.Client.KeepAlive(context.Background(), resp.ID)
+	if err != nil {
+		return etcd_clientv3.NoLease, err
+	}
+	k.leases[ttl] = resp.ID
+	go func() {
+		for range keep_alive {
+			// Drain the responses, the channel is closed once the lease can no longer be kept alive.
+		}
+		log.Printf("WARNING: etcd3: Lease '%x' is no longer being kept alive.", resp.ID)
+		k.leasesMutex.Lock()
+		defer k.leasesMutex.Unlock()
+		if k.leases[ttl] == resp.ID {
+			delete(k.leases, ttl)
+		}
+	}()
+	return resp.ID, nil
+}
+
+// A ttl of 0 means the key never expires.
+func (k *KvBackendEtcd3) Write(key string, value string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("etcd3.Write(): Writing '%s' key value", use_key)
+	var put_options []etcd_clientv3.OpOption
+	if ttl > 0 {
+		lease_id, err := k.getLease(ttl)
+		if err != nil {
+			return err
+		}
+		put_options = append(put_options, etcd_clientv3.WithLease(lease_id))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	_, err := k.Client.Put(ctx, use_key, value, put_options...)
+	cancel()
+	return err
+}
+
+// Keys are attached to a lease that is kept alive in the background. If that lease has since been dropped (eg. it
+// couldn't be kept alive during an outage), the key is attached to the current one instead.
+func (k *KvBackendEtcd3) Refresh(key string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("etcd3.Refresh(): Refreshing '%s' key TTL", use_key)
+	ctx, cancel := context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	resp, err := k.Client.Get(ctx, use_key)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return errors.New("KEY_NOT_FOUND")
+	}
+	if ttl == 0 {
+		return nil
+	}
+	lease_id, err := k.getLease(ttl)
+	if err != nil {
+		return err
+	}
+	if etcd_clientv3.LeaseID(resp.Kvs[0].Lease) == lease_id {
+		return nil
+	}
+	// Only if unchanged since the Get, so a key deleted in the meantime isn't recreated.
+	ctx, cancel = context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	txn_resp, err := k.Client.Txn(ctx).
+		If(etcd_clientv3.Compare(etcd_clientv3.ModRevision(use_key), "=", resp.Kvs[0].ModRevision)).
+		Then(etcd_clientv3.OpPut(use_key, string(resp.Kvs[0].Value), etcd_clientv3.WithLease(lease_id))).
+		Commit()
+	cancel()
+	if err != nil {
+		return err
+	}
+	if txn_resp.Succeeded == false {
+		return fmt.Errorf("etcd3: '%s' changed while refreshing", use_key)
+	}
+	return nil
+}
+
+func (k *KvBackendEtcd3) Delete(key string) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("etcd3.Delete(): Deleting '%s' key value", use_key)
+	ctx, cancel := context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	_, err := k.Client.Delete(ctx, use_key)
+	cancel()
+	return err
+}
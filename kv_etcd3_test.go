@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func getTestEtcd3KvBackend(t *testing.T) KvBackend {
+	skipWithoutDocker(t)
+	if _, ok := dockerContainerPorts["etcd_1-2379/tcp"]; ok == false {
+		t.Fatal("Docker Container port for etcd not found in dockerContainerPorts, did the container start?")
+	}
+	test_kv_backend, err := CreateKvBackend(map[string]string{
+		"backend": "etcd3",
+		"host":    dockerHost,
+		"port":    strconv.Itoa(int(dockerContainerPorts["etcd_1-2379/tcp"])),
+		"prefix":  "fs_test_registrations_v3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test_kv_backend
+}
+
+func TestKvBackendEtcd3(t *testing.T) {
+	test_kv_backend := getTestEtcd3KvBackend(t)
+	if test_kv_backend.BackendName() != "etcd3" {
+		t.Error("Expected a return type of etcd3, got", test_kv_backend.BackendName())
+	}
+	if test_kv_backend.GetPrefix() != "fs_test_registrations_v3" {
+		t.Error("Expected a .Prefix of fs_test_registrations_v3, got", test_kv_backend.GetPrefix())
+	}
+
+	// Nothing written yet.
+	_, err := test_kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Fatal("Expected KEY_NOT_FOUND error, got", err)
+	}
+
+	expected_result1 := map[string]string{
+		"1001@domain": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+		"1002@domain": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+	}
+	for k, v := range expected_result1 {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Shares the start of our prefix, but is outside of it.
+	test_client := test_kv_backend.(*KvBackendEtcd3).Client
+	if _, err := test_client.Put(context.Background(), "fs_test_registrations_v3_other", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	defer test_client.Delete(context.Background(), "fs_test_registrations_v3_other")
+	result1, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(*result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", *result1)
+	}
+
+	// Single key lookup.
+	expected_result2 := map[string]string{
+		"1001@domain": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+	}
+	result2, err := test_kv_backend.Read("1001@domain", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(*result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", *result2)
+	}
+
+	// Both keys should share a single lease.
+	if len(test_kv_backend.(*KvBackendEtcd3).leases) != 1 {
+		t.Error("Expected a single lease, got", test_kv_backend.(*KvBackendEtcd3).leases)
+	}
+
+	// And deletes.
+	for k, _ := range expected_result1 {
+		if err := test_kv_backend.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = test_kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Fatal("Expected KEY_NOT_FOUND error, got", err)
+	}
+}
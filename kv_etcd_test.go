@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	etcd_client "github.com/coreos/etcd/client"
+)
+
+func TestFlattenEtcdNodes(t *testing.T) {
+	input := etcd_client.Nodes{
+		&etcd_client.Node{Key: "/fs_registrations/1000@domain", Dir: true, Nodes: etcd_client.Nodes{
+			&etcd_client.Node{Key: "/fs_registrations/1000@domain/10.0.0.1:5060", Value: "a"},
+			&etcd_client.Node{Key: "/fs_registrations/1000@domain/10.0.0.2:5060", Value: "b"},
+		}},
+		// Left behind once all of an AOR's keys have expired.
+		&etcd_client.Node{Key: "/fs_registrations/1001@domain", Dir: true},
+		// From before per-instance keys.
+		&etcd_client.Node{Key: "/fs_registrations/1002@domain", Value: "c"},
+	}
+	expected_result := map[string]string{
+		"1000@domain/10.0.0.1:5060": "a",
+		"1000@domain/10.0.0.2:5060": "b",
+		"1002@domain":               "c",
+	}
+	result := make(map[string]string)
+	flattenEtcdNodes("fs_registrations", input, result)
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Format of Kamailio's DATETIME columns, in local time (as Kamailio writes them).
+const kamailioDatetimeFormat = "2006-01-02 15:04:05"
+
+// Kamailio's default (and largest) expires value, for keys that never expire.
+const kamailioMaxExpires = "2030-05-28 21:32:15"
+
+// ruid is a VARCHAR(64), leaving 40 characters for the SHA-1 of the key.
+const kamailioMaxPrefixLength = 23
+
+var kamailioTableRegexp = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+// Writes registrations into Kamailio's usrloc "location" table (db_mode 3, ie. DB only), so the proxy's
+// lookup("location") finds them directly. Each row is the contact of the registered device (or
+// sip:<user>@<host>:<port> if not known), with received set to its network IP/port and path set to
+// <sip:<host>:<port>;lr;fsprofile=<profile>>, so Kamailio uses the FreeSWITCH instance as the next hop.
+// Our rows are identified by a ruid of <prefix>/<sha1 of key>, anything else in the table is ignored.
+// Keys from before per-instance keys (ie. just user@domain) aren't supported.
+type KvBackendKamailio struct {
+	Db     *sql.DB
+	Prefix string
+	Table  string
+	// Kamailio socket (eg. udp:10.0.0.10:5060) to send requests to the FreeSWITCH instances from, empty for any.
+	Socket string
+	now    func() time.Time
+}
+
+// Optional conf keys (via --kvoption): driver (sqlite3 (default) or mysql), dsn (required for sqlite3, the database
+// file), table (default location) and socket. For mysql, the dsn defaults to host/port with user (default kamailio),
+// password and database (default kamailio).
+func NewKvBackendKamailio(conf map[string]string) (KvBackend, error) {
+	for _, v := range []string{"host", "port", "prefix"} {
+		if _, ok := conf[v]; ok == false {
+			return nil, fmt.Errorf("kamailio: '%s' key does not exist in conf.", v)
+		}
+	}
+	if len(conf["prefix"]) > kamailioMaxPrefixLength {
+		return nil, fmt.Errorf("kamailio: 'prefix' must be at most %d characters, got '%s'.", kamailioMaxPrefixLength, conf["prefix"])
+	}
+	table := "location"
+	if len(conf["table"]) > 0 {
+		table = conf["table"]
+	}
+	if kamailioTableRegexp.MatchString(table) == false {
+		return nil, fmt.Errorf("kamailio: Invalid 'table' '%s'.", table)
+	}
+	driver := "sqlite3"
+	if len(conf["driver"]) > 0 {
+		driver = conf["driver"]
+	}
+	dsn := conf["dsn"]
+	switch driver {
+	case "sqlite3":
+		if len(dsn) == 0 {
+			return nil, errors.New("kamailio: 'dsn' (the database file) must be set for sqlite3.")
+		}
+	case "mysql":
+		if len(dsn) == 0 {
+			mysql_config := mysql.NewConfig()
+			mysql_config.Net = "tcp"
+			mysql_config.Addr = net.JoinHostPort(conf["host"], conf["port"])
+			mysql_config.User = "kamailio"
+			if len(conf["user"]) > 0 {
+				mysql_config.User = conf["user"]
+			}
+			mysql_config.Passwd = conf["password"]
+			mysql_config.DBName = "kamailio"
+			if len(conf["database"]) > 0 {
+				mysql_config.DBName = conf["database"]
+			}
+			dsn = mysql_config.FormatDSN()
+		}
+	default:
+		return nil, fmt.Errorf("kamailio: 'driver' must be one of sqlite3, mysql, got '%s'.", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite only allows a single writer, avoid "database is locked" errors between our goroutines.
+		db.SetMaxOpenConns(1)
+	}
+	return &KvBackendKamailio{
+		Db:     db,
+		Prefix: conf["prefix"],
+		Table:  table,
+		Socket: conf["socket"],
+		now:    time.Now,
+	}, nil
+}
+
+func (k *KvBackendKamailio) BackendName() string {
+	return "kamailio"
+}
+
+func (k *KvBackendKamailio) GetPrefix() string {
+	return k.Prefix
+}
+
+func (k *KvBackendKamailio) getRuid(key string) string {
+	return fmt.Sprintf("%s/%x", k.Prefix, sha1.Sum([]byte(key)))
+}
+
+// Splits a per-instance key into its parts.
+func splitKamailioKey(key string) (user string, domain string, host string, port int, err error) {
+	aor, instance, err := splitRegistrationKey(key)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	i := strings.LastIndex(aor, "@")
+	if i == -1 {
+		return "", "", "", 0, fmt.Errorf("Invalid AOR '%s'.", aor)
+	}
+	host, port_string, err := net.SplitHostPort(instance)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	port, err = strconv.Atoi(port_string)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	return aor[:i], aor[i+1:], host, port, nil
+}
+
+// eg. sip:10.0.0.1:5060 or <sip:10.0.0.1:5060;lr> -> 10.0.0.1, 5060
+func parseKamailioUri(uri string) (string, int, error) {
+	host_port := strings.TrimPrefix(strings.Trim(uri, "<>"), "sip:")
+	if i := strings.Index(host_port, ";"); i != -1 {
+		host_port = host_port[:i]
+	}
+	host, port_string, err := net.SplitHostPort(host_port)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid URI '%s'.", uri)
+	}
+	port, err := strconv.Atoi(port_string)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid URI '%s'.", uri)
+	}
+	return host, port, nil
+}
+
+// The value of a URI parameter (eg. ;fsprofile=internal), empty if not present.
+func getKamailioUriParam(uri string, name string) string {
+	for _, v := range strings.Split(strings.Trim(uri, "<>"), ";")[1:] {
+		split_v := strings.SplitN(v, "=", 2)
+		if split_v[0] == name && len(split_v) == 2 {
+			return split_v[1]
+		}
+	}
+	return ""
+}
+
+// Written as the contact when the device's contact isn't known, and read back as no contact.
+func getKamailioFallbackContact(user string, host string, port int) string {
+	return fmt.Sprintf("sip:%s@%s", user, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// DATETIME columns come back as strings or []byte (mysql), or time.Time (sqlite3, parsed as UTC).
+func parseKamailioDatetime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+	case []byte:
+		return time.ParseInLocation(kamailioDatetimeFormat, string(t), time.Local)
+	case string:
+		return time.ParseInLocation(kamailioDatetimeFormat, t, time.Local)
+	}
+	return time.Time{}, fmt.Errorf("Unsupported DATETIME value %v (%T).", v, v)
+}
+
+// If the key is a prefix (recursive lookup), set recursive = true
+// Results will be key/value in a map. Expired rows are excluded.
+func (k *KvBackendKamailio) Read(key string, recursive bool) (*map[string]string, error) {
+	results := make(map[string]string)
+	query := fmt.Sprintf("SELECT username, domain, contact, received, path, expires, last_modified, user_agent FROM %s WHERE SUBSTR(ruid, 1, ?) = ? AND expires > ?", k.Table)
+	args := []interface{}{len(k.Prefix) + 1, k.Prefix + "/", k.now().Format(kamailioDatetimeFormat)}
+	if len(key) > 0 {
+		if _, _, _, _, err := splitKamailioKey(key); err == nil {
+			query += " AND ruid = ?"
+			args = append(args, k.getRuid(key))
+		} else if i := strings.LastIndex(key, "@"); i != -1 && strings.Contains(key, "/") == false && recursive == true {
+			query += " AND username = ? AND domain = ?"
+			args = append(args, key[:i], key[i+1:])
+		} else {
+			// Nothing else (eg. keys from before per-instance keys) can be stored.
+			return &results, errors.New("KEY_NOT_FOUND")
+		}
+	}
+	rows, err := k.Db.Query(query, args...)
+	if err != nil {
+		return &results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user, contact, path string
+		var domain, received, user_agent sql.NullString
+		var expires, last_modified interface{}
+		err = rows.Scan(&user, &domain, &contact, &received, &path, &expires, &last_modified, &user_agent)
+		if err != nil {
+			return &results, err
+		}
+		var value KvBackendValue
+		value.Host, value.Port, err = parseKamailioUri(path)
+		if err != nil {
+			return &results, err
+		}
+		value.Profile = getKamailioUriParam(path, "fsprofile")
+		if contact != getKamailioFallbackContact(user, value.Host, value.Port) {
+			value.Contact = contact
+		}
+		value.UserAgent = user_agent.String
+		if received.Valid == true && len(received.String) > 0 {
+			value.NetworkIp, value.NetworkPort, err = parseKamailioUri(received.String)
+			if err != nil {
+				return &results, err
+			}
+		}
+		expires_time, err := parseKamailioDatetime(expires)
+		if err != nil {
+			return &results, err
+		}
+		if expires_time.Format(kamailioDatetimeFormat) != kamailioMaxExpires {
+			value.Expires = expires_time.Unix()
+		}
+		last_modified_time, err := parseKamailioDatetime(last_modified)
+		if err != nil {
+			return &results, err
+		}
+		value.RecordedAt = last_modified_time.Unix()
+		encoded_value, err := json.Marshal(value)
+		if err != nil {
+			return &results, err
+		}
+		results[getRegistrationKey(fmt.Sprintf("%s@%s", user, domain.String), value.Host, value.Port)] = string(encoded_value)
+	}
+	err = rows.Err()
+	if err != nil {
+		return &results, err
+	}
+	if len(results) == 0 {
+		return &results, errors.New("KEY_NOT_FOUND")
+	}
+	return &results, nil
+}
+
+func (k *KvBackendKamailio) getExpires(ttl int) string {
+	if ttl == 0 {
+		return kamailioMaxExpires
+	}
+	return k.now().Add(time.Duration(ttl) * time.Second).Format(kamailioDatetimeFormat)
+}
+
+// A ttl of 0 means the key never expires. Only per-instance keys (user@domain/host:port) can be written.
+func (k *KvBackendKamailio) Write(key string, value string, ttl int) error {
+	user, domain, host, port, err := splitKamailioKey(key)
+	if err != nil {
+		return fmt.Errorf("kamailio: Unsupported key '%s', expected user@domain/host:port.", key)
+	}
+	var decoded_value KvBackendValue
+	err = json.Unmarshal([]byte(value), &decoded_value)
+	if err != nil {
+		return err
+	}
+	contact := decoded_value.Contact
+	if len(contact) == 0 {
+		contact = getKamailioFallbackContact(user, host, port)
+	}
+	var received string
+	if len(decoded_value.NetworkIp) > 0 {
+		received = fmt.Sprintf("sip:%s", net.JoinHostPort(decoded_value.NetworkIp, strconv.Itoa(decoded_value.NetworkPort)))
+	}
+	path := fmt.Sprintf("sip:%s;lr", net.JoinHostPort(host, strconv.Itoa(port)))
+	if len(decoded_value.Profile) > 0 {
+		path += fmt.Sprintf(";fsprofile=%s", decoded_value.Profile)
+	}
+	path = fmt.Sprintf("<%s>", path)
+	ruid := k.getRuid(key)
+
+	tx, err := k.Db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE ruid = ?", k.Table), ruid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		fmt.Sprintf("INSERT INTO %s (ruid, username, domain, contact, received, path, expires, last_modified, user_agent, socket) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", k.Table),
+		ruid, user, domain, contact, received, path, k.getExpires(ttl), k.now().Format(kamailioDatetimeFormat), decoded_value.UserAgent, k.Socket,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// A no-op if the row no longer exists.
+func (k *KvBackendKamailio) Refresh(key string, ttl int) error {
+	result, err := k.Db.Exec(fmt.Sprintf("UPDATE %s SET expires = ? WHERE ruid = ?", k.Table), k.getExpires(ttl), k.getRuid(key))
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("KEY_NOT_FOUND")
+	}
+	return nil
+}
+
+func (k *KvBackendKamailio) Delete(key string) error {
+	_, err := k.Db.Exec(fmt.Sprintf("DELETE FROM %s WHERE ruid = ?", k.Table), k.getRuid(key))
+	return err
+}
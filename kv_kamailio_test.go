@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// From Kamailio's utils/kamctl/sqlite/usrloc-create.sql
+const testKamailioLocationSchema = `CREATE TABLE location (
+    id INTEGER PRIMARY KEY NOT NULL,
+    ruid VARCHAR(64) DEFAULT '' NOT NULL,
+    username VARCHAR(64) DEFAULT '' NOT NULL,
+    domain VARCHAR(64) DEFAULT NULL,
+    contact VARCHAR(512) DEFAULT '' NOT NULL,
+    received VARCHAR(128) DEFAULT NULL,
+    path VARCHAR(512) DEFAULT NULL,
+    expires TIMESTAMP WITHOUT TIME ZONE DEFAULT '2030-05-28 21:32:15' NOT NULL,
+    q REAL DEFAULT 1.0 NOT NULL,
+    callid VARCHAR(255) DEFAULT 'Default-Call-ID' NOT NULL,
+    cseq INTEGER DEFAULT 1 NOT NULL,
+    last_modified TIMESTAMP WITHOUT TIME ZONE DEFAULT '2000-01-01 00:00:01' NOT NULL,
+    flags INTEGER DEFAULT 0 NOT NULL,
+    cflags INTEGER DEFAULT 0 NOT NULL,
+    user_agent VARCHAR(255) DEFAULT '' NOT NULL,
+    socket VARCHAR(64) DEFAULT NULL,
+    methods INTEGER DEFAULT NULL,
+    instance VARCHAR(255) DEFAULT NULL,
+    reg_id INTEGER DEFAULT 0 NOT NULL,
+    server_id INTEGER DEFAULT 0 NOT NULL,
+    connection_id INTEGER DEFAULT 0 NOT NULL,
+    keepalive INTEGER DEFAULT 0 NOT NULL,
+    partition INTEGER DEFAULT 0 NOT NULL,
+    CONSTRAINT location_ruid_idx UNIQUE (ruid)
+);`
+
+func getTestKamailioKvBackend(t *testing.T) (*KvBackendKamailio, func()) {
+	dir, err := ioutil.TempDir("", "fs-registrator-kamailio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv_backend, err := CreateKvBackend(map[string]string{
+		"backend": "kamailio",
+		"host":    "localhost",
+		"port":    "3306",
+		"prefix":  "fs_registrations",
+		"dsn":     filepath.Join(dir, "kamailio.sqlite"),
+		"socket":  "udp:10.0.0.10:5060",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kamailio_kv_backend := kv_backend.(*KvBackendKamailio)
+	_, err = kamailio_kv_backend.Db.Exec(testKamailioLocationSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kamailio_kv_backend, func() {
+		kamailio_kv_backend.Db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewKvBackendKamailio(t *testing.T) {
+	result, err := CreateKvBackend(map[string]string{"backend": "kamailio", "host": "db", "port": "3306", "prefix": "someprefix", "driver": "mysql", "password": "secret"})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if result.BackendName() != "kamailio" || result.GetPrefix() != "someprefix" {
+		t.Error("Expected kamailio and someprefix, got", result.BackendName(), result.GetPrefix())
+	}
+	invalid_confs := map[string]map[string]string{
+		"kamailio: 'dsn' (the database file) must be set for sqlite3.":                      {"backend": "kamailio", "host": "h", "port": "1", "prefix": "p"},
+		"kamailio: 'driver' must be one of sqlite3, mysql, got 'postgres'.":                 {"backend": "kamailio", "host": "h", "port": "1", "prefix": "p", "driver": "postgres"},
+		"kamailio: Invalid 'table' 'location; DROP TABLE location'.":                        {"backend": "kamailio", "host": "h", "port": "1", "prefix": "p", "dsn": "db", "table": "location; DROP TABLE location"},
+		"kamailio: 'prefix' must be at most 23 characters, got 'aaaaaaaaaaaaaaaaaaaaaaaa'.": {"backend": "kamailio", "host": "h", "port": "1", "prefix": "aaaaaaaaaaaaaaaaaaaaaaaa", "dsn": "db"},
+	}
+	for expected_err, conf := range invalid_confs {
+		_, err := CreateKvBackend(conf)
+		if err == nil || err.Error() != expected_err {
+			t.Error("Expected error of", expected_err, "got", err)
+		}
+	}
+}
+
+func TestParseKamailioDatetime(t *testing.T) {
+	expected_result := time.Date(2018, 3, 4, 5, 6, 7, 0, time.Local)
+	for _, v := range []interface{}{"2018-03-04 05:06:07", []byte("2018-03-04 05:06:07"), time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)} {
+		result, err := parseKamailioDatetime(v)
+		if err != nil || result.Equal(expected_result) == false {
+			t.Errorf("Expected %s for %v, got %s (%v)", expected_result, v, result, err)
+		}
+	}
+}
+
+func TestKvBackendKamailio(t *testing.T) {
+	kv_backend, cleanup := getTestKamailioKvBackend(t)
+	defer cleanup()
+	now := time.Date(2018, 3, 4, 5, 6, 7, 0, time.Local)
+	kv_backend.now = func() time.Time { return now }
+
+	_, err := kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND, got", err)
+	}
+
+	value1 := KvBackendValue{
+		Host:        "10.0.0.1",
+		Port:        5060,
+		Contact:     "sip:1000@192.168.1.10:5060;transport=udp",
+		UserAgent:   "Softphone 1.0",
+		NetworkIp:   "203.0.113.5",
+		NetworkPort: 41000,
+		Profile:     "internal",
+	}
+	encoded_value1, _ := json.Marshal(value1)
+	err = kv_backend.Write("1000@example.com/10.0.0.1:5060", string(encoded_value1), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written again, still only one row.
+	err = kv_backend.Write("1000@example.com/10.0.0.1:5060", string(encoded_value1), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv_backend.Write("1001@example.com/10.0.0.2:5080", "{\"host\":\"10.0.0.2\",\"port\":5080}", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written by Kamailio itself, not ours.
+	_, err = kv_backend.Db.Exec("INSERT INTO location (ruid, username, domain, contact, path) VALUES ('uloc-1', '1002', 'example.com', 'sip:1002@192.168.1.12', NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var row_count int
+	var contact, path, socket string
+	err = kv_backend.Db.QueryRow("SELECT COUNT(*) FROM location WHERE username = '1000'").Scan(&row_count)
+	if err != nil || row_count != 1 {
+		t.Error("Expected 1 row, got", row_count, err)
+	}
+	err = kv_backend.Db.QueryRow("SELECT contact, path, socket FROM location WHERE username = '1001'").Scan(&contact, &path, &socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact != "sip:1001@10.0.0.2:5080" || path != "<sip:10.0.0.2:5080;lr>" || socket != "udp:10.0.0.10:5060" {
+		t.Error("Expected sip:1001@10.0.0.2:5080, <sip:10.0.0.2:5080;lr> and udp:10.0.0.10:5060, got", contact, path, socket)
+	}
+
+	value1.Expires = now.Unix() + 300
+	value1.RecordedAt = now.Unix()
+	encoded_value1, _ = json.Marshal(value1)
+	expected_result1 := map[string]string{
+		"1000@example.com/10.0.0.1:5060": string(encoded_value1),
+		"1001@example.com/10.0.0.2:5080": "{\"host\":\"10.0.0.2\",\"port\":5080,\"expires\":" + strconv.FormatInt(now.Unix()+60, 10) + ",\"recorded_at\":" + strconv.FormatInt(now.Unix(), 10) + "}",
+	}
+	result1, err := kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(*result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", *result1)
+	}
+	err = kv_backend.Db.QueryRow("SELECT path FROM location WHERE username = '1000'").Scan(&path)
+	if err != nil || path != "<sip:10.0.0.1:5060;lr;fsprofile=internal>" {
+		t.Error("Expected <sip:10.0.0.1:5060;lr;fsprofile=internal>, got", path, err)
+	}
+	result2, err := kv_backend.Read("1000@example.com", true)
+	if err != nil || len(*result2) != 1 {
+		t.Error("Expected 1 result, got", *result2, err)
+	}
+	result3, err := kv_backend.Read("1001@example.com/10.0.0.2:5080", false)
+	if err != nil || len(*result3) != 1 {
+		t.Error("Expected 1 result, got", *result3, err)
+	}
+	for _, v := range []string{"1002@example.com", "_healthcheck"} {
+		_, err = kv_backend.Read(v, true)
+		if err == nil || err.Error() != "KEY_NOT_FOUND" {
+			t.Errorf("Expected KEY_NOT_FOUND for '%s', got %v", v, err)
+		}
+	}
+
+	// 1001 expires first, unless refreshed.
+	now = now.Add(100 * time.Second)
+	result4, err := kv_backend.Read("", true)
+	if err != nil || len(*result4) != 1 {
+		t.Error("Expected 1 result, got", *result4, err)
+	}
+	err = kv_backend.Refresh("1000@example.com/10.0.0.1:5060", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(250 * time.Second)
+	result5, err := kv_backend.Read("", true)
+	if err != nil || len(*result5) != 1 {
+		t.Error("Expected 1 result, got", *result5, err)
+	}
+
+	err = kv_backend.Delete("1000@example.com/10.0.0.1:5060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND, got", err)
+	}
+	err = kv_backend.Db.QueryRow("SELECT COUNT(*) FROM location WHERE username = '1002'").Scan(&row_count)
+	if err != nil || row_count != 1 {
+		t.Error("Expected Kamailio's own row to be left in place, got", row_count, err)
+	}
+
+	err = kv_backend.Write("1000@example.com", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300)
+	if err == nil {
+		t.Error("Expected an error writing a key without an instance, got nil")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps everything within this process, so nothing is shared with other instances or survives a restart.
+// Intended for testing (and trying things out), --kvhost and --kvport are ignored.
+type KvBackendMemory struct {
+	Prefix  string
+	entries map[string]kvMemoryEntry
+	mutex   sync.Mutex
+	// Used for TTLs, replaced by tests to control expiry.
+	now func() time.Time
+}
+
+type kvMemoryEntry struct {
+	value string
+	// Zero if the entry never expires.
+	expires time.Time
+}
+
+// A ttl of 0 means the key never expires.
+func (k *KvBackendMemory) getExpires(ttl int) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return k.now().Add(time.Duration(ttl) * time.Second)
+}
+
+func NewKvBackendMemory(conf map[string]string) (KvBackend, error) {
+	return &KvBackendMemory{
+		Prefix:  conf["prefix"],
+		entries: make(map[string]kvMemoryEntry),
+		now:     time.Now,
+	}, nil
+}
+
+func (k *KvBackendMemory) BackendName() string {
+	return "memory"
+}
+
+func (k *KvBackendMemory) GetPrefix() string {
+	return k.Prefix
+}
+
+// Drops anything that has expired, the mutex must be held.
+func (k *KvBackendMemory) expire() {
+	now := k.now()
+	for key, v := range k.entries {
+		if v.expires.IsZero() == false && now.Before(v.expires) == false {
+			delete(k.entries, key)
+		}
+	}
+}
+
+// If the key is a prefix (recursive lookup), set recursive = true
+// Results will be key/value in a map.
+func (k *KvBackendMemory) Read(key string, recursive bool) (*map[string]string, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.expire()
+	results := make(map[string]string)
+	for entry_key, v := range k.entries {
+		// The trailing slash stops a prefix of "foo" also matching "foobar", as with the other backends.
+		if entry_key == key || (recursive == true && (len(key) == 0 || strings.HasPrefix(entry_key, key+"/"))) {
+			results[entry_key] = v.value
+		}
+	}
+	if len(results) == 0 {
+		return &results, errors.New("KEY_NOT_FOUND")
+	}
+	return &results, nil
+}
+
+func (k *KvBackendMemory) Write(key string, value string, ttl int) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.entries[key] = kvMemoryEntry{
+		value:   value,
+		expires: k.getExpires(ttl),
+	}
+	return nil
+}
+
+func (k *KvBackendMemory) Refresh(key string, ttl int) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.expire()
+	entry, ok := k.entries[key]
+	if ok == false {
+		return errors.New("KEY_NOT_FOUND")
+	}
+	entry.expires = k.getExpires(ttl)
+	k.entries[key] = entry
+	return nil
+}
+
+func (k *KvBackendMemory) Delete(key string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.entries, key)
+	return nil
+}
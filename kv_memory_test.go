@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getTestMemoryKvBackend(t *testing.T) *KvBackendMemory {
+	kv_backend, err := CreateKvBackend(map[string]string{"backend": "memory", "host": "localhost", "port": "1", "prefix": "fs_registrations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv_backend.(*KvBackendMemory)
+}
+
+func TestKvBackendMemory(t *testing.T) {
+	kv_backend := getTestMemoryKvBackend(t)
+	now := time.Unix(1470367071, 0)
+	kv_backend.now = func() time.Time { return now }
+	if kv_backend.BackendName() != "memory" || kv_backend.GetPrefix() != "fs_registrations" {
+		t.Error("Expected memory and fs_registrations, got", kv_backend.BackendName(), kv_backend.GetPrefix())
+	}
+
+	_, err := kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND, got", err)
+	}
+	for k, ttl := range map[string]int{
+		"1000@domain/10.0.0.1:5060":  10,
+		"1000@domain/10.0.0.2:5060":  20,
+		"10000@domain/10.0.0.1:5060": 20,
+	} {
+		if err := kv_backend.Write(k, k, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recursive reads match whole path segments only, non-recursive reads an exact key.
+	result1, err := kv_backend.Read("1000@domain", true)
+	expected_result1 := map[string]string{
+		"1000@domain/10.0.0.1:5060": "1000@domain/10.0.0.1:5060",
+		"1000@domain/10.0.0.2:5060": "1000@domain/10.0.0.2:5060",
+	}
+	if err != nil || reflect.DeepEqual(*result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", *result1, err)
+	}
+	_, err = kv_backend.Read("1000@domain", false)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND, got", err)
+	}
+	result2, err := kv_backend.Read("", true)
+	if err != nil || len(*result2) != 3 {
+		t.Error("Expected 3 results, got", *result2, err)
+	}
+
+	// Refreshing extends the TTL, anything else expires.
+	now = now.Add(5 * time.Second)
+	if err := kv_backend.Refresh("1000@domain/10.0.0.1:5060", 30); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	now = now.Add(20 * time.Second)
+	result3, err := kv_backend.Read("", true)
+	expected_result3 := map[string]string{"1000@domain/10.0.0.1:5060": "1000@domain/10.0.0.1:5060"}
+	if err != nil || reflect.DeepEqual(*result3, expected_result3) != true {
+		t.Error("Expected", expected_result3, "got", *result3, err)
+	}
+	// Refreshing doesn't recreate expired (or deleted) keys.
+	err = kv_backend.Refresh("1000@domain/10.0.0.2:5060", 30)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND, got", err)
+	}
+
+	if err := kv_backend.Delete("1000@domain/10.0.0.1:5060"); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	_, err = kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Error("Expected KEY_NOT_FOUND, got", err)
+	}
+
+	// A TTL of 0 never expires.
+	if err := kv_backend.Write("1001@domain/10.0.0.1:5060", "1001@domain/10.0.0.1:5060", 0); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(24 * time.Hour)
+	result4, err := kv_backend.Read("", true)
+	expected_result4 := map[string]string{"1001@domain/10.0.0.1:5060": "1001@domain/10.0.0.1:5060"}
+	if err != nil || reflect.DeepEqual(*result4, expected_result4) != true {
+		t.Error("Expected", expected_result4, "got", *result4, err)
+	}
+}
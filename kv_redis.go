@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Number of keys requested per SCAN iteration.
+const redisScanCount = 1000
+
+type KvBackendRedis struct {
+	Client redis.UniversalClient
+	Prefix string
+}
+
+// Optional conf keys (via --kvoption): password, db (database index, not for cluster mode),
+// mode (standalone (default), sentinel or cluster) and master_name (required for sentinel mode).
+// The host key may contain a comma separated list of host[:port] endpoints for sentinel/cluster modes.
+func NewKvBackendRedis(conf map[string]string) (KvBackend, error) {
+	for _, v := range []string{"host", "port", "prefix"} {
+		if _, ok := conf[v]; ok == false {
+			return nil, fmt.Errorf("redis: '%s' key does not exist in conf.", v)
+		}
+	}
+	addrs := getRedisAddrs(conf["host"], conf["port"])
+	db := 0
+	if len(conf["db"]) > 0 {
+		var err error
+		db, err = strconv.Atoi(conf["db"])
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("redis: 'db' must be a non-negative integer, got '%s'.", conf["db"])
+		}
+	}
+	var client redis.UniversalClient
+	switch conf["mode"] {
+	case "", "standalone":
+		if len(addrs) != 1 {
+			return nil, fmt.Errorf("redis: standalone mode supports a single host only, got %d.", len(addrs))
+		}
+		client = redis.NewClient(&redis.Options{
+			Addr:     addrs[0],
+			Password: conf["password"],
+			DB:       db,
+		})
+	case "sentinel":
+		if len(conf["master_name"]) == 0 {
+			return nil, errors.New("redis: 'master_name' must be set for sentinel mode.")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    conf["master_name"],
+			SentinelAddrs: addrs,
+			Password:      conf["password"],
+			DB:            db,
+		})
+	case "cluster":
+		if db != 0 {
+			return nil, errors.New("redis: 'db' cannot be used in cluster mode.")
+		}
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Password: conf["password"],
+		})
+	default:
+		return nil, fmt.Errorf("redis: 'mode' must be one of standalone, sentinel, cluster, got '%s'.", conf["mode"])
+	}
+	return &KvBackendRedis{
+		Client: client,
+		Prefix: conf["prefix"],
+	}, nil
+}
+
+// Endpoints without an explicit port use the default port.
+func getRedisAddrs(hosts string, default_port string) []string {
+	var addrs []string
+	for _, v := range strings.Split(hosts, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if strings.Contains(v, ":") == false {
+			v = fmt.Sprintf("%s:%s", v, default_port)
+		}
+		addrs = append(addrs, v)
+	}
+	return addrs
+}
+
+// SCAN MATCH uses glob patterns, escape any special characters in the key itself.
+func escapeRedisPattern(input string) string {
+	var result []rune
+	for _, c := range input {
+		if strings.ContainsRune("*?[]\\", c) {
+			result = append(result, '\\')
+		}
+		result = append(result, c)
+	}
+	return string(result)
+}
+
+func (k *KvBackendRedis) BackendName() string {
+	return "redis"
+}
+
+func (k *KvBackendRedis) GetPrefix() string {
+	return k.Prefix
+}
+
+// SCAN is per node, so this only covers the node that the client is connected to.
+func scanRedisClientKeys(client *redis.Client, pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next_cursor, err := client.Scan(cursor, pattern, redisScanCount).Result()
+		if err != nil {
+			return []string{}, err
+		}
+		keys = append(keys, batch...)
+		if next_cursor == 0 {
+			return keys, nil
+		}
+		cursor = next_cursor
+	}
+}
+
+func (k *KvBackendRedis) scanKeys(pattern string) ([]string, error) {
+	switch client := k.Client.(type) {
+	case *redis.ClusterClient:
+		// Each master only holds the keys for its own slots, scan them all.
+		var keys []string
+		var keys_mutex sync.Mutex
+		err := client.ForEachMaster(func(master *redis.Client) error {
+			master_keys, err := scanRedisClientKeys(master, pattern)
+			if err != nil {
+				return err
+			}
+			keys_mutex.Lock()
+			defer keys_mutex.Unlock()
+			keys = append(keys, master_keys...)
+			return nil
+		})
+		return keys, err
+	case *redis.Client:
+		return scanRedisClientKeys(client, pattern)
+	}
+	return []string{}, fmt.Errorf("redis: Unsupported client type %T.", k.Client)
+}
+
+// If the key is a prefix (recursive lookup), set recursive = true
+// Results will be key/value in a map.
+func (k *KvBackendRedis) Read(key string, recursive bool) (*map[string]string, error) {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("redis.Read(): Getting '%s' key value (recursive: %t)", use_key, recursive)
+	results := make(map[string]string)
+	keys := []string{use_key}
+	if recursive == true {
+		scanned_keys, err := k.scanKeys(fmt.Sprintf("%s/*", escapeRedisPattern(use_key)))
+		if err != nil {
+			return &results, err
+		}
+		keys = append(keys, scanned_keys...)
+	}
+	// Pipeline the GETs, MGET does not work across cluster slots.
+	pipe := k.Client.Pipeline()
+	defer pipe.Close()
+	cmds := make(map[string]*redis.StringCmd)
+	for _, v := range keys {
+		cmds[v] = pipe.Get(v)
+	}
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return &results, err
+	}
+	for full_key, cmd := range cmds {
+		value, err := cmd.Result()
+		if err == redis.Nil {
+			// Missing, or expired since the SCAN.
+			continue
+		} else if err != nil {
+			return &results, err
+		}
+		results[getKvResultKey(k.Prefix, full_key)] = value
+	}
+	if len(results) == 0 {
+		return &results, errors.New("KEY_NOT_FOUND")
+	}
+	return &results, nil
+}
+
+// A ttl of 0 means the key never expires.
+func (k *KvBackendRedis) Write(key string, value string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("redis.Write(): Writing '%s' key value", use_key)
+	return k.Client.Set(use_key, value, time.Duration(ttl)*time.Second).Err()
+}
+
+// EXPIRE is a no-op if the key no longer exists.
+func (k *KvBackendRedis) Refresh(key string, ttl int) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("redis.Refresh(): Refreshing '%s' key TTL", use_key)
+	ok, err := k.Client.Expire(use_key, time.Duration(ttl)*time.Second).Result()
+	if err != nil {
+		return err
+	}
+	if ok == false {
+		return errors.New("KEY_NOT_FOUND")
+	}
+	return nil
+}
+
+func (k *KvBackendRedis) Delete(key string) error {
+	use_key := getKvKeyWithPrefix(k.Prefix, key)
+	//log.Printf("redis.Delete(): Deleting '%s' key value", use_key)
+	return k.Client.Del(use_key).Err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetRedisAddrs(t *testing.T) {
+	expected_result1 := []string{"10.0.0.1:6379"}
+	result1 := getRedisAddrs("10.0.0.1", "6379")
+	if reflect.DeepEqual(result1, expected_result1) != true {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+	//
+	expected_result2 := []string{"sentinel1:26379", "sentinel2:26380", "sentinel3:26379"}
+	result2 := getRedisAddrs("sentinel1, sentinel2:26380,sentinel3,", "26379")
+	if reflect.DeepEqual(result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
+}
+
+func TestEscapeRedisPattern(t *testing.T) {
+	expected_result := "prefix/user\\*\\?\\[x\\]@domain"
+	result := escapeRedisPattern("prefix/user*?[x]@domain")
+	if result != expected_result {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
+
+func TestNewKvBackendRedis(t *testing.T) {
+	// Clients connect lazily, so these don't need a running Redis.
+	valid_confs := []map[string]string{
+		{"backend": "redis", "host": "10.0.0.1", "port": "6379", "prefix": "someprefix"},
+		{"backend": "redis", "host": "10.0.0.1", "port": "6379", "prefix": "someprefix", "password": "somepass", "db": "3"},
+		{"backend": "redis", "host": "s1,s2", "port": "26379", "prefix": "someprefix", "mode": "sentinel", "master_name": "mymaster"},
+		{"backend": "redis", "host": "c1:7000,c2:7001", "port": "6379", "prefix": "someprefix", "mode": "cluster"},
+	}
+	for _, conf := range valid_confs {
+		result, err := CreateKvBackend(conf)
+		if err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+		if result.BackendName() != "redis" {
+			t.Error("Expected a return type of redis, got", result.BackendName())
+		}
+		if result.GetPrefix() != "someprefix" {
+			t.Error("Expected a .Prefix of someprefix, got", result.GetPrefix())
+		}
+	}
+	// And failures
+	invalid_confs := map[string]map[string]string{
+		"redis: 'db' must be a non-negative integer, got 'abc'.":                   {"backend": "redis", "host": "10.0.0.1", "port": "6379", "prefix": "p", "db": "abc"},
+		"redis: standalone mode supports a single host only, got 2.":               {"backend": "redis", "host": "h1,h2", "port": "6379", "prefix": "p"},
+		"redis: 'master_name' must be set for sentinel mode.":                      {"backend": "redis", "host": "s1", "port": "26379", "prefix": "p", "mode": "sentinel"},
+		"redis: 'db' cannot be used in cluster mode.":                              {"backend": "redis", "host": "c1", "port": "7000", "prefix": "p", "mode": "cluster", "db": "1"},
+		"redis: 'mode' must be one of standalone, sentinel, cluster, got 'other'.": {"backend": "redis", "host": "h1", "port": "6379", "prefix": "p", "mode": "other"},
+		"redis: 'prefix' key does not exist in conf.":                              {"backend": "redis", "host": "h1", "port": "6379"},
+	}
+	for expected_err, conf := range invalid_confs {
+		_, err := CreateKvBackend(conf)
+		if err == nil {
+			t.Fatal("Expected an error, got nil")
+		}
+		if err.Error() != expected_err {
+			t.Error("Expected error of", expected_err, "got", err.Error())
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 )
 
 func TestAvailableKvBackends(t *testing.T) {
 	expected_result := []string{
+		"consul",
 		"etcd",
+		"etcd3",
+		"kamailio",
+		"memory",
+		"redis",
 		// Add new backends here as they become available.
 	}
 	result := availableKvBackends()
@@ -69,6 +75,25 @@ func TestGetKvBackendValueJsonType(t *testing.T) {
 	if reflect.DeepEqual(result, expected_result) != true {
 		t.Error("Expected", expected_result, "got", result)
 	}
+	// Including registration details
+	expected_result2 := KvBackendValue{
+		Host:        "10.3.4.5",
+		Port:        5064,
+		Contact:     "sip:1000@192.168.1.10:5060",
+		UserAgent:   "Telephone 1.1.7",
+		NetworkIp:   "192.168.1.10",
+		NetworkPort: 5060,
+		Profile:     "internal",
+		Expires:     1470367371,
+		RecordedAt:  1470367071,
+	}
+	result2, err := getKvBackendValueJsonType("{\"host\":\"10.3.4.5\",\"port\":5064,\"contact\":\"sip:1000@192.168.1.10:5060\",\"user_agent\":\"Telephone 1.1.7\",\"network_ip\":\"192.168.1.10\",\"network_port\":5060,\"profile\":\"internal\",\"expires\":1470367371,\"recorded_at\":1470367071}")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if reflect.DeepEqual(result2, expected_result2) != true {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
 	// And a failure
 	_, err = getKvBackendValueJsonType("{\"host\"\"10.3.4.5\",\"port\":5064}")
 	if err == nil {
@@ -89,6 +114,32 @@ func TestGetKvBackendValueJsonString(t *testing.T) {
 	if reflect.DeepEqual(result, expected_result) != true {
 		t.Error("Expected", expected_result, "got", result)
 	}
+	// Registration details are included when set, and older readers can still decode host/port.
+	expected_result2 := "{\"host\":\"10.4.5.6\",\"port\":5065,\"contact\":\"sip:1000@192.168.1.10:5060\",\"profile\":\"internal\",\"recorded_at\":1470367071}"
+	result2, err := getKvBackendValueJsonString(KvBackendValue{
+		Host:       "10.4.5.6",
+		Port:       5065,
+		Contact:    "sip:1000@192.168.1.10:5060",
+		Profile:    "internal",
+		RecordedAt: 1470367071,
+	})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if result2 != expected_result2 {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
+	var old_reader_result struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	err = json.Unmarshal([]byte(result2), &old_reader_result)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if old_reader_result.Host != "10.4.5.6" || old_reader_result.Port != 5065 {
+		t.Error("Expected host 10.4.5.6 and port 5065, got", old_reader_result)
+	}
 	// And a failure
 	// TODOLATER: find something that will fail this, that still builds.
 	/*
@@ -131,3 +182,23 @@ func TestStripKvKeyPrefix(t *testing.T) {
 		t.Error("Expected", expected_result2, "got", result2)
 	}
 }
+
+func TestGetKvResultKey(t *testing.T) {
+	expected_result1 := "somekey"
+	result1 := getKvResultKey("someprefix", "/someprefix/somekey")
+	if result1 != expected_result1 {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+	//
+	expected_result2 := "anotherprefix"
+	result2 := getKvResultKey("anotherprefix", "/anotherprefix")
+	if result2 != expected_result2 {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
+	//
+	expected_result3 := "anotherprefix"
+	result3 := getKvResultKey("anotherprefix", "anotherprefix")
+	if result3 != expected_result3 {
+		t.Error("Expected", expected_result3, "got", result3)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Everything is logged at "info", except for the (potentially very large) per message/sync dumps at "debug".
+var logLevels = []string{"debug", "info"}
+
+// 1 when debug logging is enabled, changed on reload so accessed atomically.
+var debugLogging int32
+
+func setLogLevel(level string) error {
+	switch level {
+	case "debug":
+		atomic.StoreInt32(&debugLogging, 1)
+	case "info":
+		atomic.StoreInt32(&debugLogging, 0)
+	default:
+		return fmt.Errorf("Invalid log level '%s', must be one of: %s", level, strings.Join(logLevels, ", "))
+	}
+	return nil
+}
+
+func logDebugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debugLogging) == 1 {
+		log.Printf("DEBUG: "+format, v...)
+	}
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/0x19/goesl"
 	"github.com/kr/pretty"
+	"golang.org/x/net/context"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -19,6 +20,13 @@ func main() {
 	app.Version = fs_registrator_version
 	app.Usage = "FreeSWITCH Sofia-SIP Registry Bridge (Sync to Key/Value Store)"
 	app.Action = func(c *cli.Context) error {
+		// Values from the file are applied to the context, so parseFlags() validates them along with any flags.
+		config_file, err := loadConfigFile(c)
+		if err != nil {
+			log.Printf("%s\n\n", err.Error())
+			cli.ShowAppHelp(c)
+			os.Exit(1)
+		}
 		arg_config, err := parseFlags(c)
 		if err != nil {
 			log.Printf("%s\n\n", err.Error())
@@ -26,51 +34,115 @@ func main() {
 			os.Exit(1)
 		}
 		log.Printf("Config: %# v\n", pretty.Formatter(arg_config))
+		// Settings that can be changed on SIGHUP, also sets the log level.
+		runtime_config := newRuntimeConfig(arg_config)
 
 		// Setup our KV backend client.
 		log.Printf("Setting up K/V (%s) Backend...", arg_config.KvBackend)
-		kv_backend, err := CreateKvBackend(map[string]string{
-			"backend": arg_config.KvBackend,
-			"host":    arg_config.KvHost,
-			"port":    strconv.Itoa(int(arg_config.KvPort)),
-			"prefix":  arg_config.KvPrefix,
-		})
+		kv_backend, err := createKvBackendFromArgs(arg_config)
 		if err != nil {
 			log.Fatal(err)
 		}
+		kv_backend = instrumentKvBackend(kv_backend)
+		if arg_config.DryRun == true {
+			log.Printf("Dry run enabled, changes to the K/V backend will be logged instead of made.\n")
+			kv_backend = newDryRunKvBackend(kv_backend)
+		}
 		log.Printf("K/V Backend Ready.\n")
 
 		log.Printf("Opening FreeSWITCH ESL Connections (%s:%d)...", arg_config.FreeswitchHost, arg_config.FreeswitchPort)
-		// TODO: reconnection attempts? or just exit?
-		event_client, err := goesl.NewClient(arg_config.FreeswitchHost, uint(arg_config.FreeswitchPort), arg_config.FreeswitchEslPassword, int(5))
+		// If the initial connections fail, exit (most likely a configuration issue).
+		// Once established, they are re-established automatically (with backoff) if they drop.
+		event_conn, err := NewEslConnection("event", arg_config.FreeswitchHost, arg_config.FreeswitchPort, arg_config.FreeswitchEslPassword)
 		if err != nil {
 			log.Fatal(err)
 		}
-		// TODO: reconnection attempts? or just exit?
-		sync_client, err := goesl.NewClient(arg_config.FreeswitchHost, uint(arg_config.FreeswitchPort), arg_config.FreeswitchEslPassword, int(5))
+		sync_conn, err := NewEslConnection("sync", arg_config.FreeswitchHost, arg_config.FreeswitchPort, arg_config.FreeswitchEslPassword)
 		if err != nil {
 			log.Fatal(err)
 		}
 		log.Printf("FreeSWITCH ESL Connections Established.")
+		startEslRecording(arg_config)
+		defer eslRecorder.Close()
+
+		// Cancelled on SIGINT/SIGTERM, stopping all of the goroutines below.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := notifyShutdownSignals()
+		go handleShutdownSignals(signals, cancel, event_conn, sync_conn)
+		reload_signals := notifyReloadSignals()
 
 		var wg sync.WaitGroup
 		event_channel := make(chan struct{})
 		defer close(event_channel)
+		// Used by the event watcher to request a full sync after reconnecting.
+		sync_trigger := make(chan struct{}, 1)
+		// Errors that retrying won't fix, the supervisor shuts everything down and we exit with an error.
+		fatal_error_channel := make(chan error, 1)
+		var fatal_err error
+		wg.Add(1)
+		go superviseFatalErrors(ctx, cancel, &wg, fatal_error_channel, &fatal_err, event_conn, sync_conn)
 
-		go event_client.Handle()
-		go sync_client.Handle()
 		wg.Add(1)
-		go watchForRegistrationEvents(&event_client, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, &wg, 0, event_channel)
+		go watchForRegistrationEvents(ctx, event_conn, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, runtime_config, &wg, 0, event_channel, sync_trigger)
+		wg.Add(1)
+		go nullEventChannelReceiver(ctx, &wg, event_channel)
+		wg.Add(1)
+		go syncRegistrations(ctx, sync_conn, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, runtime_config, &wg, false, sync_trigger, fatal_error_channel)
+		if len(arg_config.HttpListen) > 0 {
+			http_listener, err := net.Listen("tcp", arg_config.HttpListen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			wg.Add(1)
+			go serveHttp(ctx, http_listener, newHttpMux(kv_backend, time.Duration(arg_config.LivenessThreshold)*time.Second), &wg)
+		}
+		if len(arg_config.DnsListen) > 0 {
+			dns_packet_conn, err := net.ListenPacket("udp", arg_config.DnsListen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dns_listener, err := net.Listen("tcp", arg_config.DnsListen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			wg.Add(1)
+			go serveDns(ctx, dns_packet_conn, dns_listener, NewDnsResponder(kv_backend, arg_config.DnsZone, arg_config.KvTtl), &wg)
+		}
 		wg.Add(1)
-		go nullEventChannelReceiver(&wg, event_channel)
+		go handleReloadSignals(ctx, reload_signals, c, config_file, runtime_config, &wg, sync_trigger)
 		wg.Add(1)
-		go syncRegistrations(&sync_client, arg_config.FreeswitchSofiaProfiles, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, arg_config.SyncInterval, kv_backend, &wg, false)
+		go refreshRegistrations(ctx, arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort, kv_backend, runtime_config, &wg, false, sync_trigger)
 
 		wg.Wait()
 
+		// Nothing else is writing to the K/V backend at this point.
+		if arg_config.WithdrawOnExit == true {
+			log.Printf("Withdrawing this instance's registrations from the K/V backend...\n")
+			err = withdrawRegistrations(runtime_config.AdvertisedAddresses(arg_config.FreeswitchAdvertiseIp, arg_config.FreeswitchAdvertisePort), kv_backend)
+			if err != nil {
+				log.Printf("WARNING: Error withdrawing registrations: %s\n", err)
+				os.Exit(1)
+			}
+		} else {
+			log.Printf("Leaving this instance's registrations in place, they expire after --kvttl if not refreshed.\n")
+		}
+		if fatal_err != nil {
+			log.Printf("Shutdown complete, after a fatal error: %s\n", fatal_err)
+			os.Exit(1)
+		}
+		log.Printf("Shutdown complete.\n")
+
 		return nil
 	}
+	app.Commands = getCommands()
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "YAML file of settings, named as per these flags (eg. fshost: 10.0.0.5). Flags and environment variables override the file. fsprofiles (and the include/exclude patterns), syncinterval, kvttl and loglevel are reloaded on SIGHUP.",
+			EnvVar: "CONFIG_FILE",
+		},
 		cli.StringFlag{
 			Name:   "fshost",
 			Value:  "localhost",
@@ -92,9 +164,21 @@ func main() {
 		cli.StringFlag{
 			Name:   "fsprofiles",
 			Value:  "internal",
-			Usage:  "List of Sofia Profiles to watch (comma separated list)",
+			Usage:  "List of Sofia Profiles to watch (comma separated list), or auto for every running profile (fetched from FreeSWITCH on each sync)",
 			EnvVar: "FS_PROFILES",
 		},
+		cli.StringFlag{
+			Name:   "fsprofilesinclude",
+			Value:  "",
+			Usage:  "With --fsprofiles auto, only watch profiles matching one of these glob patterns (comma separated list, eg. internal*), default is all",
+			EnvVar: "FS_PROFILES_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "fsprofilesexclude",
+			Value:  "",
+			Usage:  "With --fsprofiles auto, don't watch profiles matching any of these glob patterns (comma separated list)",
+			EnvVar: "FS_PROFILES_EXCLUDE",
+		},
 		cli.StringFlag{
 			Name:   "fsadvertiseip",
 			Value:  "",
@@ -107,6 +191,12 @@ func main() {
 			Usage:  "SIP Destination Port to store in K/V Store for FreeSWITCH",
 			EnvVar: "FS_ADVERTISE_PORT",
 		},
+		cli.StringFlag{
+			Name:   "fsadvertisefrom",
+			Value:  "",
+			Usage:  fmt.Sprintf("Derive the SIP Destination IP/Port per Sofia Profile instead of --fsadvertiseip/--fsadvertiseport (one of: %s, with the profile's sip-port)", strings.Join(advertiseFromValues, ", ")),
+			EnvVar: "FS_ADVERTISE_FROM",
+		},
 		cli.StringFlag{
 			Name:   "kvbackend",
 			Value:  "etcd",
@@ -131,6 +221,62 @@ func main() {
 			Usage:  "Key Space Prefix in K/V Store to store Registrations",
 			EnvVar: "KV_PREFIX",
 		},
+		cli.IntFlag{
+			Name:   "kvttl",
+			Value:  300,
+			Usage:  "TTL (in seconds) of Registrations in K/V Store. Registrations for this instance are refreshed while running, so a failed instance's entries expire.",
+			EnvVar: "KV_TTL",
+		},
+		cli.StringSliceFlag{
+			Name:   "kvoption",
+			Usage:  "Backend specific K/V Store option in key=value format (can be repeated, or comma separated in the environment variable)",
+			EnvVar: "KV_OPTIONS",
+		},
+		cli.StringFlag{
+			Name:   "httplisten",
+			Value:  "",
+			Usage:  "Address ([host]:port) to serve HTTP endpoints on (/metrics, /healthz, /readyz, /registrations), disabled if empty",
+			EnvVar: "HTTP_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "dnslisten",
+			Value:  "",
+			Usage:  "Address ([host]:port) to answer DNS queries (UDP/TCP) for registered users on, eg. alice.example.com.<dnszone>. Disabled if empty",
+			EnvVar: "DNS_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "dnszone",
+			Value:  "reg.local",
+			Usage:  "DNS zone to answer queries within, when --dnslisten is set",
+			EnvVar: "DNS_ZONE",
+		},
+		cli.IntFlag{
+			Name:   "livenessthreshold",
+			Value:  120,
+			Usage:  "/healthz fails if no events (including HEARTBEATs) have been received from FreeSWITCH for this many seconds",
+			EnvVar: "LIVENESS_THRESHOLD",
+		},
+		cli.StringFlag{
+			Name:   "loglevel",
+			Value:  "info",
+			Usage:  fmt.Sprintf("Log level (one of: %s), debug includes full message and sync dumps", strings.Join(logLevels, ", ")),
+			EnvVar: "LOG_LEVEL",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Log the changes that would be made to the K/V Store (by events, syncs, refreshes and --withdrawonexit) instead of making them. See also the diff command",
+			EnvVar: "DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "record",
+			Usage:  "Append every message received from FreeSWITCH (registration events and sofia xmlstatus responses) to this file as JSON lines, for the replay command",
+			EnvVar: "RECORD_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "withdrawonexit",
+			Usage:  "On SIGINT/SIGTERM, delete this instance's Registrations from the K/V Store before exiting (default is to leave them in place until they expire)",
+			EnvVar: "WITHDRAW_ON_EXIT",
+		},
 		cli.IntFlag{
 			Name:   "syncinterval",
 			Value:  3600,
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -132,7 +133,20 @@ func pollContainerTcpPortHealth(host string, port uint, timeout_sec uint) error
 var dockerHost string
 var dockerContainerPorts map[string]uint
 
+// Tests needing the Docker containers (FreeSWITCH, etcd) are skipped with -short, everything else
+// uses in-process stand-ins (see freeswitch_fake_test.go and the memory K/V backend).
+func skipWithoutDocker(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Needs Docker, skipped in -short mode.")
+	}
+}
+
 func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		log.Printf("Short mode, not starting the Docker containers.\n")
+		os.Exit(m.Run())
+	}
 	docker_project_name := "fsregistrator"
 	project, err := docker.NewProject(&ctx.Context{
 		Context: project.Context{
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exposed on /metrics when --httplisten is set.
+var (
+	metricEslEventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fs_registrator_esl_events_received_total",
+		Help: "Registration events received from FreeSWITCH, by subclass (register, unregister, expire).",
+	}, []string{"subclass"})
+	metricEslEventsIgnored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fs_registrator_esl_events_ignored_total",
+		Help: "Registration events ignored as they are for a Sofia profile that isn't synced, by profile.",
+	}, []string{"profile"})
+	metricEslEventParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fs_registrator_esl_event_parse_failures_total",
+		Help: "Events received from FreeSWITCH that could not be parsed.",
+	})
+	metricEslConnectionUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "fs_registrator_esl_connection_up",
+		Help: "Whether the ESL connection to FreeSWITCH is currently established (1) or not (0).",
+	}, []string{"connection"})
+	metricKvOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fs_registrator_kv_operations_total",
+		Help: "Operations performed against the K/V backend, by backend and operation (read, write, refresh, delete).",
+	}, []string{"backend", "operation"})
+	metricKvOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fs_registrator_kv_operation_errors_total",
+		Help: "Operations against the K/V backend that returned an error, by backend and operation (read, write, refresh, delete).",
+	}, []string{"backend", "operation"})
+	metricSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "fs_registrator_sync_duration_seconds",
+		Help: "Time taken by each full sync.",
+	})
+	metricSyncRegistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fs_registrator_sync_registrations_total",
+		Help: "Registrations added to, updated in or removed from the K/V backend by full syncs, by change (add, update, remove).",
+	}, []string{"change"})
+	metricSyncFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fs_registrator_sync_failures_total",
+		Help: "Full syncs that failed (and were retried), by reason (freeswitch, kv_backend, config, internal).",
+	}, []string{"reason"})
+	metricRegistrationsOwned = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fs_registrator_registrations_owned",
+		Help: "Registrations owned by this instance, as of the last full sync or refresh.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricEslEventsReceived,
+		metricEslEventsIgnored,
+		metricEslEventParseFailures,
+		metricEslConnectionUp,
+		metricKvOperations,
+		metricKvOperationErrors,
+		metricSyncDuration,
+		metricSyncRegistrations,
+		metricSyncFailures,
+		metricRegistrationsOwned,
+	)
+}
+
+// Wraps a KvBackend, counting operations (and errors) against it.
+type metricsKvBackend struct {
+	KvBackend
+}
+
+func instrumentKvBackend(kv_backend KvBackend) KvBackend {
+	return &metricsKvBackend{KvBackend: kv_backend}
+}
+
+func (k *metricsKvBackend) record(operation string, err error) {
+	metricKvOperations.WithLabelValues(k.BackendName(), operation).Inc()
+	if err != nil {
+		metricKvOperationErrors.WithLabelValues(k.BackendName(), operation).Inc()
+	}
+}
+
+func (k *metricsKvBackend) Read(key string, recursive bool) (*map[string]string, error) {
+	result, err := k.KvBackend.Read(key, recursive)
+	// Not finding anything is a normal result, not an error.
+	if err != nil && err.Error() == "KEY_NOT_FOUND" {
+		k.record("read", nil)
+	} else {
+		k.record("read", err)
+	}
+	return result, err
+}
+
+func (k *metricsKvBackend) Write(key string, value string, ttl int) error {
+	err := k.KvBackend.Write(key, value, ttl)
+	k.record("write", err)
+	return err
+}
+
+func (k *metricsKvBackend) Refresh(key string, ttl int) error {
+	err := k.KvBackend.Refresh(key, ttl)
+	k.record("refresh", err)
+	return err
+}
+
+func (k *metricsKvBackend) Delete(key string) error {
+	err := k.KvBackend.Delete(key)
+	k.record("delete", err)
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsKvBackend(t *testing.T) {
+	test_kv_backend := instrumentKvBackend(getTestMemoryKvBackend(t))
+	if test_kv_backend.BackendName() != "memory" {
+		t.Error("Expected a return type of memory, got", test_kv_backend.BackendName())
+	}
+
+	operations := []string{"read", "write", "refresh", "delete"}
+	operations_before := make(map[string]float64)
+	errors_before := make(map[string]float64)
+	for _, v := range operations {
+		operations_before[v] = testutil.ToFloat64(metricKvOperations.WithLabelValues("memory", v))
+		errors_before[v] = testutil.ToFloat64(metricKvOperationErrors.WithLabelValues("memory", v))
+	}
+
+	// Not found is not counted as an error.
+	_, err := test_kv_backend.Read("", true)
+	if err == nil || err.Error() != "KEY_NOT_FOUND" {
+		t.Fatal("Expected KEY_NOT_FOUND error, got", err)
+	}
+	if err := test_kv_backend.Write("1001@domain/10.0.0.1:5060", "{}", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := test_kv_backend.Refresh("1001@domain/10.0.0.1:5060", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := test_kv_backend.Delete("1001@domain/10.0.0.1:5060"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other tests may have counted operations too, so only check the increase.
+	for _, v := range operations {
+		increase := testutil.ToFloat64(metricKvOperations.WithLabelValues("memory", v)) - operations_before[v]
+		if increase != 1 {
+			t.Errorf("Expected '%s' operations to increase by 1, got %v", v, increase)
+		}
+		errors_increase := testutil.ToFloat64(metricKvOperationErrors.WithLabelValues("memory", v)) - errors_before[v]
+		if errors_increase != 0 {
+			t.Errorf("Expected no '%s' errors, got %v", v, errors_increase)
+		}
+	}
+}
@@ -1,22 +1,51 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Key = username@domain
+// Key = username@domain/advertise_ip:advertise_port
 // We use the <user> value from "sofia xmlstatus profile internal reg" to populate.
+// Each instance writes its own sub-key under the AOR, so a user registered on several instances has several entries.
 type Registrations map[string]KvBackendValue
 
-// The format we receive from FreeSWITCH.
-func generateCurrentRegistrationsType(users *[]string, advertise_ip string, advertise_port int) *Registrations {
+// Where an instance is reachable for SIP, stored as the host and port of each registration. An instance has one,
+// unless --fsadvertisefrom derives one per Sofia profile.
+type AdvertiseAddress struct {
+	Ip   string
+	Port int
+}
+
+// The K/V key for an AOR (username@domain) registered on the instance advertising advertise_ip:advertise_port.
+func getRegistrationKey(aor string, advertise_ip string, advertise_port int) string {
+	return fmt.Sprintf("%s/%s", aor, net.JoinHostPort(advertise_ip, strconv.Itoa(advertise_port)))
+}
+
+// Splits a K/V key back into the AOR and the instance (advertise_ip:advertise_port) it was registered on.
+func splitRegistrationKey(key string) (string, string, error) {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 || i == len(key)-1 {
+		return "", "", fmt.Errorf("Invalid registration key '%s', expected user@domain/ip:port.", key)
+	}
+	return key[:i], key[i+1:], nil
+}
+
+// The format we receive from FreeSWITCH. Registrations with their own AdvertiseIp/AdvertisePort (derived from the Sofia
+// profile) use that, rather than advertise_ip and advertise_port.
+func generateCurrentRegistrationsType(registrations *[]FsRegistration, advertise_ip string, advertise_port int, now time.Time) *Registrations {
 	result := make(Registrations)
-	for _, v := range *users {
-		// TODO: duplicate user handling?
-		result[v] = KvBackendValue{
-			Host: advertise_ip,
-			Port: advertise_port,
+	for _, v := range *registrations {
+		registration_ip, registration_port := advertise_ip, advertise_port
+		if len(v.AdvertiseIp) > 0 {
+			registration_ip, registration_port = v.AdvertiseIp, v.AdvertisePort
 		}
+		// getFreeswitchRegistrations() already ensures each user is only listed once.
+		result[getRegistrationKey(v.User, registration_ip, registration_port)] = getKvBackendValueFromFreeswitchRegistration(v, registration_ip, registration_port, now)
 	}
 	return &result
 }
@@ -35,69 +64,69 @@ func generateLastRegistrationsType(input *map[string]string) (*Registrations, er
 }
 
 // Parses out multiple K/V backend result sets into just the user@domain list,
-// and filter on this advertise IP and port only (this instance).
-func generateRegistrationListForThisInstance(input *Registrations, advertise_ip string, advertise_port int) *Registrations {
+// and filter on this instance's advertise addresses only.
+// Filtering is on the value rather than the key, so entries from before per-instance keys were introduced are also cleaned up.
+func generateRegistrationListForThisInstance(input *Registrations, addresses []AdvertiseAddress) *Registrations {
 	result := make(Registrations)
 	for k, v := range *input {
-		if v.Host != advertise_ip || v.Port != advertise_port {
-			continue
+		for _, address := range addresses {
+			if v.Host == address.Ip && v.Port == address.Port {
+				result[k] = v
+				break
+			}
 		}
-		result[k] = v
 	}
 	return &result
 }
 
-// add_registrations []string, remove_registrations []string
-func reconcileRegistrations(last_active_registrations *Registrations, current_active_registrations *Registrations) (*[]string, *[]string, error) {
-	var add_registrations []string
-	var remove_registrations []string
-
-	// First in one direction.
-	for k1, _ := range *last_active_registrations {
-		exists_in_current := false
-		for k2, _ := range *current_active_registrations {
-			if k1 == k2 {
-				exists_in_current = true
-				break
-			}
-		}
-		if exists_in_current == false {
-			remove_registrations = append(remove_registrations, k1)
+// Reads the registrations owned by this instance from the K/V backend, none if nothing is found.
+func readRegistrationsForThisInstance(kv_backend KvBackend, addresses []AdvertiseAddress) (*Registrations, error) {
+	raw_registrations, err := kv_backend.Read("", true)
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" {
+			return &Registrations{}, nil
 		}
+		return nil, err
 	}
-
-	// And in reverse.
-	for k3, _ := range *current_active_registrations {
-		exists_in_last := false
-		for k4, _ := range *last_active_registrations {
-			if k3 == k4 {
-				exists_in_last = true
-				break
-			}
-		}
-		if exists_in_last == false {
-			add_registrations = append(add_registrations, k3)
-		}
+	registrations, err := generateLastRegistrationsType(raw_registrations)
+	if err != nil {
+		return nil, err
 	}
+	return generateRegistrationListForThisInstance(registrations, addresses), nil
+}
+
+// Expires and RecordedAt change on every re-registration, so aren't compared.
+func registrationValuesEqual(a KvBackendValue, b KvBackendValue) bool {
+	a.Expires, a.RecordedAt = 0, 0
+	b.Expires, b.RecordedAt = 0, 0
+	return a == b
+}
 
-	// Reconcile our adds and removes, if we find any that are "added" and also "removed", they cancel eachother out and can be removed from both.
-	// This is normally a sign they already exist.
-	var add_registrations_results []string
-	var remove_registrations_results []string
-	for _, v5 := range add_registrations {
-		if stringInSlice(v5, remove_registrations) == false {
-			add_registrations_results = append(add_registrations_results, v5)
+// add_registrations []string, remove_registrations []string, update_registrations []string (each sorted)
+// Updates are keys in both, where the value differs (eg. a stale host/port or contact).
+func reconcileRegistrations(last_active_registrations *Registrations, current_active_registrations *Registrations) (*[]string, *[]string, *[]string, error) {
+	var add_registrations []string
+	var remove_registrations []string
+	var update_registrations []string
+
+	for k, v := range *current_active_registrations {
+		last_v, exists_in_last := (*last_active_registrations)[k]
+		if exists_in_last == false {
+			add_registrations = append(add_registrations, k)
+		} else if registrationValuesEqual(last_v, v) == false {
+			update_registrations = append(update_registrations, k)
 		}
 	}
-	for _, v6 := range remove_registrations {
-		if stringInSlice(v6, add_registrations) == false {
-			remove_registrations_results = append(remove_registrations_results, v6)
+	for k, _ := range *last_active_registrations {
+		if _, exists_in_current := (*current_active_registrations)[k]; exists_in_current == false {
+			remove_registrations = append(remove_registrations, k)
 		}
 	}
 
 	// Sort the results
-	sort.Strings(add_registrations_results)
-	sort.Strings(remove_registrations_results)
+	sort.Strings(add_registrations)
+	sort.Strings(remove_registrations)
+	sort.Strings(update_registrations)
 
-	return &add_registrations_results, &remove_registrations_results, nil
+	return &add_registrations, &remove_registrations, &update_registrations, nil
 }
@@ -1,26 +1,81 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
+func TestGetRegistrationKey(t *testing.T) {
+	expected_result1 := "1000@domain/10.20.30.40:5060"
+	result1 := getRegistrationKey("1000@domain", "10.20.30.40", 5060)
+	if result1 != expected_result1 {
+		t.Error("Expected", expected_result1, "got", result1)
+	}
+	expected_result2 := "1000@domain/[2001:db8::1]:5060"
+	result2 := getRegistrationKey("1000@domain", "2001:db8::1", 5060)
+	if result2 != expected_result2 {
+		t.Error("Expected", expected_result2, "got", result2)
+	}
+}
+
+func TestSplitRegistrationKey(t *testing.T) {
+	aor, instance, err := splitRegistrationKey("1000@domain/10.20.30.40:5060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aor != "1000@domain" || instance != "10.20.30.40:5060" {
+		t.Error("Expected 1000@domain and 10.20.30.40:5060, got", aor, "and", instance)
+	}
+	for _, v := range []string{"1000@domain", "/10.20.30.40:5060", "1000@domain/"} {
+		_, _, err = splitRegistrationKey(v)
+		if err == nil {
+			t.Errorf("Expected an error for '%s', got nil", v)
+		}
+	}
+}
+
 func TestGenerateCurrentRegistrationsType(t *testing.T) {
-	input := []string{
-		"user1@domain",
-		"user2@domain",
+	input := []FsRegistration{
+		{
+			Profile: "internal",
+			FsRegProfileRegistration: FsRegProfileRegistration{
+				User:        "user1@domain",
+				Contact:     "\"user1\" <sip:user1@192.168.1.10:5060>",
+				Agent:       "Telephone 1.1.7",
+				Status:      "Registered(UDP)(unknown) EXP(2016-08-05 03:22:51) EXPSECS(300)",
+				NetworkIp:   "192.168.1.10",
+				NetworkPort: "5060",
+			},
+		},
+		{
+			Profile: "external",
+			FsRegProfileRegistration: FsRegProfileRegistration{
+				User: "user2@domain",
+			},
+		},
 	}
 	expected_result := Registrations{
-		"user1@domain": KvBackendValue{
-			Host: "10.20.30.40",
-			Port: 5061,
+		"user1@domain/10.20.30.40:5061": KvBackendValue{
+			Host:        "10.20.30.40",
+			Port:        5061,
+			Contact:     "sip:user1@192.168.1.10:5060",
+			UserAgent:   "Telephone 1.1.7",
+			NetworkIp:   "192.168.1.10",
+			NetworkPort: 5060,
+			Profile:     "internal",
+			Expires:     1470367371,
+			RecordedAt:  1470367071,
 		},
-		"user2@domain": KvBackendValue{
-			Host: "10.20.30.40",
-			Port: 5061,
+		"user2@domain/10.20.30.40:5061": KvBackendValue{
+			Host:       "10.20.30.40",
+			Port:       5061,
+			Profile:    "external",
+			RecordedAt: 1470367071,
 		},
 	}
-	result := generateCurrentRegistrationsType(&input, "10.20.30.40", 5061)
+	result := generateCurrentRegistrationsType(&input, "10.20.30.40", 5061, time.Unix(1470367071, 0))
 	if reflect.DeepEqual(*result, expected_result) != true {
 		t.Error("Expected", expected_result, "got", result)
 	}
@@ -69,7 +124,7 @@ func TestGenerateRegistrationListForThisInstance(t *testing.T) {
 			Port: 5063,
 		},
 	}
-	result := generateRegistrationListForThisInstance(&Registrations{
+	input := Registrations{
 		"user3@domain": KvBackendValue{
 			Host: "10.20.30.50",
 			Port: 5062,
@@ -86,10 +141,16 @@ func TestGenerateRegistrationListForThisInstance(t *testing.T) {
 			Host: "10.20.30.60",
 			Port: 5063,
 		},
-	}, "10.20.30.60", 5063)
+	}
+	result := generateRegistrationListForThisInstance(&input, []AdvertiseAddress{{"10.20.30.60", 5063}})
 	if reflect.DeepEqual(*result, expected_result) != true {
 		t.Error("Expected", expected_result, "got", result)
 	}
+	// One address per Sofia profile (--fsadvertisefrom).
+	result2 := generateRegistrationListForThisInstance(&input, []AdvertiseAddress{{"10.20.30.60", 5063}, {"10.20.30.50", 5062}})
+	if len(*result2) != 4 {
+		t.Error("Expected all 4 registrations, got", result2)
+	}
 }
 
 func TestReconcileRegistrations(t *testing.T) {
@@ -110,7 +171,7 @@ func TestReconcileRegistrations(t *testing.T) {
 		"1003@sip.testserver.tld",
 	}
 	expected_remove1 := []string{}
-	result_add1, result_remove1, err := reconcileRegistrations(&last_input1, &current_input1)
+	result_add1, result_remove1, result_update1, err := reconcileRegistrations(&last_input1, &current_input1)
 	if err != nil {
 		t.Error("Scenario 1: Expected nil error, got error", err)
 	}
@@ -124,6 +185,9 @@ func TestReconcileRegistrations(t *testing.T) {
 			t.Error("Scenario 1: Expected", expected_remove1, "got", result_remove1)
 		}
 	}
+	if len(*result_update1) > 0 {
+		t.Error("Scenario 1: Expected no updates, got", result_update1)
+	}
 
 	// Scenario 2, some adds and removes in one operation.
 	last_input2 := Registrations{
@@ -196,7 +260,7 @@ func TestReconcileRegistrations(t *testing.T) {
 		"1003@sip.testserver.tld",
 		"1009@sip.testserver.tld",
 	}
-	result_add2, result_remove2, err := reconcileRegistrations(&last_input2, &current_input2)
+	result_add2, result_remove2, result_update2, err := reconcileRegistrations(&last_input2, &current_input2)
 	if err != nil {
 		t.Error("Scenario 2: Expected nil error, got error", err)
 	}
@@ -210,6 +274,9 @@ func TestReconcileRegistrations(t *testing.T) {
 			t.Error("Scenario 2: Expected", expected_remove2, "got", result_remove2)
 		}
 	}
+	if len(*result_update2) > 0 {
+		t.Error("Scenario 2: Expected no updates, got", result_update2)
+	}
 
 	// Scenario 3, all removes.
 	last_input3 := Registrations{
@@ -233,7 +300,7 @@ func TestReconcileRegistrations(t *testing.T) {
 		"1012@sip.testserver.tld",
 		"1013@sip.testserver.tld",
 	}
-	result_add3, result_remove3, err := reconcileRegistrations(&last_input3, &current_input3)
+	result_add3, result_remove3, result_update3, err := reconcileRegistrations(&last_input3, &current_input3)
 	if err != nil {
 		t.Error("Scenario 3: Expected nil error, got error", err)
 	}
@@ -247,4 +314,51 @@ func TestReconcileRegistrations(t *testing.T) {
 			t.Error("Scenario 3: Expected", expected_remove3, "got", result_remove3)
 		}
 	}
+	if len(*result_update3) > 0 {
+		t.Error("Scenario 3: Expected no updates, got", result_update3)
+	}
+
+	// Scenario 4, updates (values differ, other than Expires/RecordedAt) alongside an add and a remove.
+	last_input4 := Registrations{
+		"1020@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073, Contact: "sip:1020@192.168.1.20:5060", Expires: 1000, RecordedAt: 900},
+		"1021@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073, Contact: "sip:1021@192.168.1.21:5060"},
+		"1022@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.91", Port: 5073},
+		"1023@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073},
+	}
+	current_input4 := Registrations{
+		"1020@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073, Contact: "sip:1020@192.168.1.20:5060", Expires: 2000, RecordedAt: 1900},
+		"1021@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073, Contact: "sip:1021@192.168.1.99:5060"},
+		"1022@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073},
+		"1024@sip.testserver.tld/10.20.30.90:5073": KvBackendValue{Host: "10.20.30.90", Port: 5073},
+	}
+	expected_add4 := []string{"1024@sip.testserver.tld/10.20.30.90:5073"}
+	expected_remove4 := []string{"1023@sip.testserver.tld/10.20.30.90:5073"}
+	expected_update4 := []string{"1021@sip.testserver.tld/10.20.30.90:5073", "1022@sip.testserver.tld/10.20.30.90:5073"}
+	result_add4, result_remove4, result_update4, err := reconcileRegistrations(&last_input4, &current_input4)
+	if err != nil {
+		t.Error("Scenario 4: Expected nil error, got error", err)
+	}
+	if reflect.DeepEqual(*result_add4, expected_add4) != true {
+		t.Error("Scenario 4: Expected", expected_add4, "got", result_add4)
+	}
+	if reflect.DeepEqual(*result_remove4, expected_remove4) != true {
+		t.Error("Scenario 4: Expected", expected_remove4, "got", result_remove4)
+	}
+	if reflect.DeepEqual(*result_update4, expected_update4) != true {
+		t.Error("Scenario 4: Expected", expected_update4, "got", result_update4)
+	}
+}
+
+func BenchmarkReconcileRegistrations(b *testing.B) {
+	last_input := make(Registrations)
+	current_input := make(Registrations)
+	for i := 0; i < 50000; i++ {
+		key := getRegistrationKey(fmt.Sprintf("%d@sip.testserver.tld", i), "10.20.30.90", 5073)
+		last_input[key] = KvBackendValue{Host: "10.20.30.90", Port: 5073}
+		current_input[key] = KvBackendValue{Host: "10.20.30.90", Port: 5073}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reconcileRegistrations(&last_input, &current_input)
+	}
 }
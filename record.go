@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/0x19/goesl"
+	"golang.org/x/net/context"
+)
+
+// Set from --record, nil when not recording.
+var eslRecorder *EslRecorder
+
+// A message received from FreeSWITCH, one per line of a recording.
+type EslRecord struct {
+	Time time.Time `json:"time"`
+	// "event" (received by watchForRegistrationEvents()), "xmlstatus" (a response fetched by getFreeswitchRegistrations()),
+	// "profiles" (the running Sofia profiles fetched by getFreeswitchSofiaProfiles()) or "profile_info" (a Sofia profile's
+	// details fetched by getFreeswitchProfileAdvertiseAddress()).
+	// Or "sync_begin"/"sync_end" (without a message), around the xmlstatus responses of a full sync. Events can be
+	// recorded in between, and there is no sync_end if fetching the registrations failed.
+	Source string `json:"source"`
+	// For xmlstatus and profile_info only, the Sofia profile.
+	Profile string            `json:"profile,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Base64 encoded by encoding/json, as it isn't necessarily UTF-8.
+	Body []byte `json:"body,omitempty"`
+}
+
+// Appends EslRecords to a file as JSON lines, safe to use from multiple goroutines.
+type EslRecorder struct {
+	writer  io.WriteCloser
+	encoder *json.Encoder
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+func newEslRecorder(writer io.WriteCloser) *EslRecorder {
+	return &EslRecorder{
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+		now:     time.Now,
+	}
+}
+
+// Appends to the file if it already exists.
+func openEslRecorder(path string) (*EslRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return newEslRecorder(f), nil
+}
+
+// Does nothing if r is nil (not recording). Failures are only logged, recording should never get in the way.
+func (r *EslRecorder) Record(source string, profile string, msg *goesl.Message) {
+	if r == nil {
+		return
+	}
+	r.encode(EslRecord{Source: source, Profile: profile, Headers: msg.Headers, Body: msg.Body})
+}
+
+// As Record(), for sync_begin/sync_end.
+func (r *EslRecorder) RecordMarker(source string) {
+	if r == nil {
+		return
+	}
+	r.encode(EslRecord{Source: source})
+}
+
+func (r *EslRecorder) encode(record EslRecord) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	record.Time = r.now()
+	err := r.encoder.Encode(record)
+	if err != nil {
+		log.Printf("WARNING: EslRecorder.Record(): %s\n", err)
+	}
+}
+
+func (r *EslRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.writer.Close()
+}
+
+// Events and full syncs replayed by replayEslRecords().
+type ReplayResult struct {
+	Events      int
+	Syncs       int
+	FailedSyncs int
+}
+
+// Feeds a recording through the same handling as when live: events are applied as watchForRegistrationEvents() would,
+// and each full sync's xmlstatus responses are reconciled against the K/V backend as syncRegistrations() would.
+// Waits between messages as recorded, divided by speed (0 for no waiting). Returns early if ctx is cancelled.
+func replayEslRecords(ctx context.Context, reader io.Reader, speed float64, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig) (*ReplayResult, error) {
+	result := new(ReplayResult)
+	decoder := json.NewDecoder(reader)
+	// xmlstatus responses of the current full sync (in_sync is set between sync_begin and sync_end), and the K/V
+	// backend as of sync_begin, as a live sync reads it before fetching from FreeSWITCH.
+	var pending_sync []EslRecord
+	var pending_last_active_registrations *map[string]string
+	var pending_err error
+	in_sync := false
+	var last_time time.Time
+	for n := 1; ; n++ {
+		var record EslRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("Record %d: %s", n, err)
+		}
+		if speed > 0 && last_time.IsZero() == false && record.Time.After(last_time) {
+			select {
+			case <-time.After(time.Duration(float64(record.Time.Sub(last_time)) / speed)):
+			case <-ctx.Done():
+				return result, ctx.Err()
+			}
+		}
+		last_time = record.Time
+		switch record.Source {
+		case "event":
+			// As per watchForRegistrationEvents(), HEARTBEATs are only used for liveness.
+			if record.Headers["Event-Name"] == "HEARTBEAT" {
+				continue
+			}
+			result.Events++
+			handleFreeswitchRegEvent(&goesl.Message{Headers: record.Headers, Body: record.Body}, advertise_ip, advertise_port, kv_backend, runtime_config, nil)
+		case "sync_begin":
+			if in_sync == true {
+				// As when live, fetching the registrations failed part way, so nothing was applied.
+				result.Syncs++
+				result.FailedSyncs++
+				log.Printf("WARNING: replayEslRecords(): Sync %d failed: Incomplete, record %d starts another.\n", result.Syncs, n)
+			}
+			pending_sync = nil
+			pending_last_active_registrations, pending_err = readSyncLastRegistrations(kv_backend)
+			in_sync = true
+		case "xmlstatus":
+			if in_sync == false {
+				log.Printf("WARNING: replayEslRecords(): Record %d: xmlstatus outside of a sync, ignoring.\n", n)
+				continue
+			}
+			pending_sync = append(pending_sync, record)
+		case "sync_end":
+			if in_sync == false {
+				log.Printf("WARNING: replayEslRecords(): Record %d: sync_end without a sync_begin, ignoring.\n", n)
+				continue
+			}
+			result.Syncs++
+			err := pending_err
+			if err == nil {
+				err = replayEslSync(ctx, pending_sync, pending_last_active_registrations, advertise_ip, advertise_port, kv_backend, runtime_config)
+			}
+			if err != nil {
+				log.Printf("WARNING: replayEslRecords(): Sync %d failed: %s\n", result.Syncs, err)
+				result.FailedSyncs++
+			}
+			pending_sync = nil
+			in_sync = false
+		case "profiles":
+			// Only used with --fsprofiles auto, so events are filtered as they were when recorded.
+			running_profiles, err := parseFreeswitchSofiaStatus(record.Body)
+			if err != nil {
+				return result, fmt.Errorf("Record %d: %s", n, err)
+			}
+			runtime_config.SetDiscoveredSofiaProfiles(running_profiles)
+		case "profile_info":
+			// Only used with --fsadvertisefrom, otherwise the replay advertises everything with --fsadvertiseip/--fsadvertiseport.
+			advertise_from := runtime_config.AdvertiseFrom()
+			if len(advertise_from) == 0 {
+				continue
+			}
+			address, err := parseFreeswitchProfileAdvertiseAddress(record.Profile, record.Body, advertise_from)
+			if err != nil {
+				// As when live, the sync this was part of failed.
+				log.Printf("WARNING: replayEslRecords(): Record %d: %s\n", n, err)
+				continue
+			}
+			runtime_config.SetProfileAdvertiseAddress(record.Profile, address)
+		default:
+			return result, fmt.Errorf("Record %d: Unknown source '%s'.", n, record.Source)
+		}
+	}
+	if in_sync == true {
+		log.Printf("WARNING: replayEslRecords(): The recording ends part way through a sync, not applying it.\n")
+	}
+	return result, nil
+}
+
+// Reconciles the xmlstatus responses of a single full sync.
+func replayEslSync(ctx context.Context, records []EslRecord, raw_last_active_registrations *map[string]string, advertise_ip string, advertise_port int, kv_backend KvBackend, runtime_config *RuntimeConfig) error {
+	var raw_current_active_registrations []FsRegistration
+	seen_users := make(map[string]bool)
+	for _, v := range records {
+		registrations, err := parseFreeswitchXmlStatus(v.Profile, v.Body)
+		if err != nil {
+			return err
+		}
+		raw_current_active_registrations = mergeFreeswitchRegistrations(raw_current_active_registrations, seen_users, v.Profile, registrations)
+	}
+	plan, err := newFreeswitchSyncPlan(raw_last_active_registrations, &raw_current_active_registrations, advertise_ip, advertise_port, runtime_config)
+	if err != nil {
+		return err
+	}
+	return applySyncPlan(ctx, plan, kv_backend, runtime_config)
+}
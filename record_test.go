@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0x19/goesl"
+	"golang.org/x/net/context"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestEslRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := newEslRecorder(nopWriteCloser{&buf})
+	recorder.now = func() time.Time { return time.Unix(1470367071, 0).UTC() }
+	recorder.Record("event", "", getTestFreeswitchRegEvent())
+	// ISO-8859-1, as received from FreeSWITCH.
+	xmlstatus_body := []byte("<profile><registrations><registration><agent>M\xfcller</agent></registration></registrations></profile>")
+	recorder.Record("xmlstatus", "external", &goesl.Message{Headers: map[string]string{"Content-Type": "api/response"}, Body: xmlstatus_body})
+	// Not recording.
+	var nil_recorder *EslRecorder
+	nil_recorder.Record("event", "", getTestFreeswitchRegEvent())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected 2 lines, got", lines)
+	}
+	var result EslRecord
+	if err := json.Unmarshal([]byte(lines[1]), &result); err != nil {
+		t.Fatal(err)
+	}
+	expected_result := EslRecord{
+		Time:    time.Unix(1470367071, 0).UTC(),
+		Source:  "xmlstatus",
+		Profile: "external",
+		Headers: map[string]string{"Content-Type": "api/response"},
+		Body:    xmlstatus_body,
+	}
+	if reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
+
+// Keys and contacts only, the timestamps depend on when they were written.
+func getTestReplayRegistrations(t *testing.T, kv_backend KvBackend) []string {
+	registrations, err := readApiRegistrations(kv_backend, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for k, v := range *registrations {
+		result = append(result, k+" "+v.Contact)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Records a full sync and some events from the fake ESL server, then replays them into a fresh K/V backend.
+func TestReplayEslRecords(t *testing.T) {
+	var buf bytes.Buffer
+	eslRecorder = newEslRecorder(nopWriteCloser{&buf})
+	defer func() { eslRecorder = nil }()
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	fake_esl_server.SetRegistrations("internal", []FsRegProfileRegistration{getTestFakeEslRegistration("1000@sip.testserver.tld", 49210)})
+	fake_esl_server.SetRegistrations("external", []FsRegProfileRegistration{getTestFakeEslRegistration("1001@sip.testserver.tld", 49211)})
+	sync_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer sync_esl_conn.Close()
+	event_esl_conn := fake_esl_server.getTestEslConnection(t)
+	defer event_esl_conn.Close()
+	runtime_config := getTestRuntimeConfig([]string{"internal", "external"})
+	recorded_kv_backend := getTestMemoryKvBackend(t)
+
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	syncRegistrations(context.Background(), sync_esl_conn, "192.168.99.100", 5060, recorded_kv_backend, runtime_config, &test_wg, true, nil, make(chan error, 1))
+	event_channel := make(chan struct{})
+	defer close(event_channel)
+	test_wg.Add(1)
+	go watchForRegistrationEvents(context.Background(), event_esl_conn, "192.168.99.100", 5060, recorded_kv_backend, runtime_config, &test_wg, 3, event_channel, make(chan struct{}, 1))
+	<-event_channel
+	fake_esl_server.WaitForSubscription(t)
+	fake_esl_server.SendEvent(t, map[string]string{"Event-Name": "HEARTBEAT"})
+	fake_esl_server.SendEvent(t, getTestFakeEslRegEvent("sofia::register", "1002@sip.testserver.tld", 49212))
+	<-event_channel
+	fake_esl_server.SendEvent(t, getTestFakeEslRegEvent("sofia::expire", "1000@sip.testserver.tld", 49210))
+	<-event_channel
+	test_wg.Wait()
+	expected_result := []string{
+		"1001@sip.testserver.tld/192.168.99.100:5060 sip:1001@127.0.0.1:49211",
+		"1002@sip.testserver.tld/192.168.99.100:5060 sip:1002@127.0.0.1:49212",
+	}
+	if result := getTestReplayRegistrations(t, recorded_kv_backend); reflect.DeepEqual(result, expected_result) != true {
+		t.Fatal("Expected", expected_result, "got", result)
+	}
+
+	// 2 xmlstatus responses between sync_begin and sync_end (one full sync), then a HEARTBEAT and 2 events.
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 7 {
+		t.Fatal("Expected 7 recorded messages, got", lines)
+	}
+	replayed_kv_backend := getTestMemoryKvBackend(t)
+	// Left over from before, removed by the replayed sync.
+	if err := replayed_kv_backend.Write("1003@sip.testserver.tld/192.168.99.100:5060", "{\"host\":\"192.168.99.100\",\"port\":5060}", 300); err != nil {
+		t.Fatal(err)
+	}
+	result, err := replayEslRecords(context.Background(), bytes.NewReader(buf.Bytes()), 0, "192.168.99.100", 5060, replayed_kv_backend, runtime_config)
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected_replay_result := ReplayResult{Events: 2, Syncs: 1}
+	if *result != expected_replay_result {
+		t.Error("Expected", expected_replay_result, "got", *result)
+	}
+	if result := getTestReplayRegistrations(t, replayed_kv_backend); reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
+
+func TestReplayEslRecordsSpeed(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := newEslRecorder(nopWriteCloser{&buf})
+	now := time.Now()
+	recorder.now = func() time.Time { return now }
+	heartbeat := &goesl.Message{Headers: map[string]string{"Event-Name": "HEARTBEAT"}}
+	recorder.Record("event", "", heartbeat)
+	now = now.Add(2 * time.Second)
+	recorder.Record("event", "", heartbeat)
+
+	// 2 seconds at 20 times faster.
+	start := time.Now()
+	_, err := replayEslRecords(context.Background(), bytes.NewReader(buf.Bytes()), 20, "192.168.99.100", 5060, getTestMemoryKvBackend(t), getTestRuntimeConfig([]string{"internal"}))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Error("Expected around 100ms, took", elapsed)
+	}
+
+	_, err = replayEslRecords(context.Background(), strings.NewReader("{\"source\":\"event\",\"headers\":{}}\n{\"source\":\"unknown\"}\n"), 0, "192.168.99.100", 5060, getTestMemoryKvBackend(t), getTestRuntimeConfig([]string{"internal"}))
+	if err == nil || err.Error() != "Record 2: Unknown source 'unknown'." {
+		t.Error("Expected an unknown source error, got", err)
+	}
+}
+
+// Events are recorded from another goroutine, so can arrive part way through a sync.
+func TestReplayEslRecordsInterleaved(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := newEslRecorder(nopWriteCloser{&buf})
+	// Only used to generate the responses.
+	fake_esl_server := newFakeEslServer(t)
+	defer fake_esl_server.Close()
+	getXmlStatus := func(sofia_profile string, user string, port int) *goesl.Message {
+		fake_esl_server.SetRegistrations(sofia_profile, []FsRegProfileRegistration{getTestFakeEslRegistration(user, port)})
+		return &goesl.Message{Headers: map[string]string{"Content-Type": "api/response"}, Body: []byte(fake_esl_server.getXmlStatus(sofia_profile))}
+	}
+	// A sync that failed after the first profile, so was never applied.
+	recorder.RecordMarker("sync_begin")
+	recorder.Record("xmlstatus", "internal", getXmlStatus("internal", "1003@sip.testserver.tld", 49213))
+	// Then a complete sync, with an event between the two profiles.
+	recorder.RecordMarker("sync_begin")
+	recorder.Record("xmlstatus", "internal", getXmlStatus("internal", "1000@sip.testserver.tld", 49210))
+	recorder.Record("event", "", &goesl.Message{Headers: getTestFakeEslRegEvent("sofia::register", "1002@sip.testserver.tld", 49212)})
+	recorder.Record("xmlstatus", "external", getXmlStatus("external", "1001@sip.testserver.tld", 49211))
+	recorder.RecordMarker("sync_end")
+
+	replayed_kv_backend := getTestMemoryKvBackend(t)
+	result, err := replayEslRecords(context.Background(), bytes.NewReader(buf.Bytes()), 0, "192.168.99.100", 5060, replayed_kv_backend, getTestRuntimeConfig([]string{"internal", "external"}))
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	expected_replay_result := ReplayResult{Events: 1, Syncs: 2, FailedSyncs: 1}
+	if *result != expected_replay_result {
+		t.Error("Expected", expected_replay_result, "got", *result)
+	}
+	// The event is applied as it arrives, and left alone by the sync as it wasn't in the K/V backend when the sync
+	// started. 1003 was only in the failed sync, so is never written.
+	expected_result := []string{
+		"1000@sip.testserver.tld/192.168.99.100:5060 sip:1000@127.0.0.1:49210",
+		"1001@sip.testserver.tld/192.168.99.100:5060 sip:1001@127.0.0.1:49211",
+		"1002@sip.testserver.tld/192.168.99.100:5060 sip:1002@127.0.0.1:49212",
+	}
+	if result := getTestReplayRegistrations(t, replayed_kv_backend); reflect.DeepEqual(result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", result)
+	}
+}
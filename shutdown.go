@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// Call before starting handleShutdownSignals(), so a signal arriving before it runs is not missed.
+func notifyShutdownSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return signals
+}
+
+// On the first SIGINT/SIGTERM, cancels the goroutines started from main() and closes the ESL connections
+// to unblock any pending reads. A second signal exits immediately.
+func handleShutdownSignals(signals <-chan os.Signal, cancel context.CancelFunc, esl_conns ...*EslConnection) {
+	sig := <-signals
+	log.Printf("Received %s, shutting down...\n", sig)
+	cancel()
+	for _, v := range esl_conns {
+		v.Close()
+	}
+	sig = <-signals
+	log.Printf("Received %s again, exiting immediately.\n", sig)
+	os.Exit(1)
+}
+
+// On the first error sent on fatal_error_channel (by syncRegistrations(), for errors retrying won't fix), stores it
+// in fatal_err and shuts down as handleShutdownSignals() does. Returns once ctx is cancelled either way.
+func superviseFatalErrors(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, fatal_error_channel <-chan error, fatal_err *error, esl_conns ...*EslConnection) {
+	defer wg.Done()
+	select {
+	case err := <-fatal_error_channel:
+		log.Printf("ERROR: %s, shutting down...\n", err)
+		*fatal_err = err
+		cancel()
+		for _, v := range esl_conns {
+			v.Close()
+		}
+	case <-ctx.Done():
+	}
+}
+
+// Deletes every registration owned by this instance from the K/V backend.
+// Only call this once nothing else is writing to the K/V backend, or entries may be written back.
+func withdrawRegistrations(addresses []AdvertiseAddress, kv_backend KvBackend) error {
+	raw_last_active_registrations, err := kv_backend.Read("", true)
+	if err != nil {
+		if err.Error() == "KEY_NOT_FOUND" {
+			log.Printf("withdrawRegistrations(): No registrations found within K/V backend, nothing to withdraw.\n")
+			return nil
+		}
+		return err
+	}
+	last_active_registrations_typed, err := generateLastRegistrationsType(raw_last_active_registrations)
+	if err != nil {
+		return err
+	}
+	last_active_registrations := generateRegistrationListForThisInstance(last_active_registrations_typed, addresses)
+	// Carry on past individual failures, withdraw as much as possible before exiting.
+	var last_err error
+	withdraw_count := 0
+	for k, _ := range *last_active_registrations {
+		err = kv_backend.Delete(k)
+		if err != nil {
+			log.Printf("WARNING: withdrawRegistrations(): Error deleting '%s': %s\n", k, err)
+			last_err = err
+			continue
+		}
+		withdraw_count++
+	}
+	log.Printf("withdrawRegistrations(): Withdrew %d of %d registrations.\n", withdraw_count, len(*last_active_registrations))
+	return last_err
+}
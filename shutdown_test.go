@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestWithdrawRegistrations(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+
+	// Nothing to withdraw is not an error.
+	err := withdrawRegistrations([]AdvertiseAddress{{"10.0.0.1", 5060}}, test_kv_backend)
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+
+	this_instance_value := "{\"host\":\"10.0.0.1\",\"port\":5060}"
+	other_instance_value := "{\"host\":\"10.0.0.2\",\"port\":5060}"
+	for k, v := range map[string]string{
+		getRegistrationKey("1001@domain", "10.0.0.1", 5060): this_instance_value,
+		getRegistrationKey("1001@domain", "10.0.0.2", 5060): other_instance_value,
+		getRegistrationKey("1002@domain", "10.0.0.1", 5060): this_instance_value,
+	} {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = withdrawRegistrations([]AdvertiseAddress{{"10.0.0.1", 5060}}, test_kv_backend)
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	result, err := test_kv_backend.Read("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the other instance's entry is left.
+	expected_result := map[string]string{
+		getRegistrationKey("1001@domain", "10.0.0.2", 5060): other_instance_value,
+	}
+	if reflect.DeepEqual(*result, expected_result) != true {
+		t.Error("Expected", expected_result, "got", *result)
+	}
+}
+
+func TestSuperviseFatalErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var test_wg sync.WaitGroup
+	fatal_error_channel := make(chan error, 1)
+	var fatal_err error
+	test_wg.Add(1)
+	go superviseFatalErrors(ctx, cancel, &test_wg, fatal_error_channel, &fatal_err)
+	expected_err := errors.New("Invalid Sofia Profile 'internal'.")
+	fatal_error_channel <- expected_err
+	test_wg.Wait()
+	if fatal_err != expected_err {
+		t.Error("Expected", expected_err, "got", fatal_err)
+	}
+	if ctx.Err() == nil {
+		t.Error("Expected ctx to be cancelled")
+	}
+
+	// Shutting down otherwise leaves fatal_err as nil.
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	var fatal_err2 error
+	test_wg.Add(1)
+	go superviseFatalErrors(ctx2, cancel2, &test_wg, make(chan error, 1), &fatal_err2)
+	cancel2()
+	test_wg.Wait()
+	if fatal_err2 != nil {
+		t.Error("Expected nil error, got", fatal_err2)
+	}
+}
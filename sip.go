@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Largest SIP message accepted, over UDP this is the datagram size.
+const sipMaxMessageSize = 65535
+
+// Full header names for the compact forms (RFC 3261 section 7.3.3) we need to understand.
+var sipCompactHeaders = map[string]string{
+	"v": "via",
+	"f": "from",
+	"t": "to",
+	"i": "call-id",
+	"m": "contact",
+	"l": "content-length",
+}
+
+type sipHeader struct {
+	// Lower case, compact forms expanded.
+	Name  string
+	Value string
+}
+
+// Only what's needed to build a response, the body is ignored.
+type SipRequest struct {
+	Method     string
+	RequestUri string
+	Headers    []sipHeader
+}
+
+// Returns the first value of the header, empty if not present.
+func (r *SipRequest) Header(name string) string {
+	for _, v := range r.Headers {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+func parseSipRequest(data []byte) (*SipRequest, error) {
+	header_end := bytes.Index(data, []byte("\r\n\r\n"))
+	if header_end == -1 {
+		return nil, errors.New("No end of headers found.")
+	}
+	lines := strings.Split(string(data[:header_end]), "\r\n")
+	request_line := strings.Split(lines[0], " ")
+	if len(request_line) != 3 || request_line[2] != "SIP/2.0" {
+		// Also responses, which we never expect as we don't send any requests.
+		return nil, fmt.Errorf("Invalid request line '%s'.", lines[0])
+	}
+	result := &SipRequest{
+		Method:     strings.ToUpper(request_line[0]),
+		RequestUri: request_line[1],
+	}
+	for _, line := range lines[1:] {
+		// Folded onto multiple lines.
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(result.Headers) > 0 {
+			result.Headers[len(result.Headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		split_line := strings.SplitN(line, ":", 2)
+		if len(split_line) != 2 {
+			return nil, fmt.Errorf("Invalid header line '%s'.", line)
+		}
+		name := strings.ToLower(strings.TrimSpace(split_line[0]))
+		if full_name, ok := sipCompactHeaders[name]; ok == true {
+			name = full_name
+		}
+		result.Headers = append(result.Headers, sipHeader{Name: name, Value: strings.TrimSpace(split_line[1])})
+	}
+	return result, nil
+}
+
+// Returns the AOR (user@domain) of a sip: or sips: URI, without any port or parameters.
+func getSipUriAor(uri string) (string, error) {
+	lower_uri := strings.ToLower(uri)
+	switch {
+	case strings.HasPrefix(lower_uri, "sip:"):
+		uri = uri[len("sip:"):]
+	case strings.HasPrefix(lower_uri, "sips:"):
+		uri = uri[len("sips:"):]
+	default:
+		return "", fmt.Errorf("Unsupported URI '%s'.", uri)
+	}
+	if i := strings.IndexAny(uri, ";?"); i != -1 {
+		uri = uri[:i]
+	}
+	i := strings.LastIndex(uri, "@")
+	if i <= 0 {
+		return "", fmt.Errorf("No user in URI '%s'.", uri)
+	}
+	// user:password@host
+	user := strings.SplitN(uri[:i], ":", 2)[0]
+	domain := uri[i+1:]
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	domain = strings.Trim(domain, "[]")
+	if len(user) == 0 || len(domain) == 0 {
+		return "", fmt.Errorf("No user or domain in URI '%s'.", uri)
+	}
+	return fmt.Sprintf("%s@%s", user, strings.ToLower(domain)), nil
+}
+
+// Answers INVITEs with a 302 to every FreeSWITCH instance the Request-URI user@domain is registered on (404 if none),
+// so any SIP edge proxy can use the K/V store as a location service.
+type SipRedirector struct {
+	KvBackend KvBackend
+}
+
+func NewSipRedirector(kv_backend KvBackend) *SipRedirector {
+	return &SipRedirector{KvBackend: kv_backend}
+}
+
+// Builds a response to req, with Contact headers for each of contacts.
+func getSipResponse(req *SipRequest, code int, reason string, contacts []string, extra_headers ...sipHeader) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", code, reason)
+	for _, v := range req.Headers {
+		if v.Name == "via" {
+			fmt.Fprintf(&b, "Via: %s\r\n", v.Value)
+		}
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", req.Header("from"))
+	to := req.Header("to")
+	if strings.Contains(strings.ToLower(to), ";tag=") == false {
+		// The same for retransmissions of the request, so they get an identical response.
+		h := fnv.New32a()
+		io.WriteString(h, req.Header("call-id")+req.Header("cseq")+req.Header("from"))
+		to = fmt.Sprintf("%s;tag=%08x", to, h.Sum32())
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Call-ID: %s\r\n", req.Header("call-id"))
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.Header("cseq"))
+	for _, v := range contacts {
+		fmt.Fprintf(&b, "Contact: <%s>\r\n", v)
+	}
+	for _, v := range extra_headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", v.Name, v.Value)
+	}
+	fmt.Fprintf(&b, "Server: fs-registrator/%s\r\n", fs_registrator_version)
+	b.WriteString("Content-Length: 0\r\n\r\n")
+	return b.Bytes()
+}
+
+// Returns the response to send, nil if there's nothing to send (ACKs, or anything unparseable).
+func (s *SipRedirector) handleMessage(data []byte) []byte {
+	req, err := parseSipRequest(data)
+	if err != nil {
+		logDebugf("SipRedirector.handleMessage(): Ignoring message: %s\n", err)
+		return nil
+	}
+	if req.Method == "ACK" {
+		return nil
+	}
+	for _, v := range []string{"via", "from", "to", "call-id", "cseq"} {
+		if len(req.Header(v)) == 0 {
+			if v == "via" {
+				// Nowhere to send a response.
+				return nil
+			}
+			return getSipResponse(req, 400, "Bad Request", nil)
+		}
+	}
+	switch req.Method {
+	case "OPTIONS":
+		return getSipResponse(req, 200, "OK", nil)
+	case "INVITE":
+		// Handled below.
+	default:
+		return getSipResponse(req, 405, "Method Not Allowed", nil, sipHeader{Name: "Allow", Value: "INVITE, ACK, OPTIONS"})
+	}
+
+	aor, err := getSipUriAor(req.RequestUri)
+	if err != nil {
+		return getSipResponse(req, 416, "Unsupported URI Scheme", nil)
+	}
+	registrations, err := readApiRegistrations(s.KvBackend, aor)
+	if err != nil {
+		log.Printf("WARNING: SipRedirector.handleMessage(): Error looking up '%s': %s\n", aor, err)
+		return getSipResponse(req, 503, "Service Unavailable", nil)
+	}
+	results := groupRegistrationsByAor(registrations)
+	if len(results) == 0 {
+		logDebugf("SipRedirector.handleMessage(): '%s' is not registered.\n", aor)
+		return getSipResponse(req, 404, "Not Found", nil)
+	}
+	user := strings.SplitN(aor, "@", 2)[0]
+	var contacts []string
+	for _, v := range results[0].Registrations {
+		contacts = append(contacts, fmt.Sprintf("sip:%s@%s", user, net.JoinHostPort(v.Host, strconv.Itoa(v.Port))))
+	}
+	logDebugf("SipRedirector.handleMessage(): Redirecting '%s' to %v\n", aor, contacts)
+	return getSipResponse(req, 302, "Moved Temporarily", contacts)
+}
+
+// Reads a single message from a stream (TCP), delimited by Content-Length.
+func readSipStreamMessage(reader *bufio.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	content_length := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		// Skip keepalives (CRLF) between messages.
+		if b.Len() == 0 && strings.TrimSpace(line) == "" {
+			continue
+		}
+		b.WriteString(line)
+		if b.Len() > sipMaxMessageSize {
+			return nil, errors.New("Message too large.")
+		}
+		trimmed_line := strings.TrimSpace(line)
+		if trimmed_line == "" {
+			break
+		}
+		split_line := strings.SplitN(trimmed_line, ":", 2)
+		if len(split_line) == 2 {
+			name := strings.ToLower(strings.TrimSpace(split_line[0]))
+			if name == "content-length" || name == "l" {
+				content_length, err = strconv.Atoi(strings.TrimSpace(split_line[1]))
+				if err != nil || content_length < 0 || content_length > sipMaxMessageSize {
+					return nil, fmt.Errorf("Invalid Content-Length '%s'.", split_line[1])
+				}
+			}
+		}
+	}
+	body := make([]byte, content_length)
+	_, err := io.ReadFull(reader, body)
+	if err != nil {
+		return nil, err
+	}
+	b.Write(body)
+	return b.Bytes(), nil
+}
+
+func (s *SipRedirector) serveUdp(packet_conn net.PacketConn) error {
+	for {
+		buf := make([]byte, sipMaxMessageSize)
+		n, addr, err := packet_conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			response := s.handleMessage(buf[:n])
+			if response == nil {
+				return
+			}
+			_, err := packet_conn.WriteTo(response, addr)
+			if err != nil {
+				log.Printf("WARNING: SipRedirector.serveUdp(): Error responding to %s: %s\n", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *SipRedirector) serveTcpConn(ctx context.Context, conn net.Conn) {
+	conn_done := make(chan struct{})
+	defer close(conn_done)
+	// Unblock the read on shutdown.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-conn_done:
+		}
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := readSipStreamMessage(reader)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				logDebugf("SipRedirector.serveTcpConn(): Closing connection from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		response := s.handleMessage(data)
+		if response == nil {
+			continue
+		}
+		_, err = conn.Write(response)
+		if err != nil {
+			log.Printf("WARNING: SipRedirector.serveTcpConn(): Error responding to %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (s *SipRedirector) serveTcp(ctx context.Context, listener net.Listener) error {
+	var conns_wg sync.WaitGroup
+	defer conns_wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		conns_wg.Add(1)
+		go func() {
+			defer conns_wg.Done()
+			s.serveTcpConn(ctx, conn)
+		}()
+	}
+}
+
+// Serves redirector over UDP and TCP until ctx is cancelled, run within a goroutine from the redirect subcommand.
+func serveSip(ctx context.Context, packet_conn net.PacketConn, listener net.Listener, redirector *SipRedirector, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log.Printf("serveSip(): Listening on %s (UDP/TCP).\n", packet_conn.LocalAddr())
+	var servers_wg sync.WaitGroup
+	servers_wg.Add(2)
+	go func() {
+		defer servers_wg.Done()
+		err := redirector.serveUdp(packet_conn)
+		if ctx.Err() == nil {
+			log.Printf("WARNING: serveSip(): UDP: %s\n", err)
+		}
+	}()
+	go func() {
+		defer servers_wg.Done()
+		err := redirector.serveTcp(ctx, listener)
+		if ctx.Err() == nil {
+			log.Printf("WARNING: serveSip(): TCP: %s\n", err)
+		}
+	}()
+	// Closing the sockets on shutdown stops both servers (and any TCP connections).
+	<-ctx.Done()
+	packet_conn.Close()
+	listener.Close()
+	servers_wg.Wait()
+	log.Printf("serveSip(): Finished.\n")
+}
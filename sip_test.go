@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func getTestSipRequest(method string, request_uri string) string {
+	return method + " " + request_uri + " SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.1:5060;branch=z9hG4bK776asdhds\r\n" +
+		"v: SIP/2.0/UDP 192.168.1.2:5060;branch=z9hG4bK776asdhdt\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: <" + request_uri + ">\r\n" +
+		"From: <sip:1001@example.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 " + method + "\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"v=0\n"
+}
+
+func TestGetSipUriAor(t *testing.T) {
+	for input, expected_result := range map[string]string{
+		"sip:1000@example.com":                    "1000@example.com",
+		"sip:1000@Example.COM:5080;transport=tcp": "1000@example.com",
+		"sips:1000:secret@example.com?subject=hi": "1000@example.com",
+		"SIP:1000@[2001:db8::1]:5060":             "1000@2001:db8::1",
+		"sip:1000@[2001:db8::1]":                  "1000@2001:db8::1",
+	} {
+		result, err := getSipUriAor(input)
+		if err != nil || result != expected_result {
+			t.Errorf("Expected '%s' for '%s', got '%s' (%v)", expected_result, input, result, err)
+		}
+	}
+	for _, v := range []string{"tel:+15551234", "sip:example.com", "sip:@example.com"} {
+		if result, err := getSipUriAor(v); err == nil {
+			t.Errorf("Expected an error for '%s', got '%s'", v, result)
+		}
+	}
+}
+
+func TestSipRedirector(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	for k, v := range map[string]string{
+		"1000@example.com/10.0.0.1:5060": "{\"host\":\"10.0.0.1\",\"port\":5060}",
+		"1000@example.com/10.0.0.2:5080": "{\"host\":\"10.0.0.2\",\"port\":5080}",
+	} {
+		if err := test_kv_backend.Write(k, v, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	redirector := NewSipRedirector(test_kv_backend)
+
+	result1 := string(redirector.handleMessage([]byte(getTestSipRequest("INVITE", "sip:1000@example.com"))))
+	for _, v := range []string{
+		"SIP/2.0 302 Moved Temporarily\r\n",
+		// Both Via headers, in order.
+		"Via: SIP/2.0/UDP 192.168.1.1:5060;branch=z9hG4bK776asdhds\r\nVia: SIP/2.0/UDP 192.168.1.2:5060;branch=z9hG4bK776asdhdt\r\n",
+		"From: <sip:1001@example.com>;tag=1928301774\r\n",
+		"To: <sip:1000@example.com>;tag=",
+		"Call-ID: a84b4c76e66710\r\n",
+		"CSeq: 314159 INVITE\r\n",
+		"Contact: <sip:1000@10.0.0.1:5060>\r\nContact: <sip:1000@10.0.0.2:5080>\r\n",
+		"Content-Length: 0\r\n\r\n",
+	} {
+		if strings.Contains(result1, v) == false {
+			t.Errorf("Expected '%s' in response, got '%s'", v, result1)
+		}
+	}
+	// Retransmissions get the same response.
+	if result := string(redirector.handleMessage([]byte(getTestSipRequest("INVITE", "sip:1000@example.com")))); result != result1 {
+		t.Error("Expected an identical response to a retransmission, got", result)
+	}
+
+	for request, expected_status := range map[string]string{
+		getTestSipRequest("INVITE", "sip:1001@example.com"):                                                        "SIP/2.0 404 Not Found\r\n",
+		getTestSipRequest("INVITE", "tel:+15551234"):                                                               "SIP/2.0 416 Unsupported URI Scheme\r\n",
+		getTestSipRequest("OPTIONS", "sip:example.com"):                                                            "SIP/2.0 200 OK\r\n",
+		getTestSipRequest("REGISTER", "sip:example.com"):                                                           "SIP/2.0 405 Method Not Allowed\r\n",
+		strings.Replace(getTestSipRequest("INVITE", "sip:1000@example.com"), "Call-ID: a84b4c76e66710\r\n", "", 1): "SIP/2.0 400 Bad Request\r\n",
+	} {
+		if result := string(redirector.handleMessage([]byte(request))); strings.HasPrefix(result, expected_status) == false {
+			t.Errorf("Expected '%s', got '%s'", expected_status, result)
+		}
+	}
+	for _, v := range []string{
+		getTestSipRequest("ACK", "sip:1000@example.com"),
+		"SIP/2.0 200 OK\r\nContent-Length: 0\r\n\r\n",
+		"garbage",
+	} {
+		if result := redirector.handleMessage([]byte(v)); result != nil {
+			t.Errorf("Expected no response to '%s', got '%s'", v, result)
+		}
+	}
+}
+
+func TestServeSip(t *testing.T) {
+	test_kv_backend := getTestMemoryKvBackend(t)
+	if err := test_kv_backend.Write("1000@example.com/10.0.0.1:5060", "{\"host\":\"10.0.0.1\",\"port\":5060}", 300); err != nil {
+		t.Fatal(err)
+	}
+	packet_conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var test_wg sync.WaitGroup
+	test_wg.Add(1)
+	go serveSip(ctx, packet_conn, listener, NewSipRedirector(test_kv_backend), &test_wg)
+
+	// UDP
+	udp_conn, err := net.Dial("udp", packet_conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp_conn.Close()
+	udp_conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = udp_conn.Write([]byte(getTestSipRequest("INVITE", "sip:1000@example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, sipMaxMessageSize)
+	n, err := udp_conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(string(buf[:n]), "SIP/2.0 302 Moved Temporarily\r\n") == false {
+		t.Error("Expected a 302 over UDP, got", string(buf[:n]))
+	}
+
+	// TCP, two requests (with a keepalive between them) on the same connection.
+	tcp_conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp_conn.Close()
+	tcp_conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = tcp_conn.Write([]byte(getTestSipRequest("INVITE", "sip:1000@example.com") + "\r\n\r\n" + getTestSipRequest("INVITE", "sip:1001@example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(tcp_conn)
+	for _, expected_status := range []string{"SIP/2.0 302 Moved Temporarily\r\n", "SIP/2.0 404 Not Found\r\n"} {
+		result, err := readSipStreamMessage(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(result), expected_status) == false {
+			t.Errorf("Expected '%s' over TCP, got '%s'", expected_status, result)
+		}
+	}
+
+	// Should stop serving (including open TCP connections) on shutdown.
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		test_wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for serveSip() to return after cancelling")
+	}
+}